@@ -1,6 +1,7 @@
 package database
 
 import (
+	"encoding/json"
 	"io/fs"
 	"log"
 	"os"
@@ -53,6 +54,12 @@ func InitDB(dbPath string) error {
 	if err := initUser(); err != nil {
 		return err
 	}
+	if err := migrateUserRoles(); err != nil {
+		return err
+	}
+	if err := migrateClients(); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -61,7 +68,19 @@ func initModels() error {
 	// TODO: 添加可用的 model
 	models := []interface{}{
 		&model.User{},
+		&model.APIToken{},
 		&model.Inbound{},
+		&model.Client{},
+		&model.ClientInbound{},
+		&model.Plan{},
+		&model.ClientAlert{},
+		&model.Webhook{},
+		&model.WebhookDelivery{},
+		&model.EmailMessage{},
+		&model.SubIdAlias{},
+		&model.SubAccessLog{},
+		&model.TrafficHistory{},
+		&model.TrafficResetLog{},
 		// &model.OutboundTraffics{},
 		&model.Setting{},
 		// &model.InboundClientIps{},
@@ -73,6 +92,12 @@ func initModels() error {
 			return err
 		}
 	}
+	// Clients are sorted by usage, which gorm can not declare as an index
+	err := db.Exec("CREATE INDEX IF NOT EXISTS idx_client_traffics_usage ON client_traffics (up + down)").Error
+	if err != nil {
+		log.Printf("Error creating usage index: %v", err)
+		return err
+	}
 	return nil
 }
 
@@ -87,12 +112,24 @@ func initUser() error {
 			Username:    defaultUsername,
 			Password:    defaultPassword,
 			LoginSecret: defaultSecret,
+			Role:        model.RoleOwner,
 		}
 		return db.Create(user).Error
 	}
 	return nil
 }
 
+// migrateUserRoles makes users created before roles existed the owner.
+func migrateUserRoles() error {
+	err := db.Model(&model.User{}).
+		Where("role IS NULL OR role = ?", "").
+		Update("role", model.RoleOwner).Error
+	if err != nil {
+		log.Printf("Error migrating user roles: %v", err)
+	}
+	return err
+}
+
 func isTableEmpty(tableName string) (bool, error) {
 	var count int64
 	err := db.Table(tableName).Count(&count).Error
@@ -106,3 +143,54 @@ func GetDB() *gorm.DB {
 func IsNotFound(err error) bool {
 	return err == gorm.ErrRecordNotFound
 }
+
+// migrateClients moves the clients array out of the settings of every inbound
+// into the clients table.
+func migrateClients() error {
+	var inbounds []*model.Inbound
+	err := db.Model(model.Inbound{}).Where("settings LIKE ?", `%"clients"%`).Find(&inbounds).Error
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, inbound := range inbounds {
+			if !inbound.Protocol.HasClients() {
+				continue
+			}
+			settings := map[string]json.RawMessage{}
+			err := json.Unmarshal([]byte(inbound.Settings), &settings)
+			if err != nil {
+				log.Printf("Skipping clients of inbound %v: %v", inbound.Id, err)
+				continue
+			}
+			rawClients, ok := settings["clients"]
+			if !ok {
+				continue
+			}
+			var clients []model.Client
+			err = json.Unmarshal(rawClients, &clients)
+			if err != nil {
+				log.Printf("Error migrating clients of inbound %v: %v", inbound.Id, err)
+				return err
+			}
+			for i := range clients {
+				clients[i].InboundId = inbound.Id
+				if err := tx.Create(&clients[i]).Error; err != nil {
+					log.Printf("Error migrating client %v: %v", clients[i].Email, err)
+					return err
+				}
+			}
+			delete(settings, "clients")
+			newSettings, err := json.MarshalIndent(settings, "", "  ")
+			if err != nil {
+				return err
+			}
+			err = tx.Model(model.Inbound{}).Where("id = ?", inbound.Id).Update("settings", string(newSettings)).Error
+			if err != nil {
+				return err
+			}
+			log.Printf("Migrated %v clients of inbound %v", len(clients), inbound.Id)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"x-ui-scratch/database/model"
+)
+
+// uiClients are the settings of a VLESS inbound as the panel frontend saved
+// them before clients had their own table: tgId is an empty string unless a
+// Telegram id was typed in, and clients imported from older panels may lack
+// enable.
+const uiClients = `{
+  "clients": [
+    {
+      "id": "b831381d-6324-4d53-ad4f-8cda48b30811",
+      "flow": "xtls-rprx-vision",
+      "email": "alice",
+      "limitIp": 0,
+      "totalGB": 0,
+      "expiryTime": 0,
+      "enable": true,
+      "tgId": "",
+      "subId": "ny2kb8fhwmqa0ac4",
+      "reset": 0
+    },
+    {
+      "id": "0b8d6c9e-3f6d-4f0b-9f5e-2d7c0d1e6a41",
+      "flow": "",
+      "email": "bob",
+      "limitIp": 2,
+      "totalGB": 10737418240,
+      "expiryTime": 1700000000000,
+      "enable": false,
+      "tgId": "123456789",
+      "subId": "c4tq8w3m1x9v7zrd",
+      "reset": 30
+    },
+    {
+      "id": "7a4f2c1e-9d3b-4e8a-b6f0-1c2d3e4f5a6b",
+      "email": "carol",
+      "limitIp": 0,
+      "totalGB": 0,
+      "expiryTime": 0,
+      "tgId": 987654321,
+      "subId": "c4tq8w3m1x9v7zrd"
+    }
+  ],
+  "decryption": "none",
+  "fallbacks": []
+}`
+
+func TestMigrateClients(t *testing.T) {
+	if err := InitDB(filepath.Join(t.TempDir(), "x-ui.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	inbound := &model.Inbound{
+		Remark:   "vless",
+		Port:     443,
+		Protocol: model.VLESS,
+		Settings: uiClients,
+		Tag:      "inbound-443",
+	}
+	if err := db.Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateClients(); err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []model.Client
+	if err := db.Order("id").Find(&clients).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		email   string
+		enable  bool
+		tgId    int64
+		totalGB int64
+	}{
+		{"alice", true, 0, 0},
+		{"bob", false, 123456789, 10737418240},
+		{"carol", true, 987654321, 0},
+	}
+	if len(clients) != len(want) {
+		t.Fatalf("migrated %v clients, want %v", len(clients), len(want))
+	}
+	for i, w := range want {
+		c := clients[i]
+		if c.Email != w.email || c.Enable != w.enable || c.TgID != w.tgId || c.TotalGB != w.totalGB || c.InboundId != inbound.Id {
+			t.Errorf("client %v = %+v, want %+v", i, c, w)
+		}
+	}
+
+	var settings map[string]json.RawMessage
+	if err := db.First(inbound, inbound.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := settings["clients"]; ok {
+		t.Errorf("clients left in the settings: %v", inbound.Settings)
+	}
+	if string(settings["decryption"]) != `"none"` {
+		t.Errorf("settings lost decryption: %v", inbound.Settings)
+	}
+}
+
+func TestClientUnmarshalInvalidTgId(t *testing.T) {
+	var client model.Client
+	err := json.Unmarshal([]byte(`{"email":"dave","tgId":"@dave"}`), &client)
+	if err == nil {
+		t.Errorf("tgId @dave accepted as %v", client.TgID)
+	}
+}
@@ -1,18 +1,135 @@
 package model
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"x-ui-scratch/util/json_util"
 	"x-ui-scratch/xray"
 )
 
 type Protocol string
 
+const (
+	VMESS       Protocol = "vmess"
+	VLESS       Protocol = "vless"
+	DOKODEMO    Protocol = "dokodemo-door"
+	HTTP        Protocol = "http"
+	Trojan      Protocol = "trojan"
+	Shadowsocks Protocol = "shadowsocks"
+	Socks       Protocol = "socks"
+	WireGuard   Protocol = "wireguard"
+)
+
+func (p Protocol) IsValid() bool {
+	switch p {
+	case VMESS, VLESS, DOKODEMO, HTTP, Trojan, Shadowsocks, Socks, WireGuard:
+		return true
+	}
+	return false
+}
+
+// HasClients reports whether inbounds of this protocol have clients, with one
+// ClientTraffic row per client email.
+func (p Protocol) HasClients() bool {
+	switch p {
+	case VMESS, VLESS, Trojan, Shadowsocks:
+		return true
+	}
+	return false
+}
+
+// Role is the access level of a panel administrator.
+type Role string
+
+const (
+	// RoleOwner has full access to the panel, including server and user management.
+	RoleOwner Role = "owner"
+	// RoleOperator can view everything and manage clients, but not inbounds or the server.
+	RoleOperator Role = "operator"
+	// RoleAuditor has read-only access.
+	RoleAuditor Role = "auditor"
+	// RoleReseller can only see and manage the inbounds (and their clients) it owns.
+	RoleReseller Role = "reseller"
+)
+
+// Permission is a single capability checked by the controllers.
+type Permission string
+
+const (
+	PermRead          Permission = "read"
+	PermClientsWrite  Permission = "clients:write"
+	PermInboundsWrite Permission = "inbounds:write"
+	PermServerAdmin   Permission = "server:admin"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleOwner:    {PermRead, PermClientsWrite, PermInboundsWrite, PermServerAdmin},
+	RoleOperator: {PermRead, PermClientsWrite},
+	RoleAuditor:  {PermRead},
+	RoleReseller: {PermRead, PermClientsWrite, PermInboundsWrite},
+}
+
+func (r Role) IsValid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (r Role) Can(perm Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
 type User struct {
-	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`
-	Username    string `json:"username"`
-	Password    string `json:"password"`
-	LoginSecret string `json:"loginSecret"`
+	Id          int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Username    string `json:"username" form:"username"`
+	Password    string `json:"password" form:"password"`
+	LoginSecret string `json:"loginSecret" form:"loginSecret"`
+	Role        Role   `json:"role" form:"role"`
+}
+
+// APIToken is a long-lived credential for the /panel/api endpoints. Only the
+// SHA-256 hash of the token is stored; the token itself is shown once on creation.
+type APIToken struct {
+	Id         int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	UserId     int    `json:"userId" form:"userId" gorm:"index"`
+	Name       string `json:"name" form:"name"`
+	Prefix     string `json:"prefix" form:"prefix"`
+	TokenHash  string `json:"-" gorm:"uniqueIndex"`
+	Scopes     string `json:"scopes" form:"scopes"`
+	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
+	LastUsed   int64  `json:"lastUsed" form:"lastUsed"`
+	CreatedAt  int64  `json:"createdAt" form:"createdAt"`
+}
+
+func (t *APIToken) GetScopes() []Permission {
+	var scopes []Permission
+	for _, scope := range strings.Split(t.Scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope != "" {
+			scopes = append(scopes, Permission(scope))
+		}
+	}
+	return scopes
+}
+
+func (t *APIToken) HasScope(perm Permission) bool {
+	for _, scope := range t.GetScopes() {
+		if scope == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsScoped reports whether the user may only access the inbounds it owns.
+func (u *User) IsScoped() bool {
+	return u.Role == RoleReseller
 }
 
 type Setting struct {
@@ -23,14 +140,20 @@ type Setting struct {
 
 type Inbound struct {
 	Id          int                  `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
-	UserId      int                  `json:"-"`
+	UserId      int                  `json:"userId" form:"userId"`
 	Up          int64                `json:"up" form:"up"`
 	Down        int64                `json:"down" form:"down"`
 	Total       int64                `json:"total" form:"total"`
 	Remark      string               `json:"remark" form:"remark"`
 	Enable      bool                 `json:"enable" form:"enable"`
 	ExpiryTime  int64                `json:"expiryTime" form:"expiryTime"`
+	SpeedLimit  int64                `json:"speedLimit" form:"speedLimit"`
 	ClientStats []xray.ClientTraffic `gorm:"foreignKey:InboundId;references:Id" json:"clientStats" form:"clientStats"`
+	Clients     []Client             `gorm:"foreignKey:InboundId;references:Id" json:"clients" form:"-"`
+
+	TrafficReset         ResetPeriod `json:"trafficReset" form:"trafficReset" gorm:"default:never"`
+	ResetDay             int         `json:"resetDay" form:"resetDay"`
+	LastTrafficResetTime int64       `json:"lastTrafficResetTime" form:"-"`
 
 	// config part
 	Listen         string   `json:"listen" form:"listen"`
@@ -59,3 +182,289 @@ func (i *Inbound) GenXrayInboundConfig() *xray.InboundConfig {
 		Allocate:       json_util.RawMessage(i.Allocate),
 	}
 }
+
+// Client is a user of an inbound. Clients are stored in their own table and
+// only rendered into settings.clients when the Xray config is built. The JSON
+// names match the entries of settings.clients. SpeedLimit is in bytes per
+// second, 0 meaning unlimited.
+type Client struct {
+	Id         int    `json:"-" gorm:"primaryKey;autoIncrement"`
+	InboundId  int    `json:"inboundId" form:"inboundId" gorm:"index"`
+	UUID       string `json:"id" form:"id" gorm:"column:uuid;index"`
+	Password   string `json:"password" form:"password"`
+	Flow       string `json:"flow" form:"flow"`
+	Method     string `json:"method,omitempty" form:"method"`
+	Email      string `json:"email" form:"email" gorm:"uniqueIndex"`
+	LimitIP    int    `json:"limitIp" form:"limitIp"`
+	TotalGB    int64  `json:"totalGB" form:"totalGB"`
+	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
+	Enable     bool   `json:"enable" form:"enable"`
+	TgID       int64  `json:"tgId" form:"tgId"`
+	SubID      string `json:"subId" form:"subId" gorm:"index"`
+	Reset      int    `json:"reset" form:"reset"`
+	SpeedLimit int64  `json:"speedLimit" form:"speedLimit"`
+
+	TrafficReset         ResetPeriod `json:"trafficReset" form:"trafficReset" gorm:"default:never"`
+	ResetDay             int         `json:"resetDay" form:"resetDay"`
+	LastTrafficResetTime int64       `json:"lastTrafficResetTime" form:"-"`
+
+	QuotaAction QuotaAction `json:"quotaAction" form:"quotaAction" gorm:"default:cut"`
+	QuotaGrace  int         `json:"quotaGrace" form:"quotaGrace"`
+
+	PlanId int `json:"planId" form:"planId" gorm:"index"`
+}
+
+// UnmarshalJSON reads a client the way the frontend saves it: tgId may be a
+// number, a string of one or empty, and a client without enable is enabled.
+func (c *Client) UnmarshalJSON(data []byte) error {
+	type client Client
+	raw := struct {
+		*client
+		TgID   json.RawMessage `json:"tgId"`
+		Enable *bool           `json:"enable"`
+	}{client: (*client)(c)}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	c.Enable = raw.Enable == nil || *raw.Enable
+	c.TgID = 0
+	tgId := string(raw.TgID)
+	if unquoted, err := strconv.Unquote(tgId); err == nil {
+		tgId = strings.TrimSpace(unquoted)
+	}
+	if tgId != "" && tgId != "null" {
+		c.TgID, err = strconv.ParseInt(tgId, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid tgId of client %v: %v", c.Email, string(raw.TgID))
+		}
+	}
+	return nil
+}
+
+// ClientInbound links a client to an inbound besides its own. The client is
+// served on every linked inbound with the same credentials, and its traffic
+// there counts against the same quota and expiry.
+type ClientInbound struct {
+	ClientId  int `json:"clientId" gorm:"primaryKey"`
+	InboundId int `json:"inboundId" gorm:"primaryKey;index"`
+}
+
+// Plan is a package clients are provisioned and renewed from. Days is the
+// validity of a subscription, 0 meaning it never expires, and Inbounds are the
+// ids of the inbounds its clients may be created on.
+type Plan struct {
+	Id           int         `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name         string      `json:"name" form:"name" gorm:"unique"`
+	TotalGB      int64       `json:"totalGB" form:"totalGB"`
+	Days         int         `json:"days" form:"days"`
+	TrafficReset ResetPeriod `json:"trafficReset" form:"trafficReset" gorm:"default:never"`
+	ResetDay     int         `json:"resetDay" form:"resetDay"`
+	SpeedLimit   int64       `json:"speedLimit" form:"speedLimit"`
+	LimitIP      int         `json:"limitIp" form:"limitIp"`
+	Flow         string      `json:"flow" form:"flow"`
+	Inbounds     []int       `json:"inbounds" form:"inbounds" gorm:"serializer:json"`
+}
+
+// QuotaAction is what happens to a client whose usage reaches its quota plus
+// the QuotaGrace percentage: it is cut off, throttled to the quota throttle
+// speed, or routed to the quota-exceeded outbound. Throttled clients are cut
+// off instead while there is no throttle speed or speed limit shaper.
+type QuotaAction string
+
+const (
+	QuotaCut      QuotaAction = "cut"
+	QuotaThrottle QuotaAction = "throttle"
+	QuotaRedirect QuotaAction = "redirect"
+)
+
+func (a QuotaAction) IsValid() bool {
+	switch a {
+	case QuotaCut, QuotaThrottle, QuotaRedirect:
+		return true
+	}
+	return false
+}
+
+// NotifyEvent is a condition clients and admins are notified about.
+type NotifyEvent string
+
+const (
+	// NotifyExpiring is sent when a client expires within the expireDiff days.
+	NotifyExpiring NotifyEvent = "expiring"
+	// NotifyTraffic is sent when a client used trafficWarnPercent of its
+	// quota or has less than trafficDiff GB left.
+	NotifyTraffic NotifyEvent = "traffic"
+	// NotifyDepleted is sent when a client has used up its quota or expired.
+	NotifyDepleted NotifyEvent = "depleted"
+	// NotifyDisabled is sent when a client has been cut off for that.
+	NotifyDisabled NotifyEvent = "disabled"
+	// NotifyRenewed is sent when the expiry of a client has been extended.
+	NotifyRenewed NotifyEvent = "renewed"
+)
+
+// ClientAlert records that a notification condition holds for a client, so it
+// is notified only once until the condition clears. For NotifyRenewed it
+// tracks the last expiry seen instead.
+type ClientAlert struct {
+	Email      string      `json:"email" gorm:"primaryKey"`
+	Event      NotifyEvent `json:"event" gorm:"primaryKey"`
+	ExpiryTime int64       `json:"expiryTime"`
+	Time       int64       `json:"time"`
+}
+
+// WebhookEvent is a panel event webhooks can subscribe to.
+type WebhookEvent string
+
+const (
+	WebhookClientCreated  WebhookEvent = "client.created"
+	WebhookClientUpdated  WebhookEvent = "client.updated"
+	WebhookClientDeleted  WebhookEvent = "client.deleted"
+	WebhookClientDepleted WebhookEvent = "client.depleted"
+	WebhookClientExpired  WebhookEvent = "client.expired"
+	WebhookClientRenewed  WebhookEvent = "client.renewed"
+	WebhookInboundChanged WebhookEvent = "inbound.changed"
+	WebhookXrayCrashed    WebhookEvent = "xray.crashed"
+	WebhookXrayRestarted  WebhookEvent = "xray.restarted"
+	WebhookLoginSuccess   WebhookEvent = "login.success"
+	WebhookLoginFailed    WebhookEvent = "login.failed"
+)
+
+func (e WebhookEvent) IsValid() bool {
+	switch e {
+	case WebhookClientCreated, WebhookClientUpdated, WebhookClientDeleted,
+		WebhookClientDepleted, WebhookClientExpired, WebhookClientRenewed,
+		WebhookInboundChanged, WebhookXrayCrashed, WebhookXrayRestarted,
+		WebhookLoginSuccess, WebhookLoginFailed:
+		return true
+	}
+	return false
+}
+
+// Webhook posts the events it subscribes to, or all events when Events is
+// empty, to a URL. The payloads are signed with Secret.
+type Webhook struct {
+	Id     int            `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name   string         `json:"name" form:"name"`
+	URL    string         `json:"url" form:"url"`
+	Secret string         `json:"secret" form:"secret"`
+	Events []WebhookEvent `json:"events" form:"events" gorm:"serializer:json"`
+	Enable bool           `json:"enable" form:"enable"`
+}
+
+// WebhookDelivery is an event sent or to be sent to a webhook. Failed
+// deliveries are retried at NextAttempt until they run out of attempts.
+type WebhookDelivery struct {
+	Id          int          `json:"id" gorm:"primaryKey;autoIncrement"`
+	WebhookId   int          `json:"webhookId" gorm:"index"`
+	Event       WebhookEvent `json:"event"`
+	Payload     string       `json:"payload"`
+	Attempts    int          `json:"attempts"`
+	StatusCode  int          `json:"statusCode"`
+	Error       string       `json:"error"`
+	Delivered   bool         `json:"delivered" gorm:"index"`
+	NextAttempt int64        `json:"nextAttempt"`
+	LastAttempt int64        `json:"lastAttempt"`
+	Time        int64        `json:"time" gorm:"index"`
+}
+
+// EmailMessage is an email waiting in the mail queue. Sent messages leave the
+// queue; failed ones are retried at NextAttempt until they run out of
+// attempts.
+type EmailMessage struct {
+	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	To          string `json:"to"`
+	Subject     string `json:"subject"`
+	Body        string `json:"body"`
+	Attempts    int    `json:"attempts"`
+	Error       string `json:"error"`
+	NextAttempt int64  `json:"nextAttempt" gorm:"index"`
+	Time        int64  `json:"time"`
+}
+
+// SubIdAlias keeps a replaced subscription id working until ExpiryTime, so
+// client apps have time to switch to the new id, Target.
+type SubIdAlias struct {
+	SubId      string `json:"subId" gorm:"primaryKey"`
+	Target     string `json:"target" gorm:"index"`
+	ExpiryTime int64  `json:"expiryTime" gorm:"index"`
+}
+
+// SubAccessLog is a fetch of a subscription, under its current id.
+// RequestedId is the id it was fetched by, a replaced one during its grace
+// period.
+type SubAccessLog struct {
+	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	SubId       string `json:"subId" gorm:"index"`
+	RequestedId string `json:"requestedId"`
+	Ip          string `json:"ip"`
+	UserAgent   string `json:"userAgent"`
+	Status      int    `json:"status"`
+	Time        int64  `json:"time" gorm:"index"`
+}
+
+// ResetPeriod is the calendar schedule on which the traffic of an inbound or
+// a client is reset. ResetDay is the weekday (0 = Sunday) for weekly resets
+// and the day of the month for monthly ones; shorter months reset on their
+// last day.
+type ResetPeriod string
+
+const (
+	ResetNever   ResetPeriod = "never"
+	ResetDaily   ResetPeriod = "daily"
+	ResetWeekly  ResetPeriod = "weekly"
+	ResetMonthly ResetPeriod = "monthly"
+)
+
+func (p ResetPeriod) IsValid(day int) bool {
+	switch p {
+	case ResetNever, ResetDaily:
+		return true
+	case ResetWeekly:
+		return day >= 0 && day <= 6
+	case ResetMonthly:
+		return day >= 1 && day <= 31
+	}
+	return false
+}
+
+// TrafficResetLog records a scheduled traffic reset of an inbound (Email is
+// empty) or a client, with the usage it cleared.
+type TrafficResetLog struct {
+	Id        int         `json:"id" gorm:"primaryKey;autoIncrement"`
+	InboundId int         `json:"inboundId" gorm:"index"`
+	Email     string      `json:"email"`
+	Period    ResetPeriod `json:"period"`
+	Up        int64       `json:"up"`
+	Down      int64       `json:"down"`
+	Time      int64       `json:"time" gorm:"index"`
+}
+
+// HistoryPeriod is the length of a TrafficHistory bucket.
+type HistoryPeriod string
+
+const (
+	PeriodHour  HistoryPeriod = "hour"
+	PeriodDay   HistoryPeriod = "day"
+	PeriodMonth HistoryPeriod = "month"
+)
+
+func (p HistoryPeriod) IsValid() bool {
+	switch p {
+	case PeriodHour, PeriodDay, PeriodMonth:
+		return true
+	}
+	return false
+}
+
+// TrafficHistory is the traffic of an inbound (Email is empty) or of a client
+// (InboundId is 0) in the bucket of the given period starting at Time.
+type TrafficHistory struct {
+	Id        int           `json:"-" gorm:"primaryKey;autoIncrement"`
+	InboundId int           `json:"inboundId" gorm:"uniqueIndex:idx_traffic_history_bucket,priority:2"`
+	Email     string        `json:"email" gorm:"uniqueIndex:idx_traffic_history_bucket,priority:1"`
+	Period    HistoryPeriod `json:"period" gorm:"uniqueIndex:idx_traffic_history_bucket,priority:3;index:idx_traffic_history_time,priority:1"`
+	Time      int64         `json:"time" gorm:"uniqueIndex:idx_traffic_history_bucket,priority:4;index:idx_traffic_history_time,priority:2"`
+	Up        int64         `json:"up"`
+	Down      int64         `json:"down"`
+}
@@ -1,10 +1,43 @@
 package sub
 
-import "context"
+import (
+	"context"
+	"crypto/tls"
+	"embed"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
 
+	"x-ui-scratch/config"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/web"
+	"x-ui-scratch/web/locale"
+	"x-ui-scratch/web/middleware"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed html/*
+var htmlFS embed.FS
+
+// Server serves the subscriptions of clients on its own listen address,
+// port, path and domain. It serves over HTTPS when a certificate is set.
 type Server struct {
+	httpServer *http.Server
+	listener   net.Listener
+
+	sub *SUBController
+
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	settingService service.SettingService
+	subService     SubService
 }
 
 func NewServer() *Server {
@@ -15,6 +48,70 @@ func NewServer() *Server {
 	}
 }
 
+func (s *Server) initRouter() (*gin.Engine, error) {
+	if !config.IsDebug() {
+		gin.DefaultWriter = io.Discard
+		gin.DefaultErrorWriter = io.Discard
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	engine := gin.Default()
+
+	subDomain, err := s.settingService.GetSubDomain()
+	if err != nil {
+		return nil, err
+	}
+
+	if subDomain != "" {
+		engine.Use(middleware.DomainValidatorMiddleware(subDomain))
+	}
+
+	// Client addresses are taken from the X-Forwarded-For and X-Real-IP
+	// headers only when a trusted reverse proxy sent them.
+	trustedProxies, err := s.settingService.GetSubTrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+	err = engine.SetTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	subPath, err := s.settingService.GetSubPath()
+	if err != nil {
+		return nil, err
+	}
+
+	subJsonPath, err := s.settingService.GetSubJsonPath()
+	if err != nil {
+		return nil, err
+	}
+	if subJsonPath == subPath {
+		return nil, common.NewError("the json subscription path must differ from the subscription path:", subPath)
+	}
+
+	// The status page is localized like the panel, whose translations are
+	// loaded by the web server.
+	engine.FuncMap["i18n"] = func(key string, params ...string) string {
+		return locale.I18n(locale.Web, key, params...)
+	}
+	engine.Use(locale.LocalizerMiddleware())
+	t, err := template.New("").Funcs(engine.FuncMap).ParseFS(htmlFS, "html/*.html")
+	if err != nil {
+		return nil, err
+	}
+	engine.SetHTMLTemplate(t)
+	// The assets are served next to the subscriptions, so the page finds
+	// them behind reverse proxies as well.
+	engine.StaticFS(subPath+"assets", http.FS(web.EmbeddedAssets()))
+
+	g := engine.Group("/")
+
+	s.sub = NewSUBController(g, subPath, subJsonPath)
+
+	return engine, nil
+}
+
 func (s *Server) Start() (err error) {
 	// This is an anonymous function, no function name
 	defer func() {
@@ -22,12 +119,79 @@ func (s *Server) Start() (err error) {
 			s.Stop()
 		}
 	}()
-	// TODO
+
+	subEnable, err := s.settingService.GetSubEnable()
+	if err != nil {
+		return err
+	}
+	if !subEnable {
+		return nil
+	}
+
+	engine, err := s.initRouter()
+	if err != nil {
+		return err
+	}
+
+	certFile, err := s.settingService.GetSubCertFile()
+	if err != nil {
+		return err
+	}
+	keyFile, err := s.settingService.GetSubKeyFile()
+	if err != nil {
+		return err
+	}
+	listen, err := s.settingService.GetSubListen()
+	if err != nil {
+		return err
+	}
+	port, err := s.settingService.GetSubPort()
+	if err != nil {
+		return err
+	}
+
+	listenAddr := net.JoinHostPort(listen, strconv.Itoa(port))
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})
+		logger.Info("Sub server running HTTPS on", listener.Addr())
+	} else {
+		logger.Info("Sub server running HTTP on", listener.Addr())
+	}
+	s.listener = listener
+
+	s.httpServer = &http.Server{
+		Handler: engine,
+	}
+
+	go func() {
+		s.httpServer.Serve(listener)
+	}()
+
 	return nil
 }
 
+// GetClientLinks returns the share links of a client, for the panel to show
+// them as QR codes.
+func (s *Server) GetClientLinks(client *model.Client, host string) ([]string, error) {
+	return s.subService.GetClientLinks(client, host)
+}
+
 func (s *Server) Stop() error {
 	s.cancel()
-	// TODO
+	if s.httpServer != nil {
+		return s.httpServer.Close()
+	}
 	return nil
 }
@@ -0,0 +1,251 @@
+package sub
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/web/service"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed clash.yaml
+var clashTemplate string
+
+const (
+	clashSelectGroup  = "PROXY"
+	clashUrlTestGroup = "AUTO"
+)
+
+// SubClashService renders subscriptions as Clash Meta (Mihomo) configs. Every
+// inbound endpoint becomes a proxy, all of which are offered by the PROXY
+// select group and tested by the AUTO url-test group. The rules come from
+// the admin settings.
+type SubClashService struct {
+	subService     SubService
+	settingService service.SettingService
+}
+
+// GetClash returns the config of the subscription with the given id, or an
+// empty string when it has no proxies. Host is the address of inbounds
+// listening on all interfaces.
+func (s *SubClashService) GetClash(subId string, host string) (string, error) {
+	clients, err := s.subService.getSubClients(subId)
+	if err != nil {
+		return "", err
+	}
+	showInfo, err := s.settingService.GetSubShowInfo()
+	if err != nil {
+		return "", err
+	}
+	rules, err := s.settingService.GetSubClashRules()
+	if err != nil {
+		return "", err
+	}
+
+	var proxies []interface{}
+	names := proxyNames{}
+	for _, c := range clients {
+		for _, inbound := range c.inbounds {
+			stream := map[string]interface{}{}
+			json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+			settings := map[string]interface{}{}
+			json.Unmarshal([]byte(inbound.Settings), &settings)
+			for _, ep := range getEndpoints(inbound, stream, host) {
+				proxy := genClashProxy(inbound, c.client, settings, stream, ep)
+				if proxy == nil {
+					continue
+				}
+				name := names.unique(s.subService.genRemark(inbound, c, ep.remark, showInfo))
+				proxy["name"] = name
+				proxies = append(proxies, proxy)
+			}
+		}
+	}
+	if len(proxies) == 0 {
+		return "", nil
+	}
+
+	config := map[string]interface{}{}
+	if err = yaml.Unmarshal([]byte(clashTemplate), &config); err != nil {
+		return "", err
+	}
+	config["proxies"] = proxies
+	selectProxies := append([]string{clashUrlTestGroup}, names.list...)
+	config["proxy-groups"] = []interface{}{
+		map[string]interface{}{
+			"name":    clashSelectGroup,
+			"type":    "select",
+			"proxies": append(selectProxies, "DIRECT"),
+		},
+		map[string]interface{}{
+			"name":     clashUrlTestGroup,
+			"type":     "url-test",
+			"proxies":  names.list,
+			"url":      "https://www.gstatic.com/generate_204",
+			"interval": 300,
+		},
+	}
+	config["rules"] = getClashRules(rules)
+
+	data, err := yaml.Marshal(config)
+	return string(data), err
+}
+
+// getClashRules splits the rules setting into rules, skipping blank lines
+// and comments.
+func getClashRules(rules string) []string {
+	var result []string
+	for _, line := range strings.Split(rules, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result = append(result, line)
+	}
+	return result
+}
+
+// genClashProxy returns the proxy a client connects to an inbound endpoint
+// with, or nil when Clash does not support its protocol, transport or
+// security.
+func genClashProxy(inbound *model.Inbound, client *model.Client, settings map[string]interface{}, stream map[string]interface{}, ep subEndpoint) map[string]interface{} {
+	params := streamParams(stream, ep.security, client.Flow)
+	proxy := map[string]interface{}{
+		"server": ep.address,
+		"port":   ep.port,
+		"udp":    true,
+	}
+	sniKey := "servername"
+	switch inbound.Protocol {
+	case model.VMESS:
+		proxy["type"] = "vmess"
+		proxy["uuid"] = client.UUID
+		proxy["alterId"] = 0
+		proxy["cipher"] = "auto"
+	case model.VLESS:
+		proxy["type"] = "vless"
+		proxy["uuid"] = client.UUID
+		if flow := params.Get("flow"); flow != "" {
+			proxy["flow"] = flow
+		}
+	case model.Trojan:
+		// Trojan always runs over TLS in Clash.
+		if ep.security == "none" {
+			return nil
+		}
+		proxy["type"] = "trojan"
+		proxy["password"] = client.Password
+		sniKey = "sni"
+	case model.Shadowsocks:
+		// Clash has no transports for Shadowsocks, nor the HTTP header.
+		if params.Get("type") != "tcp" || params.Get("headerType") != "" || ep.security != "none" {
+			return nil
+		}
+		method, password := getShadowsocksCredentials(client, settings)
+		proxy["type"] = "ss"
+		proxy["cipher"] = method
+		proxy["password"] = password
+		return proxy
+	default:
+		return nil
+	}
+
+	switch network := params.Get("type"); network {
+	case "tcp":
+		if params.Get("headerType") == "http" {
+			if inbound.Protocol == model.Trojan {
+				return nil
+			}
+			httpOpts := map[string]interface{}{
+				"method": "GET",
+				"path":   splitParam(params.Get("path"), "/"),
+			}
+			if host := params.Get("host"); host != "" {
+				httpOpts["headers"] = map[string]interface{}{
+					"Host": strings.Split(host, ","),
+				}
+			}
+			proxy["network"] = "http"
+			proxy["http-opts"] = httpOpts
+		}
+	case "ws", "httpupgrade":
+		wsOpts := map[string]interface{}{
+			"path": params.Get("path"),
+		}
+		if host := params.Get("host"); host != "" {
+			wsOpts["headers"] = map[string]interface{}{
+				"Host": host,
+			}
+		}
+		if network == "httpupgrade" {
+			wsOpts["v2ray-http-upgrade"] = true
+		}
+		proxy["network"] = "ws"
+		proxy["ws-opts"] = wsOpts
+	case "grpc":
+		proxy["network"] = "grpc"
+		proxy["grpc-opts"] = map[string]interface{}{
+			"grpc-service-name": params.Get("serviceName"),
+		}
+	case "http":
+		if inbound.Protocol == model.Trojan {
+			return nil
+		}
+		h2Opts := map[string]interface{}{
+			"path": params.Get("path"),
+		}
+		if host := params.Get("host"); host != "" {
+			h2Opts["host"] = strings.Split(host, ",")
+		}
+		proxy["network"] = "h2"
+		proxy["h2-opts"] = h2Opts
+	default:
+		return nil
+	}
+
+	switch ep.security {
+	case "tls", "reality":
+		if inbound.Protocol != model.Trojan {
+			proxy["tls"] = true
+		}
+		if sni := params.Get("sni"); sni != "" {
+			proxy[sniKey] = sni
+		}
+		if alpn := params.Get("alpn"); alpn != "" {
+			proxy["alpn"] = strings.Split(alpn, ",")
+		}
+		if params.Get("allowInsecure") == "1" {
+			proxy["skip-cert-verify"] = true
+		}
+		fingerprint := params.Get("fp")
+		if ep.security == "reality" {
+			realityOpts := map[string]interface{}{
+				"public-key": params.Get("pbk"),
+			}
+			if sid := params.Get("sid"); sid != "" {
+				realityOpts["short-id"] = sid
+			}
+			proxy["reality-opts"] = realityOpts
+			// Clash needs a fingerprint to connect with REALITY.
+			if fingerprint == "" {
+				fingerprint = "chrome"
+			}
+		}
+		if fingerprint != "" {
+			proxy["client-fingerprint"] = fingerprint
+		}
+	}
+	return proxy
+}
+
+// splitParam splits a comma separated parameter, or returns the fallback
+// when it is empty.
+func splitParam(value string, fallback string) []string {
+	if value == "" {
+		return []string{fallback}
+	}
+	return strings.Split(value, ",")
+}
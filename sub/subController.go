@@ -0,0 +1,368 @@
+package sub
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	formatClash   = "clash"
+	formatSingbox = "singbox"
+)
+
+// formatApps maps the User-Agent markers of client apps to the formats they
+// import. sing-box apps come first since some mention Clash as well.
+var formatApps = []struct {
+	marker string
+	format string
+}{
+	{"sing-box", formatSingbox},
+	{"hiddify", formatSingbox},
+	{"clash", formatClash},
+	{"mihomo", formatClash},
+	{"stash", formatClash},
+}
+
+type SUBController struct {
+	subPath     string
+	subJsonPath string
+
+	subService        SubService
+	subJsonService    SubJsonService
+	subClashService   SubClashService
+	subSingboxService SubSingboxService
+	subPageService    SubPageService
+	settingService    service.SettingService
+	qrCodeService     service.QRCodeService
+	subAccessService  service.SubAccessService
+}
+
+func NewSUBController(g *gin.RouterGroup, subPath string, subJsonPath string) *SUBController {
+	a := &SUBController{
+		subPath:     subPath,
+		subJsonPath: subJsonPath,
+	}
+	a.initRouter(g)
+	return a
+}
+
+func (a *SUBController) initRouter(g *gin.RouterGroup) {
+	gLink := g.Group(a.subPath)
+	gJson := g.Group(a.subJsonPath)
+	gLink.Use(a.access)
+	gJson.Use(a.access)
+
+	gLink.GET(":subid", a.subs)
+	gLink.GET(":subid/:format", a.subs)
+	gJson.GET(":subid", a.subJsons)
+}
+
+// access resolves the subscription id of a request to the current one for
+// the handlers, checks the token of the request when it has one or tokens
+// are required, and logs the fetch under the current id. QR codes of the
+// subscription URLs are not logged, since they are fetched by the status
+// page, but QR codes of share links are, as they hold the credentials.
+func (a *SUBController) access(c *gin.Context) {
+	requested := c.Param("subid")
+	token := c.Query("token")
+	subId := requested
+	if c.Param("format") != "qr" || c.Query("link") != "" {
+		defer func() {
+			err := a.subAccessService.LogAccess(subId, requested, c.ClientIP(), c.GetHeader("User-Agent"), c.Writer.Status())
+			if err != nil {
+				logger.Warning("log subscription access failed:", err)
+			}
+		}()
+	}
+
+	resolved, err := a.subAccessService.ResolveSubId(requested)
+	if err != nil {
+		logger.Warning("resolve subscription id failed:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	subId = resolved
+
+	required, err := a.settingService.GetSubTokenRequired()
+	if err != nil {
+		logger.Warning("get subscription settings failed:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if token != "" || required {
+		if err := a.subAccessService.CheckSubToken(requested, token); err != nil {
+			logger.Debug("subscription", requested, "refused:", err)
+			c.String(http.StatusForbidden, "Forbidden")
+			c.Abort()
+			return
+		}
+	}
+	c.Set("subId", subId)
+	c.Next()
+}
+
+// subs answers with the share links of a subscription, one per line and
+// base64 encoded unless encoding is turned off, or with another format
+// chosen by the path suffix or the client.
+func (a *SUBController) subs(c *gin.Context) {
+	switch getFormat(c) {
+	case "":
+		if strings.Contains(c.GetHeader("Accept"), "text/html") {
+			a.subPage(c)
+			return
+		}
+	case formatClash:
+		a.subClash(c)
+		return
+	case formatSingbox:
+		a.subSingbox(c)
+		return
+	case "qr":
+		a.subQR(c)
+		return
+	default:
+		c.String(http.StatusNotFound, "Not Found")
+		return
+	}
+
+	subId := c.GetString("subId")
+	links, err := a.subService.GetSubs(subId, getHost(c))
+	if err != nil {
+		logger.Warning("get subscription failed:", err)
+		c.String(http.StatusInternalServerError, "Error!")
+		return
+	}
+	if len(links) == 0 {
+		c.String(http.StatusNotFound, "Not Found")
+		return
+	}
+
+	result := strings.Join(links, "\n")
+	if encrypt, _ := a.settingService.GetSubEncrypt(); encrypt {
+		result = base64.StdEncoding.EncodeToString([]byte(result))
+	}
+	a.setHeaders(c, subId)
+	c.String(http.StatusOK, result)
+}
+
+// subJsons answers with the Xray client configs of a subscription.
+func (a *SUBController) subJsons(c *gin.Context) {
+	subId := c.GetString("subId")
+	result, err := a.subJsonService.GetJson(subId, getHost(c))
+	if err != nil {
+		logger.Warning("get json subscription failed:", err)
+		c.String(http.StatusInternalServerError, "Error!")
+		return
+	}
+	if result == "" {
+		c.String(http.StatusNotFound, "Not Found")
+		return
+	}
+
+	a.setHeaders(c, subId)
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(result))
+}
+
+// subClash answers with the Clash config of a subscription.
+func (a *SUBController) subClash(c *gin.Context) {
+	subId := c.GetString("subId")
+	result, err := a.subClashService.GetClash(subId, getHost(c))
+	if err != nil {
+		logger.Warning("get clash subscription failed:", err)
+		c.String(http.StatusInternalServerError, "Error!")
+		return
+	}
+	if result == "" {
+		c.String(http.StatusNotFound, "Not Found")
+		return
+	}
+
+	a.setHeaders(c, subId)
+	c.Data(http.StatusOK, "text/yaml; charset=utf-8", []byte(result))
+}
+
+// subSingbox answers with the sing-box config of a subscription.
+func (a *SUBController) subSingbox(c *gin.Context) {
+	subId := c.GetString("subId")
+	result, err := a.subSingboxService.GetSingbox(subId, getHost(c))
+	if err != nil {
+		logger.Warning("get sing-box subscription failed:", err)
+		c.String(http.StatusInternalServerError, "Error!")
+		return
+	}
+	if result == "" {
+		c.String(http.StatusNotFound, "Not Found")
+		return
+	}
+
+	a.setHeaders(c, subId)
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(result))
+}
+
+// subPage answers browsers with the status page of a subscription.
+func (a *SUBController) subPage(c *gin.Context) {
+	subId := c.GetString("subId")
+	page, err := a.subPageService.GetPage(subId, getHost(c))
+	if err != nil {
+		logger.Warning("get subscription page failed:", err)
+		c.String(http.StatusInternalServerError, "Error!")
+		return
+	}
+	if page == nil {
+		c.String(http.StatusNotFound, "Not Found")
+		return
+	}
+	page.SubId = c.Param("subid")
+	page.Token = c.Query("token")
+	if page.Title == "" {
+		page.Title = page.SubId
+	}
+	page.URLs = a.getSubURLs(c)
+	c.HTML(http.StatusOK, "page.html", page)
+}
+
+// subQR answers with a QR code of a subscription URL, chosen by the for
+// query of the format key, or with one of the share links, chosen by the
+// link query of its position. The type, size and level queries choose how
+// it is rendered.
+func (a *SUBController) subQR(c *gin.Context) {
+	subId := c.GetString("subId")
+	var text string
+	if link := c.Query("link"); link != "" {
+		links, err := a.subService.GetSubs(subId, getHost(c))
+		if err != nil {
+			logger.Warning("get subscription failed:", err)
+			c.String(http.StatusInternalServerError, "Error!")
+			return
+		}
+		index, err := strconv.Atoi(link)
+		if err != nil || index < 0 || index >= len(links) {
+			c.String(http.StatusNotFound, "Not Found")
+			return
+		}
+		text = links[index]
+	} else {
+		clients, err := a.subService.getSubClients(subId)
+		if err != nil {
+			logger.Warning("get subscription failed:", err)
+			c.String(http.StatusInternalServerError, "Error!")
+			return
+		}
+		if len(clients) == 0 {
+			c.String(http.StatusNotFound, "Not Found")
+			return
+		}
+		key := c.DefaultQuery("for", "links")
+		for _, subURL := range a.getSubURLs(c) {
+			if subURL.Key == key {
+				text = subURL.URL
+			}
+		}
+		if text == "" {
+			c.String(http.StatusNotFound, "Not Found")
+			return
+		}
+	}
+
+	var options service.QROptions
+	c.ShouldBindQuery(&options)
+	data, contentType, err := a.qrCodeService.Render(text, options)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// setHeaders sets the headers client apps read the update interval, usage,
+// title and support address of a subscription from.
+func (a *SUBController) setHeaders(c *gin.Context, subId string) {
+	header := c.Writer.Header()
+	if updates, err := a.settingService.GetSubUpdates(); err == nil && updates > 0 {
+		header.Set("Profile-Update-Interval", strconv.Itoa(updates))
+	}
+	if clients, err := a.subService.getSubClients(subId); err == nil {
+		usage := getUsage(clients)
+		header.Set("Subscription-Userinfo", fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d",
+			usage.up, usage.down, usage.total, usage.expire))
+	}
+	// Titles are base64 encoded, since headers can not hold every language.
+	if title, _ := a.settingService.GetSubTitle(); title != "" {
+		header.Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(title)))
+	}
+	if support, _ := a.settingService.GetSubSupport(); support != "" {
+		header.Set("Support-Url", support)
+	}
+	header.Set("Profile-Web-Page-Url", a.getSubURLs(c)[0].URL)
+}
+
+// getSubURLs returns the URLs of a subscription in every format, at the
+// configured URIs or else where the subscription was requested. They have
+// the id and token the subscription was requested with, so a replaced id
+// does not give away the current one.
+func (a *SUBController) getSubURLs(c *gin.Context) []subPageURL {
+	subId := c.Param("subid")
+	query := ""
+	if token := c.Query("token"); token != "" {
+		query = "?token=" + url.QueryEscape(token)
+	}
+	base := "http://" + c.Request.Host
+	if c.Request.TLS != nil {
+		base = "https://" + c.Request.Host
+	}
+	subURI, _ := a.settingService.GetSubURI()
+	if subURI == "" {
+		subURI = base + a.subPath
+	}
+	subJsonURI, _ := a.settingService.GetSubJsonURI()
+	if subJsonURI == "" {
+		subJsonURI = base + a.subJsonPath
+	}
+	return []subPageURL{
+		{Key: "links", Name: "V2Ray / Xray", URL: subURI + subId + query},
+		{Key: "json", Name: "Xray JSON", URL: subJsonURI + subId + query},
+		{Key: formatClash, Name: "Clash / Mihomo", URL: subURI + subId + "/" + formatClash + query},
+		{Key: formatSingbox, Name: "sing-box", URL: subURI + subId + "/" + formatSingbox + query},
+	}
+}
+
+// getFormat returns the format a subscription is requested in: the path
+// suffix if there is one, or else the format of a known client app, or an
+// empty string for share links.
+func getFormat(c *gin.Context) string {
+	switch format := c.Param("format"); format {
+	case "":
+	case "mihomo":
+		return formatClash
+	case "sing-box":
+		return formatSingbox
+	default:
+		return format
+	}
+	userAgent := strings.ToLower(c.GetHeader("User-Agent"))
+	for _, app := range formatApps {
+		if strings.Contains(userAgent, app.marker) {
+			return app.format
+		}
+	}
+	return ""
+}
+
+// getHost returns the host the subscription was requested at, without port.
+func getHost(c *gin.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.Host)
+	if err != nil {
+		return c.Request.Host
+	}
+	return host
+}
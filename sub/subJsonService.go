@@ -0,0 +1,305 @@
+package sub
+
+import (
+	_ "embed"
+	"encoding/json"
+
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/web/service"
+)
+
+//go:embed default.json
+var defaultJson string
+
+// SubJsonService renders subscriptions as complete Xray client configs, one
+// per inbound endpoint, for clients that import configs rather than links.
+// Each config routes private addresses and the direct rules of the admin
+// directly and everything else through its proxy outbound.
+type SubJsonService struct {
+	subService     SubService
+	settingService service.SettingService
+}
+
+// jsonOptions are the admin settings applied to every config.
+type jsonOptions struct {
+	// dialer is a freedom outbound the proxy dials through, to fragment
+	// connections or send noises ahead of them.
+	dialer map[string]interface{}
+	mux    map[string]interface{}
+	rules  []interface{}
+}
+
+func (s *SubJsonService) getOptions() (*jsonOptions, error) {
+	fragment, err := s.settingService.GetSubJsonFragment()
+	if err != nil {
+		return nil, err
+	}
+	noises, err := s.settingService.GetSubJsonNoises()
+	if err != nil {
+		return nil, err
+	}
+	mux, err := s.settingService.GetSubJsonMux()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := s.settingService.GetSubJsonRules()
+	if err != nil {
+		return nil, err
+	}
+
+	options := &jsonOptions{}
+	var fragmentOutbound, noisesOutbound map[string]interface{}
+	if err = unmarshalSetting("subJsonFragment", fragment, &fragmentOutbound); err != nil {
+		return nil, err
+	}
+	if err = unmarshalSetting("subJsonNoises", noises, &noisesOutbound); err != nil {
+		return nil, err
+	}
+	if err = unmarshalSetting("subJsonMux", mux, &options.mux); err != nil {
+		return nil, err
+	}
+	if err = unmarshalSetting("subJsonRules", rules, &options.rules); err != nil {
+		return nil, err
+	}
+
+	// A freedom outbound can fragment and send noises at once, so both are
+	// merged into one dialer.
+	options.dialer = fragmentOutbound
+	if noisesOutbound != nil {
+		if options.dialer == nil {
+			options.dialer = noisesOutbound
+		} else if settings := getMap(options.dialer, "settings"); settings != nil {
+			settings["noises"] = getMap(noisesOutbound, "settings")["noises"]
+		}
+	}
+	if options.dialer != nil && getString(options.dialer, "tag") == "" {
+		options.dialer["tag"] = "fragment"
+	}
+	return options, nil
+}
+
+func unmarshalSetting(key string, value string, v interface{}) error {
+	if value == "" {
+		return nil
+	}
+	err := json.Unmarshal([]byte(value), v)
+	if err != nil {
+		return common.NewErrorf("invalid %v: %v", key, err)
+	}
+	return nil
+}
+
+// GetJson returns the configs of the subscription with the given id: an
+// object when there is one and an array otherwise, or an empty string when
+// there are none. Host is the address of inbounds listening on all
+// interfaces.
+func (s *SubJsonService) GetJson(subId string, host string) (string, error) {
+	clients, err := s.subService.getSubClients(subId)
+	if err != nil {
+		return "", err
+	}
+	showInfo, err := s.settingService.GetSubShowInfo()
+	if err != nil {
+		return "", err
+	}
+	options, err := s.getOptions()
+	if err != nil {
+		return "", err
+	}
+	var configs []interface{}
+	for _, c := range clients {
+		for _, inbound := range c.inbounds {
+			stream := map[string]interface{}{}
+			json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+			settings := map[string]interface{}{}
+			json.Unmarshal([]byte(inbound.Settings), &settings)
+			for _, ep := range getEndpoints(inbound, stream, host) {
+				outbound := genOutbound(inbound, c.client, settings, stream, ep)
+				if outbound == nil {
+					continue
+				}
+				remark := s.subService.genRemark(inbound, c, ep.remark, showInfo)
+				configs = append(configs, genConfig(outbound, remark, options))
+			}
+		}
+	}
+	var data []byte
+	switch len(configs) {
+	case 0:
+		return "", nil
+	case 1:
+		data, err = json.MarshalIndent(configs[0], "", "  ")
+	default:
+		data, err = json.MarshalIndent(configs, "", "  ")
+	}
+	return string(data), err
+}
+
+// genConfig puts a proxy outbound into the config template with the admin
+// options.
+func genConfig(outbound map[string]interface{}, remark string, options *jsonOptions) map[string]interface{} {
+	config := map[string]interface{}{}
+	json.Unmarshal([]byte(defaultJson), &config)
+	config["remarks"] = remark
+
+	outbounds := []interface{}{outbound}
+	// Mux does not work with the VLESS flows.
+	if options.mux != nil && !hasUserFlow(outbound) {
+		outbound["mux"] = options.mux
+	}
+	if options.dialer != nil {
+		stream := getMap(outbound, "streamSettings")
+		stream["sockopt"] = map[string]interface{}{
+			"dialerProxy": options.dialer["tag"],
+		}
+		outbounds = append(outbounds, options.dialer)
+	}
+	defaultOutbounds, _ := config["outbounds"].([]interface{})
+	config["outbounds"] = append(outbounds, defaultOutbounds...)
+
+	routing := getMap(config, "routing")
+	rules, _ := routing["rules"].([]interface{})
+	rules = append(rules, options.rules...)
+	rules = append(rules, map[string]interface{}{
+		"type":        "field",
+		"network":     "tcp,udp",
+		"outboundTag": "proxy",
+	})
+	routing["rules"] = rules
+	return config
+}
+
+// genOutbound returns the outbound a client connects to an inbound endpoint
+// with, or nil when the protocol has no client outbound.
+func genOutbound(inbound *model.Inbound, client *model.Client, settings map[string]interface{}, stream map[string]interface{}, ep subEndpoint) map[string]interface{} {
+	var protocolSettings map[string]interface{}
+	switch inbound.Protocol {
+	case model.VMESS, model.VLESS:
+		user := map[string]interface{}{
+			"id":    client.UUID,
+			"level": 8,
+		}
+		if inbound.Protocol == model.VMESS {
+			user["security"] = "auto"
+		} else {
+			user["encryption"] = "none"
+			if client.Flow != "" && hasFlow(getNetwork(stream), ep.security) {
+				user["flow"] = client.Flow
+			}
+		}
+		protocolSettings = map[string]interface{}{
+			"vnext": []interface{}{
+				map[string]interface{}{
+					"address": ep.address,
+					"port":    ep.port,
+					"users":   []interface{}{user},
+				},
+			},
+		}
+	case model.Trojan:
+		protocolSettings = map[string]interface{}{
+			"servers": []interface{}{
+				map[string]interface{}{
+					"address":  ep.address,
+					"port":     ep.port,
+					"password": client.Password,
+					"level":    8,
+				},
+			},
+		}
+	case model.Shadowsocks:
+		method, password := getShadowsocksCredentials(client, settings)
+		protocolSettings = map[string]interface{}{
+			"servers": []interface{}{
+				map[string]interface{}{
+					"address":  ep.address,
+					"port":     ep.port,
+					"method":   method,
+					"password": password,
+					"level":    8,
+				},
+			},
+		}
+	default:
+		return nil
+	}
+	return map[string]interface{}{
+		"tag":            "proxy",
+		"protocol":       string(inbound.Protocol),
+		"settings":       protocolSettings,
+		"streamSettings": genStreamSettings(stream, ep.security),
+	}
+}
+
+// genStreamSettings turns the stream settings of an inbound into the ones a
+// client connects with, keeping the transport and the client side of its
+// security.
+func genStreamSettings(stream map[string]interface{}, security string) map[string]interface{} {
+	network := getNetwork(stream)
+	result := map[string]interface{}{
+		"network":  network,
+		"security": security,
+	}
+	if transport := getMap(stream, network+"Settings"); transport != nil {
+		clientTransport := make(map[string]interface{}, len(transport))
+		for key, value := range transport {
+			clientTransport[key] = value
+		}
+		delete(clientTransport, "acceptProxyProtocol")
+		result[network+"Settings"] = clientTransport
+	}
+
+	switch security {
+	case "tls":
+		tlsSettings := getMap(stream, "tlsSettings")
+		settings := getMap(tlsSettings, "settings")
+		clientTls := map[string]interface{}{}
+		setValue(clientTls, "serverName", getString(tlsSettings, "serverName"))
+		setValue(clientTls, "fingerprint", getString(settings, "fingerprint"))
+		if alpn := getStrings(tlsSettings, "alpn"); len(alpn) > 0 {
+			clientTls["alpn"] = alpn
+		}
+		if allowInsecure, _ := settings["allowInsecure"].(bool); allowInsecure {
+			clientTls["allowInsecure"] = true
+		}
+		result["tlsSettings"] = clientTls
+	case "reality":
+		reality := getMap(stream, "realitySettings")
+		settings := getMap(reality, "settings")
+		clientReality := map[string]interface{}{}
+		sni := getString(settings, "serverName")
+		if serverNames := getStrings(reality, "serverNames"); sni == "" && len(serverNames) > 0 {
+			sni = serverNames[0]
+		}
+		setValue(clientReality, "serverName", sni)
+		setValue(clientReality, "fingerprint", getString(settings, "fingerprint"))
+		setValue(clientReality, "publicKey", getString(settings, "publicKey"))
+		if shortIds := getStrings(reality, "shortIds"); len(shortIds) > 0 {
+			setValue(clientReality, "shortId", shortIds[0])
+		}
+		setValue(clientReality, "spiderX", getString(settings, "spiderX"))
+		result["realitySettings"] = clientReality
+	}
+	return result
+}
+
+// hasUserFlow reports whether the user of a VLESS outbound has a flow.
+func hasUserFlow(outbound map[string]interface{}) bool {
+	vnext, _ := getMap(outbound, "settings")["vnext"].([]interface{})
+	for _, server := range vnext {
+		users, _ := server.(map[string]interface{})["users"].([]interface{})
+		for _, user := range users {
+			if _, ok := user.(map[string]interface{})["flow"]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func setValue(m map[string]interface{}, key string, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
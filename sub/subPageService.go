@@ -0,0 +1,125 @@
+package sub
+
+import (
+	"time"
+
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/web/service"
+)
+
+// SubPageService gathers what the status page of a subscription shows to
+// clients opening it in a browser: the usage and expiry of every client of
+// the subscription and their share links.
+type SubPageService struct {
+	subService     SubService
+	settingService service.SettingService
+}
+
+// subPage is the data of the status page template.
+type subPage struct {
+	// SubId and Token are what the page was requested with, for the URLs
+	// of its QR codes.
+	SubId   string
+	Token   string
+	Title   string
+	Support string
+	URLs    []subPageURL
+	Clients []*subPageClient
+}
+
+// subPageURL is a subscription URL in one of the formats.
+type subPageURL struct {
+	Key  string
+	Name string
+	URL  string
+}
+
+// subPageLink is a share link with its position in the subscription.
+type subPageLink struct {
+	Index int
+	Link  string
+}
+
+type subPageClient struct {
+	Email   string
+	Enabled bool
+	Expired bool
+	Used    string
+	// Total is empty for unlimited traffic.
+	Total   string
+	Percent int64
+	// Expiry is the expiry date, empty when the client does not expire or
+	// its time starts with the first use.
+	Expiry    string
+	DaysLeft  int
+	DelayDays int64
+	Links     []subPageLink
+}
+
+// GetPage returns the status page of the subscription with the given id, or
+// nil when it has no clients. Host is the address of inbounds listening on
+// all interfaces.
+func (s *SubPageService) GetPage(subId string, host string) (*subPage, error) {
+	clients, err := s.subService.getSubClients(subId)
+	if err != nil || len(clients) == 0 {
+		return nil, err
+	}
+	showInfo, err := s.settingService.GetSubShowInfo()
+	if err != nil {
+		return nil, err
+	}
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return nil, err
+	}
+	title, err := s.settingService.GetSubTitle()
+	if err != nil {
+		return nil, err
+	}
+	support, err := s.settingService.GetSubSupport()
+	if err != nil {
+		return nil, err
+	}
+
+	page := &subPage{
+		SubId:   subId,
+		Title:   title,
+		Support: support,
+	}
+	// Links are numbered in the order of the subscription, for their QR
+	// codes.
+	index := 0
+	for _, c := range clients {
+		client := &subPageClient{
+			Email:   c.client.Email,
+			Enabled: true,
+			Used:    common.FormatTraffic(0),
+		}
+		if traffic := c.traffic; traffic != nil {
+			used := traffic.Up + traffic.Down
+			client.Enabled = traffic.Enable
+			client.Used = common.FormatTraffic(used)
+			if traffic.Total > 0 {
+				client.Total = common.FormatTraffic(traffic.Total)
+				client.Percent = min(used*100/traffic.Total, 100)
+			}
+			switch {
+			case traffic.ExpiryTime < 0:
+				client.DelayDays = -traffic.ExpiryTime / 86400000
+			case traffic.ExpiryTime > 0:
+				expiry := time.UnixMilli(traffic.ExpiryTime)
+				client.Expiry = expiry.In(loc).Format("2006-01-02 15:04")
+				client.DaysLeft = max(int(time.Until(expiry).Hours()/24), 0)
+				client.Expired = expiry.Before(time.Now())
+			}
+		}
+		for _, inbound := range c.inbounds {
+			for _, link := range s.subService.getLinks(inbound, c, host, showInfo) {
+				client.Links = append(client.Links, subPageLink{Index: index, Link: link})
+				index++
+			}
+		}
+		page.Clients = append(page.Clients, client)
+	}
+	return page, nil
+}
@@ -0,0 +1,516 @@
+package sub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/web/service"
+	"x-ui-scratch/xray"
+)
+
+// SubService renders the subscriptions of clients. A subscription holds the
+// share links of every client with its subscription id, on every enabled
+// inbound the client is served on: its own and the ones it is linked to.
+type SubService struct {
+	settingService service.SettingService
+}
+
+// subClient is a client of a subscription with the inbounds it is served on.
+type subClient struct {
+	client   *model.Client
+	traffic  *xray.ClientTraffic
+	inbounds []*model.Inbound
+}
+
+// subEndpoint is an address a client connects to an inbound at. An inbound
+// has one endpoint unless it is reached through external proxies.
+type subEndpoint struct {
+	address  string
+	port     int
+	security string
+	remark   string
+}
+
+// subUsage is the traffic and expiry of a subscription as client apps show
+// them. A total of 0 means unlimited traffic and an expiry of 0 none.
+type subUsage struct {
+	up     int64
+	down   int64
+	total  int64
+	expire int64
+}
+
+// getUsage sums the traffic of the clients of a subscription. It is unlimited
+// when any client is, and expires with the first client that expires, in
+// Unix seconds. Clients whose time has not started do not expire yet.
+func getUsage(clients []*subClient) subUsage {
+	var usage subUsage
+	unlimited := false
+	for _, c := range clients {
+		traffic := c.traffic
+		if traffic == nil {
+			continue
+		}
+		usage.up += traffic.Up
+		usage.down += traffic.Down
+		usage.total += traffic.Total
+		if traffic.Total == 0 {
+			unlimited = true
+		}
+		if expire := traffic.ExpiryTime / 1000; expire > 0 && (usage.expire == 0 || expire < usage.expire) {
+			usage.expire = expire
+		}
+	}
+	if unlimited {
+		usage.total = 0
+	}
+	return usage
+}
+
+// GetSubs returns the share links of the subscription with the given id. Host
+// is the address of inbounds listening on all interfaces.
+func (s *SubService) GetSubs(subId string, host string) ([]string, error) {
+	clients, err := s.getSubClients(subId)
+	if err != nil {
+		return nil, err
+	}
+	return s.getSubLinks(clients, host)
+}
+
+// GetClientLinks returns the share links of a client on every enabled inbound
+// it is served on, whether the client itself is enabled or not.
+func (s *SubService) GetClientLinks(client *model.Client, host string) ([]string, error) {
+	clients, err := s.loadSubClients([]*model.Client{client})
+	if err != nil {
+		return nil, err
+	}
+	return s.getSubLinks(clients, host)
+}
+
+// getSubLinks returns the share links of clients on the inbounds they are
+// served on.
+func (s *SubService) getSubLinks(clients []*subClient, host string) ([]string, error) {
+	showInfo, err := s.settingService.GetSubShowInfo()
+	if err != nil {
+		return nil, err
+	}
+	var links []string
+	for _, c := range clients {
+		for _, inbound := range c.inbounds {
+			links = append(links, s.getLinks(inbound, c, host, showInfo)...)
+		}
+	}
+	return links, nil
+}
+
+// getSubClients returns the enabled clients with the given subscription id
+// that are served on at least one enabled inbound.
+func (s *SubService) getSubClients(subId string) ([]*subClient, error) {
+	db := database.GetDB()
+	var clients []*model.Client
+	err := db.Model(model.Client{}).Where("sub_id = ? AND enable = ?", subId, true).Order("id").Find(&clients).Error
+	if err != nil || len(clients) == 0 {
+		return nil, err
+	}
+	return s.loadSubClients(clients)
+}
+
+// loadSubClients finds the enabled inbounds clients are served on, leaving
+// out the clients without any.
+func (s *SubService) loadSubClients(clients []*model.Client) ([]*subClient, error) {
+	db := database.GetDB()
+	clientIds := make([]int, 0, len(clients))
+	emails := make([]string, 0, len(clients))
+	inboundIds := make([]int, 0, len(clients))
+	for _, client := range clients {
+		clientIds = append(clientIds, client.Id)
+		emails = append(emails, client.Email)
+		inboundIds = append(inboundIds, client.InboundId)
+	}
+	var links []model.ClientInbound
+	err := db.Model(model.ClientInbound{}).Where("client_id IN ?", clientIds).Order("inbound_id").Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		inboundIds = append(inboundIds, link.InboundId)
+	}
+	var inbounds []*model.Inbound
+	err = db.Model(model.Inbound{}).Where("id IN ? AND enable = ?", inboundIds, true).Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	inboundMap := make(map[int]*model.Inbound, len(inbounds))
+	for _, inbound := range inbounds {
+		inboundMap[inbound.Id] = inbound
+	}
+	var traffics []*xray.ClientTraffic
+	err = db.Model(xray.ClientTraffic{}).Where("email IN ?", emails).Find(&traffics).Error
+	if err != nil {
+		return nil, err
+	}
+	trafficMap := make(map[string]*xray.ClientTraffic, len(traffics))
+	for _, traffic := range traffics {
+		trafficMap[traffic.Email] = traffic
+	}
+
+	linkMap := make(map[int][]int)
+	for _, link := range links {
+		linkMap[link.ClientId] = append(linkMap[link.ClientId], link.InboundId)
+	}
+	result := make([]*subClient, 0, len(clients))
+	for _, client := range clients {
+		c := &subClient{client: client, traffic: trafficMap[client.Email]}
+		for _, id := range append([]int{client.InboundId}, linkMap[client.Id]...) {
+			if inbound, ok := inboundMap[id]; ok {
+				c.inbounds = append(c.inbounds, inbound)
+			}
+		}
+		if len(c.inbounds) > 0 {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// getLinks returns the share links of a client on an inbound, one per
+// endpoint.
+func (s *SubService) getLinks(inbound *model.Inbound, c *subClient, host string, showInfo bool) []string {
+	stream := map[string]interface{}{}
+	json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+	settings := map[string]interface{}{}
+	json.Unmarshal([]byte(inbound.Settings), &settings)
+
+	var links []string
+	for _, ep := range getEndpoints(inbound, stream, host) {
+		remark := s.genRemark(inbound, c, ep.remark, showInfo)
+		var link string
+		switch inbound.Protocol {
+		case model.VMESS:
+			link = genVmessLink(c.client, stream, ep, remark)
+		case model.VLESS:
+			link = genVlessLink(c.client, stream, ep, remark)
+		case model.Trojan:
+			link = genTrojanLink(c.client, stream, ep, remark)
+		case model.Shadowsocks:
+			link = genShadowsocksLink(c.client, settings, stream, ep, remark)
+		}
+		if link != "" {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// getEndpoints returns where clients connect to an inbound: the external
+// proxies of its stream, or else the inbound itself.
+func getEndpoints(inbound *model.Inbound, stream map[string]interface{}, host string) []subEndpoint {
+	security := getString(stream, "security")
+	if security == "" {
+		security = "none"
+	}
+	proxies, _ := stream["externalProxy"].([]interface{})
+	if len(proxies) == 0 {
+		address := host
+		switch inbound.Listen {
+		case "", "0.0.0.0", "::", "::0":
+		default:
+			address = inbound.Listen
+		}
+		return []subEndpoint{{address: address, port: inbound.Port, security: security}}
+	}
+	endpoints := make([]subEndpoint, 0, len(proxies))
+	for _, proxy := range proxies {
+		p, ok := proxy.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ep := subEndpoint{
+			address:  getString(p, "dest"),
+			port:     getInt(p, "port"),
+			security: security,
+			remark:   getString(p, "remark"),
+		}
+		if forceTls := getString(p, "forceTls"); forceTls != "" && forceTls != "same" {
+			ep.security = forceTls
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints
+}
+
+// genRemark names a link after the inbound and the client, adding the remark
+// of the external proxy and, when showInfo is set, the remaining traffic and
+// time of the client.
+func (s *SubService) genRemark(inbound *model.Inbound, c *subClient, extra string, showInfo bool) string {
+	var parts []string
+	for _, part := range []string{inbound.Remark, c.client.Email, extra} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if showInfo && c.traffic != nil {
+		traffic := c.traffic
+		if !traffic.Enable {
+			parts = append(parts, "⛔️")
+		} else {
+			if traffic.Total > 0 {
+				remaining := max(traffic.Total-traffic.Up-traffic.Down, 0)
+				parts = append(parts, strings.ReplaceAll(common.FormatTraffic(remaining), " ", "")+"📊")
+			}
+			switch {
+			case traffic.ExpiryTime < 0:
+				parts = append(parts, strconv.FormatInt(-traffic.ExpiryTime/86400000, 10)+"D⏳")
+			case traffic.ExpiryTime > 0:
+				left := time.Until(time.UnixMilli(traffic.ExpiryTime))
+				if days := int(left.Hours() / 24); days > 0 {
+					parts = append(parts, strconv.Itoa(days)+"D⏳")
+				} else {
+					parts = append(parts, strconv.Itoa(max(int(left.Hours()), 0))+"H⏳")
+				}
+			}
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// streamParams returns the query parameters of a share link that describe
+// the transport and the security of a stream.
+func streamParams(stream map[string]interface{}, security string, flow string) url.Values {
+	params := url.Values{}
+	network := getNetwork(stream)
+	params.Set("type", network)
+	switch network {
+	case "tcp":
+		header := getMap(getMap(stream, "tcpSettings"), "header")
+		if getString(header, "type") == "http" {
+			request := getMap(header, "request")
+			setParam(params, "path", strings.Join(getStrings(request, "path"), ","))
+			setParam(params, "host", strings.Join(getHeader(getMap(request, "headers"), "host"), ","))
+			params.Set("headerType", "http")
+		}
+	case "kcp":
+		kcp := getMap(stream, "kcpSettings")
+		setParam(params, "headerType", getString(getMap(kcp, "header"), "type"))
+		setParam(params, "seed", getString(kcp, "seed"))
+	case "ws", "httpupgrade", "splithttp", "xhttp":
+		settings := getMap(stream, network+"Settings")
+		setParam(params, "path", getString(settings, "path"))
+		host := getString(settings, "host")
+		if host == "" {
+			host = strings.Join(getHeader(getMap(settings, "headers"), "host"), ",")
+		}
+		setParam(params, "host", host)
+		setParam(params, "mode", getString(settings, "mode"))
+	case "http":
+		http := getMap(stream, "httpSettings")
+		setParam(params, "path", getString(http, "path"))
+		setParam(params, "host", strings.Join(getStrings(http, "host"), ","))
+	case "grpc":
+		grpc := getMap(stream, "grpcSettings")
+		setParam(params, "serviceName", getString(grpc, "serviceName"))
+		setParam(params, "authority", getString(grpc, "authority"))
+		if multiMode, _ := grpc["multiMode"].(bool); multiMode {
+			params.Set("mode", "multi")
+		}
+	}
+
+	params.Set("security", security)
+	switch security {
+	case "tls":
+		tlsSettings := getMap(stream, "tlsSettings")
+		settings := getMap(tlsSettings, "settings")
+		setParam(params, "sni", getString(tlsSettings, "serverName"))
+		setParam(params, "alpn", strings.Join(getStrings(tlsSettings, "alpn"), ","))
+		setParam(params, "fp", getString(settings, "fingerprint"))
+		if allowInsecure, _ := settings["allowInsecure"].(bool); allowInsecure {
+			params.Set("allowInsecure", "1")
+		}
+	case "reality":
+		reality := getMap(stream, "realitySettings")
+		settings := getMap(reality, "settings")
+		setParam(params, "pbk", getString(settings, "publicKey"))
+		setParam(params, "fp", getString(settings, "fingerprint"))
+		sni := getString(settings, "serverName")
+		if serverNames := getStrings(reality, "serverNames"); sni == "" && len(serverNames) > 0 {
+			sni = serverNames[0]
+		}
+		setParam(params, "sni", sni)
+		if shortIds := getStrings(reality, "shortIds"); len(shortIds) > 0 {
+			setParam(params, "sid", shortIds[0])
+		}
+		setParam(params, "spx", getString(settings, "spiderX"))
+	}
+	if hasFlow(network, security) {
+		setParam(params, "flow", flow)
+	}
+	return params
+}
+
+// hasFlow reports whether a VLESS flow applies to a stream.
+func hasFlow(network string, security string) bool {
+	return network == "tcp" && (security == "tls" || security == "reality")
+}
+
+func genVmessLink(client *model.Client, stream map[string]interface{}, ep subEndpoint, remark string) string {
+	params := streamParams(stream, ep.security, "")
+	obj := map[string]interface{}{
+		"v":    "2",
+		"ps":   remark,
+		"add":  ep.address,
+		"port": ep.port,
+		"id":   client.UUID,
+		"scy":  "auto",
+		"net":  params.Get("type"),
+		"type": "none",
+		"tls":  ep.security,
+	}
+	if obj["net"] == "http" {
+		obj["net"] = "h2"
+	}
+	for key, value := range params {
+		switch key {
+		case "headerType":
+			obj["type"] = value[0]
+		case "seed", "serviceName":
+			obj["path"] = value[0]
+		case "mode":
+			if value[0] == "multi" {
+				obj["type"] = "multi"
+			}
+		case "allowInsecure":
+			obj["allowInsecure"] = true
+		case "path", "host", "authority", "sni", "alpn", "fp":
+			obj[key] = value[0]
+		}
+	}
+	data, _ := json.Marshal(obj)
+	return "vmess://" + base64.StdEncoding.EncodeToString(data)
+}
+
+func genVlessLink(client *model.Client, stream map[string]interface{}, ep subEndpoint, remark string) string {
+	params := streamParams(stream, ep.security, client.Flow)
+	params.Set("encryption", "none")
+	return genLink("vless", url.PathEscape(client.UUID), ep, params, remark)
+}
+
+func genTrojanLink(client *model.Client, stream map[string]interface{}, ep subEndpoint, remark string) string {
+	params := streamParams(stream, ep.security, "")
+	return genLink("trojan", url.User(client.Password).String(), ep, params, remark)
+}
+
+// genShadowsocksLink returns a SIP002 link.
+func genShadowsocksLink(client *model.Client, settings map[string]interface{}, stream map[string]interface{}, ep subEndpoint, remark string) string {
+	method, password := getShadowsocksCredentials(client, settings)
+	userInfo := base64.RawURLEncoding.EncodeToString([]byte(method + ":" + password))
+	params := streamParams(stream, ep.security, "")
+	return genLink("ss", userInfo, ep, params, remark)
+}
+
+// getShadowsocksCredentials returns the method and the password a client
+// connects to a shadowsocks inbound with. The 2022 methods take the server
+// password before the client password.
+func getShadowsocksCredentials(client *model.Client, settings map[string]interface{}) (string, string) {
+	method := getString(settings, "method")
+	if client.Method != "" {
+		method = client.Method
+	}
+	password := client.Password
+	if serverPassword := getString(settings, "password"); strings.HasPrefix(method, "2022-") && serverPassword != "" {
+		password = serverPassword + ":" + password
+	}
+	return method, password
+}
+
+func genLink(scheme string, userInfo string, ep subEndpoint, params url.Values, remark string) string {
+	return fmt.Sprintf("%s://%s@%s?%s#%s", scheme, userInfo,
+		net.JoinHostPort(ep.address, strconv.Itoa(ep.port)), params.Encode(), url.PathEscape(remark))
+}
+
+// proxyNames hands out unique names for the proxies of a config, which
+// refer to each other by name, numbering repeated names.
+type proxyNames struct {
+	list   []string
+	counts map[string]int
+}
+
+func (n *proxyNames) unique(name string) string {
+	if n.counts == nil {
+		n.counts = map[string]int{}
+	}
+	n.counts[name]++
+	if count := n.counts[name]; count > 1 {
+		name += " " + strconv.Itoa(count)
+	}
+	n.list = append(n.list, name)
+	return name
+}
+
+func getNetwork(stream map[string]interface{}) string {
+	network := getString(stream, "network")
+	if network == "" {
+		return "tcp"
+	}
+	return network
+}
+
+func setParam(params url.Values, key string, value string) {
+	if value != "" {
+		params.Set(key, value)
+	}
+}
+
+func getMap(m map[string]interface{}, key string) map[string]interface{} {
+	value, _ := m[key].(map[string]interface{})
+	return value
+}
+
+func getString(m map[string]interface{}, key string) string {
+	value, _ := m[key].(string)
+	return value
+}
+
+func getInt(m map[string]interface{}, key string) int {
+	value, _ := m[key].(float64)
+	return int(value)
+}
+
+// getStrings returns a list of strings that may also be stored as a single,
+// comma-separated string.
+func getStrings(m map[string]interface{}, key string) []string {
+	switch value := m[key].(type) {
+	case string:
+		if value == "" {
+			return nil
+		}
+		return strings.Split(value, ",")
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// getHeader returns the values of a header, matching its name in any case.
+func getHeader(headers map[string]interface{}, name string) []string {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return getStrings(headers, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package sub
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/web/service"
+)
+
+//go:embed singbox.json
+var singboxTemplate string
+
+const (
+	singboxSelector = "proxy"
+	singboxUrlTest  = "auto"
+)
+
+// SubSingboxService renders subscriptions as sing-box configs. Every inbound
+// endpoint becomes an outbound, all of which are offered by the proxy
+// selector and tested by the auto urltest outbound. The dns and route
+// objects can be replaced by the admin.
+type SubSingboxService struct {
+	subService     SubService
+	settingService service.SettingService
+}
+
+// GetSingbox returns the config of the subscription with the given id, or an
+// empty string when it has no outbounds. Host is the address of inbounds
+// listening on all interfaces.
+func (s *SubSingboxService) GetSingbox(subId string, host string) (string, error) {
+	clients, err := s.subService.getSubClients(subId)
+	if err != nil {
+		return "", err
+	}
+	showInfo, err := s.settingService.GetSubShowInfo()
+	if err != nil {
+		return "", err
+	}
+	dns, err := s.settingService.GetSubSingboxDns()
+	if err != nil {
+		return "", err
+	}
+	route, err := s.settingService.GetSubSingboxRoute()
+	if err != nil {
+		return "", err
+	}
+
+	config := map[string]interface{}{}
+	json.Unmarshal([]byte(singboxTemplate), &config)
+	if dns != "" {
+		var dnsObject map[string]interface{}
+		if err = unmarshalSetting("subSingboxDns", dns, &dnsObject); err != nil {
+			return "", err
+		}
+		config["dns"] = dnsObject
+	}
+	if route != "" {
+		var routeObject map[string]interface{}
+		if err = unmarshalSetting("subSingboxRoute", route, &routeObject); err != nil {
+			return "", err
+		}
+		config["route"] = routeObject
+	}
+
+	var outbounds []interface{}
+	names := proxyNames{}
+	for _, c := range clients {
+		for _, inbound := range c.inbounds {
+			stream := map[string]interface{}{}
+			json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+			settings := map[string]interface{}{}
+			json.Unmarshal([]byte(inbound.Settings), &settings)
+			for _, ep := range getEndpoints(inbound, stream, host) {
+				outbound := genSingboxOutbound(inbound, c.client, settings, stream, ep)
+				if outbound == nil {
+					continue
+				}
+				outbound["tag"] = names.unique(s.subService.genRemark(inbound, c, ep.remark, showInfo))
+				outbounds = append(outbounds, outbound)
+			}
+		}
+	}
+	if len(outbounds) == 0 {
+		return "", nil
+	}
+
+	groups := []interface{}{
+		map[string]interface{}{
+			"type":      "selector",
+			"tag":       singboxSelector,
+			"outbounds": append([]string{singboxUrlTest}, names.list...),
+			"default":   singboxUrlTest,
+		},
+		map[string]interface{}{
+			"type":      "urltest",
+			"tag":       singboxUrlTest,
+			"outbounds": names.list,
+			"url":       "https://www.gstatic.com/generate_204",
+			"interval":  "5m",
+		},
+	}
+	defaultOutbounds, _ := config["outbounds"].([]interface{})
+	outbounds = append(groups, outbounds...)
+	config["outbounds"] = append(outbounds, defaultOutbounds...)
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	return string(data), err
+}
+
+// genSingboxOutbound returns the outbound a client connects to an inbound
+// endpoint with, or nil when sing-box does not support its protocol,
+// transport or security.
+func genSingboxOutbound(inbound *model.Inbound, client *model.Client, settings map[string]interface{}, stream map[string]interface{}, ep subEndpoint) map[string]interface{} {
+	params := streamParams(stream, ep.security, client.Flow)
+	outbound := map[string]interface{}{
+		"server":      ep.address,
+		"server_port": ep.port,
+	}
+	switch inbound.Protocol {
+	case model.VMESS:
+		outbound["type"] = "vmess"
+		outbound["uuid"] = client.UUID
+		outbound["security"] = "auto"
+		outbound["alter_id"] = 0
+	case model.VLESS:
+		outbound["type"] = "vless"
+		outbound["uuid"] = client.UUID
+		if flow := params.Get("flow"); flow != "" {
+			outbound["flow"] = flow
+		}
+	case model.Trojan:
+		outbound["type"] = "trojan"
+		outbound["password"] = client.Password
+	case model.Shadowsocks:
+		// sing-box has no transports for Shadowsocks, nor the HTTP header.
+		if params.Get("type") != "tcp" || params.Get("headerType") != "" || ep.security != "none" {
+			return nil
+		}
+		method, password := getShadowsocksCredentials(client, settings)
+		outbound["type"] = "shadowsocks"
+		outbound["method"] = method
+		outbound["password"] = password
+		return outbound
+	default:
+		return nil
+	}
+
+	transport := genSingboxTransport(params)
+	if transport == nil {
+		return nil
+	}
+	if len(transport) > 0 {
+		outbound["transport"] = transport
+	}
+
+	switch ep.security {
+	case "tls", "reality":
+		tls := map[string]interface{}{
+			"enabled": true,
+		}
+		setValue(tls, "server_name", params.Get("sni"))
+		if alpn := params.Get("alpn"); alpn != "" {
+			tls["alpn"] = strings.Split(alpn, ",")
+		}
+		if params.Get("allowInsecure") == "1" {
+			tls["insecure"] = true
+		}
+		fingerprint := params.Get("fp")
+		if ep.security == "reality" {
+			reality := map[string]interface{}{
+				"enabled":    true,
+				"public_key": params.Get("pbk"),
+			}
+			setValue(reality, "short_id", params.Get("sid"))
+			tls["reality"] = reality
+			// sing-box needs uTLS to connect with REALITY.
+			if fingerprint == "" {
+				fingerprint = "chrome"
+			}
+		}
+		if fingerprint != "" {
+			tls["utls"] = map[string]interface{}{
+				"enabled":     true,
+				"fingerprint": fingerprint,
+			}
+		}
+		outbound["tls"] = tls
+	}
+	return outbound
+}
+
+// genSingboxTransport returns the transport of an outbound, which is empty
+// for raw TCP, or nil when sing-box does not support the one of the inbound.
+func genSingboxTransport(params url.Values) map[string]interface{} {
+	transport := map[string]interface{}{}
+	switch params.Get("type") {
+	case "tcp":
+		// The HTTP header of Xray is not a transport of sing-box.
+		if params.Get("headerType") != "" {
+			return nil
+		}
+	case "ws":
+		transport["type"] = "ws"
+		setValue(transport, "path", params.Get("path"))
+		if host := params.Get("host"); host != "" {
+			transport["headers"] = map[string]interface{}{
+				"Host": host,
+			}
+		}
+	case "httpupgrade":
+		transport["type"] = "httpupgrade"
+		setValue(transport, "path", params.Get("path"))
+		setValue(transport, "host", params.Get("host"))
+	case "grpc":
+		transport["type"] = "grpc"
+		setValue(transport, "service_name", params.Get("serviceName"))
+	case "http":
+		transport["type"] = "http"
+		setValue(transport, "path", params.Get("path"))
+		if host := params.Get("host"); host != "" {
+			transport["host"] = strings.Split(host, ",")
+		}
+	default:
+		return nil
+	}
+	return transport
+}
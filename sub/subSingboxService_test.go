@@ -0,0 +1,203 @@
+package sub
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/xray"
+
+	"github.com/op/go-logging"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	logging.SetBackend(logging.NewLogBackend(io.Discard, "", 0))
+	logger.InitLogger(logging.ERROR)
+	dir, err := os.MkdirTemp("", "x-ui-sub")
+	if err != nil {
+		panic(err)
+	}
+	if err := database.InitDB(filepath.Join(dir, "x-ui.db")); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	if sqlDB, err := database.GetDB().DB(); err == nil {
+		sqlDB.Close()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// singboxInbound is an inbound of a test subscription with its one client.
+type singboxInbound struct {
+	inbound model.Inbound
+	client  model.Client
+	traffic xray.ClientTraffic
+}
+
+func addSingboxInbounds(t *testing.T, subId string, inbounds []singboxInbound) {
+	t.Helper()
+	db := database.GetDB()
+	for _, in := range inbounds {
+		inbound := in.inbound
+		inbound.Enable = true
+		inbound.Tag = subId + "-" + inbound.Remark
+		if err := db.Create(&inbound).Error; err != nil {
+			t.Fatal(err)
+		}
+		client := in.client
+		client.InboundId = inbound.Id
+		client.SubID = subId
+		client.Enable = true
+		if err := db.Create(&client).Error; err != nil {
+			t.Fatal(err)
+		}
+		traffic := in.traffic
+		traffic.InboundId = inbound.Id
+		traffic.Email = client.Email
+		traffic.Enable = true
+		if err := db.Create(&traffic).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetSingbox(t *testing.T) {
+	tests := []struct {
+		name     string
+		inbounds []singboxInbound
+	}{
+		{
+			name: "vless_reality",
+			inbounds: []singboxInbound{{
+				inbound: model.Inbound{
+					Remark:         "reality",
+					Port:           443,
+					Protocol:       model.VLESS,
+					Settings:       `{"decryption":"none"}`,
+					StreamSettings: `{"network":"tcp","security":"reality","realitySettings":{"dest":"yahoo.com:443","serverNames":["yahoo.com","www.yahoo.com"],"shortIds":["ab12","cd"],"privateKey":"x","settings":{"publicKey":"Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw","fingerprint":"firefox","spiderX":"/"}},"tcpSettings":{"header":{"type":"none"}}}`,
+				},
+				client: model.Client{Email: "reality-user", UUID: "b831381d-6324-4d53-ad4f-8cda48b30811", Flow: "xtls-rprx-vision"},
+			}},
+		},
+		{
+			name: "vmess_ws",
+			inbounds: []singboxInbound{{
+				inbound: model.Inbound{
+					Remark:         "ws",
+					Port:           8443,
+					Protocol:       model.VMESS,
+					Settings:       `{}`,
+					StreamSettings: `{"network":"ws","security":"tls","tlsSettings":{"serverName":"ex.com","alpn":["h2","http/1.1"],"settings":{"fingerprint":"chrome","allowInsecure":true}},"wsSettings":{"path":"/ws","headers":{"Host":"cdn.ex.com"}}}`,
+				},
+				client:  model.Client{Email: "ws-user", UUID: "0b8d6c9e-3f6d-4f0b-9f5e-2d7c0d1e6a41"},
+				traffic: xray.ClientTraffic{Total: 10 << 30, Up: 1 << 30, ExpiryTime: -30 * 86400000},
+			}},
+		},
+		{
+			name: "vmess_grpc",
+			inbounds: []singboxInbound{{
+				inbound: model.Inbound{
+					Remark:         "grpc",
+					Listen:         "10.0.0.2",
+					Port:           2053,
+					Protocol:       model.VMESS,
+					Settings:       `{}`,
+					StreamSettings: `{"network":"grpc","security":"none","grpcSettings":{"serviceName":"svc","multiMode":true}}`,
+				},
+				client: model.Client{Email: "grpc-user", UUID: "7a4f2c1e-9d3b-4e8a-b6f0-1c2d3e4f5a6b"},
+			}},
+		},
+		{
+			name: "trojan",
+			inbounds: []singboxInbound{{
+				inbound: model.Inbound{
+					Remark:         "trojan",
+					Port:           2083,
+					Protocol:       model.Trojan,
+					Settings:       `{}`,
+					StreamSettings: `{"network":"tcp","security":"tls","tlsSettings":{"serverName":"ex.com"},"externalProxy":[{"forceTls":"same","dest":"proxy.ex.com","port":443,"remark":"cdn"},{"forceTls":"none","dest":"1.2.3.4","port":2083,"remark":""}]}`,
+				},
+				client: model.Client{Email: "trojan-user", Password: "p@ss/word"},
+			}},
+		},
+		{
+			// The HTTP header of the second inbound is not supported by
+			// sing-box, so the inbound is left out.
+			name: "ss2022",
+			inbounds: []singboxInbound{{
+				inbound: model.Inbound{
+					Remark:         "ss",
+					Port:           8388,
+					Protocol:       model.Shadowsocks,
+					Settings:       `{"method":"2022-blake3-aes-128-gcm","password":"c2VydmVyc2VydmVyc2VydmVy","network":"tcp,udp"}`,
+					StreamSettings: `{"network":"tcp","security":"none"}`,
+				},
+				client: model.Client{Email: "ss-user", Password: "AHS3aIIh4OQWRAaL7LmrTw=="},
+			}, {
+				inbound: model.Inbound{
+					Remark:         "ss-http",
+					Port:           8389,
+					Protocol:       model.Shadowsocks,
+					Settings:       `{"method":"2022-blake3-aes-128-gcm","password":"c2VydmVyc2VydmVyc2VydmVy","network":"tcp,udp"}`,
+					StreamSettings: `{"network":"tcp","security":"none","tcpSettings":{"header":{"type":"http","request":{"path":["/"],"headers":{"Host":["h.com"]}}}}}`,
+				},
+				client: model.Client{Email: "ss-http-user", Password: "bXlQYXNzd29yZDEyMzQ1Ng=="},
+			}},
+		},
+	}
+
+	s := &SubSingboxService{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addSingboxInbounds(t, tt.name, tt.inbounds)
+			config, err := s.GetSingbox(tt.name, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "singbox_"+tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(config+"\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config+"\n" != string(want) {
+				t.Errorf("config differs from %v:\n%v", golden, config)
+			}
+		})
+	}
+}
+
+func TestGetSingboxUnsupported(t *testing.T) {
+	addSingboxInbounds(t, "unsupported", []singboxInbound{{
+		inbound: model.Inbound{
+			Remark:         "kcp",
+			Port:           9000,
+			Protocol:       model.VLESS,
+			Settings:       `{"decryption":"none"}`,
+			StreamSettings: `{"network":"kcp","security":"none"}`,
+		},
+		client: model.Client{Email: "kcp-user", UUID: "5f1e2d3c-4b5a-4978-8695-a4b3c2d1e0f9"},
+	}})
+
+	s := &SubSingboxService{}
+	config, err := s.GetSingbox("unsupported", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != "" {
+		t.Errorf("config of a subscription without supported inbounds:\n%v", config)
+	}
+}
@@ -9,3 +9,8 @@ func NewErrorf(format string, a ...interface{}) error {
 	msg := fmt.Sprintf(format, a...)
 	return errors.New(msg)
 }
+
+func NewError(a ...interface{}) error {
+	msg := fmt.Sprintln(a...)
+	return errors.New(msg[:len(msg)-1])
+}
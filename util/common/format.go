@@ -0,0 +1,18 @@
+package common
+
+import "strconv"
+
+// FormatTraffic renders a byte count with a binary unit, such as "1.50 GB".
+func FormatTraffic(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	if bytes < 1024 {
+		return strconv.FormatInt(bytes, 10) + " B"
+	}
+	size := float64(bytes)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	return strconv.FormatFloat(size, 'f', 2, 64) + " " + units[i]
+}
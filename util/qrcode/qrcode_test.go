@@ -0,0 +1,107 @@
+package qrcode
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testLink = "vless://b831381d-6324-4d53-ad4f-8cda48b30811@example.com:443?type=tcp&security=reality&pbk=Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw&fp=chrome&sni=yahoo.com&sid=ab12&spx=%2F&flow=xtls-rprx-vision#reality-alice"
+
+// TestEncodeVectors compares codes with the given masks to the modules of
+// testdata/<name>.txt, where # is dark. The files were made with the coding
+// package of rsc.io/qr, in byte mode and the same versions.
+func TestEncodeVectors(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		level Level
+		mask  int
+	}{
+		{"v1_low_mask0", "hello", Low, 0},
+		{"v2_medium_mask1", "https://example.com/sub/", Medium, 1},
+		{"v4_quartile_mask2", "trojan://secret@example.com:443#trojan", Quartile, 2},
+		{"v8_high_mask3", "ss://MjAyMi1ibGFrZTMtYWVzLTEyOC1nY206c2VjcmV0@example.com:8388#ss", High, 3},
+		{"v9_low_mask4", testLink, Low, 4},
+		{"v13_medium_mask5", testLink + "&" + testLink[8:100], Medium, 5},
+		{"v16_quartile_mask6", testLink + "\n" + testLink[:90], Quartile, 6},
+		{"v20_high_mask7", strings.Repeat(testLink[:120], 3), High, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.name+".txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+
+			q, err := encode(tt.text, tt.level, tt.mask)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.Size() != len(want) {
+				t.Fatalf("size = %v, want %v", q.Size(), len(want))
+			}
+			for y, row := range want {
+				var got strings.Builder
+				for x := 0; x < q.Size(); x++ {
+					if q.Dark(x, y) {
+						got.WriteByte('#')
+					} else {
+						got.WriteByte('.')
+					}
+				}
+				if got.String() != row {
+					t.Fatalf("row %v differs:\n got %v\nwant %v", y, got.String(), row)
+				}
+			}
+		})
+	}
+}
+
+// TestEncodeCapacity checks the versions texts land in against the byte
+// mode capacities of the standard.
+func TestEncodeCapacity(t *testing.T) {
+	tests := []struct {
+		level    Level
+		version  int
+		capacity int
+	}{
+		{Low, 1, 17},
+		{Medium, 1, 14},
+		{Quartile, 1, 11},
+		{High, 1, 7},
+		{Low, 10, 271},
+		{Medium, 10, 213},
+		{Quartile, 10, 151},
+		{High, 10, 119},
+		{Low, 40, 2953},
+		{Medium, 40, 2331},
+		{Quartile, 40, 1663},
+		{High, 40, 1273},
+	}
+	for _, tt := range tests {
+		q, err := Encode(strings.Repeat("a", tt.capacity), tt.level)
+		if err != nil {
+			t.Fatalf("level %v, %v bytes: %v", tt.level, tt.capacity, err)
+		}
+		if want := tt.version*4 + 17; q.Size() != want {
+			t.Errorf("level %v, %v bytes: size %v, want %v", tt.level, tt.capacity, q.Size(), want)
+		}
+
+		q, err = Encode(strings.Repeat("a", tt.capacity+1), tt.level)
+		if tt.version == 40 {
+			if err == nil {
+				t.Errorf("level %v, %v bytes: encoded beyond version 40", tt.level, tt.capacity+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("level %v, %v bytes: %v", tt.level, tt.capacity+1, err)
+		}
+		if q.Size() <= tt.version*4+17 {
+			t.Errorf("level %v, %v bytes: still version %v", tt.level, tt.capacity+1, tt.version)
+		}
+	}
+}
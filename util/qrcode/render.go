@@ -0,0 +1,64 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// quietZone is the light border around a code, in modules, that readers
+// need to find it.
+const quietZone = 4
+
+// scale returns the pixels per module that fit a code with its quiet zone
+// into size pixels, at least one.
+func (q *QRCode) scale(size int) int {
+	return max(size/(q.size+2*quietZone), 1)
+}
+
+// PNG renders the code as a black on white PNG image of at most size pixels
+// square, or larger when the code has more modules than that.
+func (q *QRCode) PNG(size int) ([]byte, error) {
+	scale := q.scale(size)
+	pixels := (q.size + 2*quietZone) * scale
+	palette := color.Palette{color.White, color.Black}
+	img := image.NewPaletted(image.Rect(0, 0, pixels, pixels), palette)
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				offset := img.PixOffset((x+quietZone)*scale, (y+quietZone)*scale+dy)
+				for dx := 0; dx < scale; dx++ {
+					img.Pix[offset+dx] = 1
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the code as a black on white SVG image of size pixels square.
+// Its modules are drawn as a single path in a view box of module units.
+func (q *QRCode) SVG(size int) string {
+	units := q.size + 2*quietZone
+	var path strings.Builder
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#ffffff"/><path fill="#000000" d="%s"/></svg>`,
+		size, size, units, units, path.String())
+}
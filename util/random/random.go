@@ -6,6 +6,22 @@ var (
 	allSeq [62]rune
 )
 
+func init() {
+	i := 0
+	for c := '0'; c <= '9'; c++ {
+		allSeq[i] = c
+		i++
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		allSeq[i] = c
+		i++
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		allSeq[i] = c
+		i++
+	}
+}
+
 func Seq(n int) string {
 	runes := make([]rune, n)
 	for i := 0; i < n; i++ {
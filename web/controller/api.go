@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIController serves the JSON API under /panel/api. Requests are authenticated
+// with an "Authorization: Bearer <token>" header, or with the panel session
+// when no header is sent.
+type APIController struct {
+	BaseController
+
+	inboundController *InboundController
+	clientController  *ClientController
+	historyController *HistoryController
+	reportController  *ReportController
+	planController    *PlanController
+	webhookController *WebhookController
+	serverService     service.ServerService
+	tokenService      service.TokenService
+}
+
+func NewAPIController(g *gin.RouterGroup) *APIController {
+	a := &APIController{
+		inboundController: &InboundController{},
+		clientController:  &ClientController{},
+		historyController: &HistoryController{},
+		reportController:  &ReportController{},
+		planController:    &PlanController{},
+		webhookController: &WebhookController{},
+	}
+	a.initRouter(g)
+	return a
+}
+
+func (a *APIController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/panel/api")
+	g.Use(a.checkAPIAuth)
+
+	inbounds := g.Group("/inbounds")
+	inbounds.GET("/list", a.checkPermission(model.PermRead), a.inboundController.getInbounds)
+	inbounds.GET("/get/:id", a.checkPermission(model.PermRead), a.inboundController.getInbound)
+	inbounds.GET("/getClientTraffics/:email", a.checkPermission(model.PermRead), a.inboundController.getClientTraffics)
+	inbounds.GET("/resetLogs", a.checkPermission(model.PermRead), a.inboundController.getResetLogs)
+	inbounds.POST("/add", a.checkPermission(model.PermInboundsWrite), a.inboundController.addInbound)
+	inbounds.POST("/update/:id", a.checkPermission(model.PermInboundsWrite), a.inboundController.updateInbound)
+	inbounds.POST("/del/:id", a.checkPermission(model.PermInboundsWrite), a.inboundController.delInbound)
+	inbounds.POST("/enable/:id", a.checkPermission(model.PermInboundsWrite), a.inboundController.setInboundEnable)
+	inbounds.POST("/clone/:id", a.checkPermission(model.PermInboundsWrite), a.inboundController.cloneInbound)
+
+	clients := g.Group("/clients")
+	clients.GET("/list", a.checkPermission(model.PermRead), a.clientController.searchClients)
+	clients.POST("/subAccess/:email", a.checkPermission(model.PermRead), a.clientController.getSubAccessLogs)
+	clients.POST("/subSuspicious", a.checkPermission(model.PermRead), a.clientController.getSubSuspicious)
+	clientsWrite := clients.Group("/", a.checkPermission(model.PermClientsWrite))
+	clientsWrite.POST("/add", a.clientController.addClients)
+	clientsWrite.POST("/update/:email", a.clientController.updateClient)
+	clientsWrite.POST("/del/:email", a.clientController.delClient)
+	clientsWrite.POST("/resetTraffic/:email", a.clientController.resetClientTraffic)
+	clientsWrite.POST("/renew/:email", a.clientController.renewClient)
+	clientsWrite.POST("/setQuota/:email", a.clientController.setClientQuota)
+	clientsWrite.POST("/move/:email", a.clientController.moveClient)
+	clientsWrite.POST("/link/:email", a.clientController.linkInbound)
+	clientsWrite.POST("/unlink/:email", a.clientController.unlinkInbound)
+	clientsWrite.POST("/regenSubId/:email", a.clientController.regenSubId)
+	clientsWrite.POST("/subToken/:email", a.clientController.getSubToken)
+	clientsWrite.GET("/qr/:email", a.clientController.getClientQR)
+	clientsWrite.POST("/bulk/add", a.clientController.bulkAddClients)
+	clientsWrite.POST("/bulk/enable", a.clientController.bulkEnableClients)
+	clientsWrite.POST("/bulk/disable", a.clientController.bulkDisableClients)
+	clientsWrite.POST("/bulk/del", a.clientController.bulkDelClients)
+	clientsWrite.POST("/bulk/resetTraffic", a.clientController.bulkResetClientsTraffic)
+	clientsWrite.POST("/bulk/renew", a.clientController.bulkRenewClients)
+
+	history := g.Group("/history", a.checkPermission(model.PermRead))
+	history.GET("/client/:email", a.historyController.getClientHistory)
+	history.GET("/inbound/:id", a.historyController.getInboundHistory)
+	history.GET("/server", a.historyController.getServerHistory)
+
+	plans := g.Group("/plans")
+	plans.GET("/list", a.checkPermission(model.PermRead), a.planController.getPlans)
+	plans.GET("/get/:id", a.checkPermission(model.PermRead), a.planController.getPlan)
+	plans.POST("/add", a.checkPermission(model.PermServerAdmin), a.planController.addPlan)
+	plans.POST("/update/:id", a.checkPermission(model.PermServerAdmin), a.planController.updatePlan)
+	plans.POST("/del/:id", a.checkPermission(model.PermServerAdmin), a.planController.delPlan)
+	plans.POST("/addClients", a.checkPermission(model.PermClientsWrite), a.planController.addPlanClients)
+	plans.POST("/renewClients", a.checkPermission(model.PermClientsWrite), a.planController.renewPlanClients)
+
+	webhooks := g.Group("/webhooks", a.checkPermission(model.PermServerAdmin))
+	webhooks.GET("/list", a.webhookController.getWebhooks)
+	webhooks.GET("/get/:id", a.webhookController.getWebhook)
+	webhooks.GET("/deliveries", a.webhookController.getDeliveries)
+	webhooks.POST("/add", a.webhookController.addWebhook)
+	webhooks.POST("/update/:id", a.webhookController.updateWebhook)
+	webhooks.POST("/del/:id", a.webhookController.delWebhook)
+	webhooks.POST("/redeliver/:id", a.webhookController.redeliver)
+
+	g.GET("/report/download", a.checkPermission(model.PermRead), a.reportController.download)
+
+	server := g.Group("/server", a.checkPermission(model.PermServerAdmin))
+	server.POST("/restartXrayService", a.restartXrayService)
+	server.POST("/stopXrayService", a.stopXrayService)
+}
+
+func (a *APIController) checkAPIAuth(c *gin.Context) {
+	auth := c.GetHeader("Authorization")
+	if auth == "" {
+		user := a.getSessionUser(c)
+		if user == nil {
+			pureJsonMsg(c, http.StatusUnauthorized, false, I18nWeb(c, "pages.login.loginAgain"))
+			c.Abort()
+			return
+		}
+		c.Set(loginUserKey, user)
+		c.Next()
+		return
+	}
+
+	token, found := strings.CutPrefix(auth, "Bearer ")
+	if !found {
+		pureJsonMsg(c, http.StatusUnauthorized, false, "invalid authorization header")
+		c.Abort()
+		return
+	}
+	apiToken, user, err := a.tokenService.CheckToken(strings.TrimSpace(token))
+	if err != nil {
+		logger.Warningf("API token rejected from %s: %v", getRemoteIp(c), err)
+		pureJsonMsg(c, http.StatusUnauthorized, false, err.Error())
+		c.Abort()
+		return
+	}
+	c.Set(loginUserKey, user)
+	c.Set(apiTokenKey, apiToken)
+	c.Next()
+}
+
+func (a *APIController) restartXrayService(c *gin.Context) {
+	err := a.serverService.RestartXrayService()
+	jsonMsg(c, "Xray restarted", err)
+}
+
+func (a *APIController) stopXrayService(c *gin.Context) {
+	err := a.serverService.StopXrayService()
+	jsonMsg(c, "Xray stopped", err)
+}
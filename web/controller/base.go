@@ -2,17 +2,41 @@ package controller
 
 import (
 	"net/http"
+	"x-ui-scratch/database/model"
 	"x-ui-scratch/logger"
 	"x-ui-scratch/web/locale"
+	"x-ui-scratch/web/service"
 	"x-ui-scratch/web/session"
 
 	"github.com/gin-gonic/gin"
 )
 
-type BaseController struct{}
+const (
+	loginUserKey = "login_user"
+	apiTokenKey  = "api_token"
+)
+
+type BaseController struct {
+	userService service.UserService
+}
+
+// getSessionUser returns the user of the login session, reloaded from the
+// database so that role changes and deletions apply immediately.
+func (a *BaseController) getSessionUser(c *gin.Context) *model.User {
+	sessionUser := session.GetLoginUser(c)
+	if sessionUser == nil {
+		return nil
+	}
+	user, err := a.userService.GetUserById(sessionUser.Id)
+	if err != nil {
+		return nil
+	}
+	return user
+}
 
 func (a *BaseController) checkLogin(c *gin.Context) {
-	if !session.IsLogin(c) {
+	user := a.getSessionUser(c)
+	if user == nil {
 		if isAjax(c) {
 			pureJsonMsg(c, http.StatusUnauthorized, false, I18nWeb(c, "pages.login.loginAgain"))
 		} else {
@@ -20,10 +44,48 @@ func (a *BaseController) checkLogin(c *gin.Context) {
 		}
 		c.Abort()
 	} else {
+		c.Set(loginUserKey, user)
 		c.Next()
 	}
 }
 
+// checkPermission aborts the request unless the logged in user's role grants
+// perm and, for API token requests, the token has perm as a scope.
+// It must run after checkLogin or checkAPIAuth.
+func (a *BaseController) checkPermission(perm model.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := getLoginUser(c)
+		allowed := user != nil && user.Role.Can(perm)
+		if token := getAPIToken(c); token != nil && !token.HasScope(perm) {
+			allowed = false
+		}
+		if !allowed {
+			pureJsonMsg(c, http.StatusForbidden, false, I18nWeb(c, "pages.login.toasts.noPermission"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func getLoginUser(c *gin.Context) *model.User {
+	obj, exists := c.Get(loginUserKey)
+	if !exists {
+		return nil
+	}
+	user, _ := obj.(*model.User)
+	return user
+}
+
+func getAPIToken(c *gin.Context) *model.APIToken {
+	obj, exists := c.Get(apiTokenKey)
+	if !exists {
+		return nil
+	}
+	token, _ := obj.(*model.APIToken)
+	return token
+}
+
 func I18nWeb(c *gin.Context, name string, params ...string) string {
 	anyfunc, funcExists := c.Get("I18n")
 	if !funcExists {
@@ -0,0 +1,354 @@
+package controller
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/web/global"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ClientController struct {
+	BaseController
+
+	clientService    service.ClientService
+	xrayService      service.XrayService
+	subAccessService service.SubAccessService
+	qrCodeService    service.QRCodeService
+}
+
+// ClientForm carries clients the same way inbounds store them: as a settings
+// JSON object with a clients array.
+type ClientForm struct {
+	InboundId int    `json:"inboundId" form:"inboundId"`
+	Settings  string `json:"settings" form:"settings"`
+}
+
+func (f *ClientForm) getClients() ([]model.Client, error) {
+	settings := struct {
+		Clients []model.Client `json:"clients"`
+	}{}
+	err := json.Unmarshal([]byte(f.Settings), &settings)
+	return settings.Clients, err
+}
+
+// BulkAddForm describes clients to generate for an inbound.
+type BulkAddForm struct {
+	InboundId int `json:"inboundId" form:"inboundId"`
+	service.BulkClients
+}
+
+// BulkForm selects clients for a bulk action by email.
+type BulkForm struct {
+	Emails []string `json:"emails" form:"emails"`
+	Days   int      `json:"days" form:"days"`
+}
+
+// ClientQRForm chooses a share link of a client by its position and how its
+// QR code is rendered.
+type ClientQRForm struct {
+	Link int `json:"link" form:"link"`
+	service.QROptions
+}
+
+func NewClientController(g *gin.RouterGroup) *ClientController {
+	a := &ClientController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *ClientController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/client")
+
+	read := g.Group("/", a.checkPermission(model.PermRead))
+	read.POST("/list", a.searchClients)
+	read.POST("/subAccess/:email", a.getSubAccessLogs)
+	read.POST("/subSuspicious", a.getSubSuspicious)
+
+	write := g.Group("/", a.checkPermission(model.PermClientsWrite))
+	write.POST("/add", a.addClients)
+	write.POST("/update/:email", a.updateClient)
+	write.POST("/del/:email", a.delClient)
+	write.POST("/resetTraffic/:email", a.resetClientTraffic)
+	write.POST("/renew/:email", a.renewClient)
+	write.POST("/setQuota/:email", a.setClientQuota)
+	write.POST("/move/:email", a.moveClient)
+	write.POST("/link/:email", a.linkInbound)
+	write.POST("/unlink/:email", a.unlinkInbound)
+	write.POST("/regenSubId/:email", a.regenSubId)
+	write.POST("/subToken/:email", a.getSubToken)
+	write.POST("/qr/:email", a.getClientQR)
+
+	write.POST("/bulk/add", a.bulkAddClients)
+	write.POST("/bulk/enable", a.bulkEnableClients)
+	write.POST("/bulk/disable", a.bulkDisableClients)
+	write.POST("/bulk/del", a.bulkDelClients)
+	write.POST("/bulk/resetTraffic", a.bulkResetClientsTraffic)
+	write.POST("/bulk/renew", a.bulkRenewClients)
+}
+
+func (a *ClientController) result(c *gin.Context, msg string, needRestart bool, err error) {
+	if err == nil && needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	jsonMsg(c, msg, err)
+}
+
+func (a *ClientController) searchClients(c *gin.Context) {
+	query := &service.ClientQuery{}
+	err := c.ShouldBind(query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.obtain"), err)
+		return
+	}
+	page, err := a.clientService.SearchClients(getLoginUser(c), query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, page, nil)
+}
+
+func (a *ClientController) addClients(c *gin.Context) {
+	form := &ClientForm{}
+	err := c.ShouldBind(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.add"), err)
+		return
+	}
+	clients, err := form.getClients()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.add"), err)
+		return
+	}
+	needRestart, err := a.clientService.AddClients(getLoginUser(c), form.InboundId, clients)
+	a.result(c, I18nWeb(c, "pages.client.toasts.add"), needRestart, err)
+}
+
+func (a *ClientController) updateClient(c *gin.Context) {
+	form := &ClientForm{}
+	err := c.ShouldBind(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.update"), err)
+		return
+	}
+	clients, err := form.getClients()
+	if err == nil && len(clients) != 1 {
+		err = common.NewError("exactly one client is required")
+	}
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.update"), err)
+		return
+	}
+	needRestart, err := a.clientService.UpdateClient(getLoginUser(c), c.Param("email"), clients[0])
+	a.result(c, I18nWeb(c, "pages.client.toasts.update"), needRestart, err)
+}
+
+func (a *ClientController) delClient(c *gin.Context) {
+	needRestart, err := a.clientService.DelClient(getLoginUser(c), c.Param("email"))
+	a.result(c, I18nWeb(c, "pages.client.toasts.delete"), needRestart, err)
+}
+
+func (a *ClientController) resetClientTraffic(c *gin.Context) {
+	needRestart, err := a.clientService.ResetClientTraffic(getLoginUser(c), c.Param("email"))
+	a.result(c, I18nWeb(c, "pages.client.toasts.resetTraffic"), needRestart, err)
+}
+
+func (a *ClientController) renewClient(c *gin.Context) {
+	days, err := strconv.Atoi(c.PostForm("days"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.renew"), err)
+		return
+	}
+	needRestart, err := a.clientService.RenewClient(getLoginUser(c), c.Param("email"), days)
+	a.result(c, I18nWeb(c, "pages.client.toasts.renew"), needRestart, err)
+}
+
+func (a *ClientController) setClientQuota(c *gin.Context) {
+	total, err := strconv.ParseInt(c.PostForm("total"), 10, 64)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.setQuota"), err)
+		return
+	}
+	needRestart, err := a.clientService.SetClientQuota(getLoginUser(c), c.Param("email"), total)
+	a.result(c, I18nWeb(c, "pages.client.toasts.setQuota"), needRestart, err)
+}
+
+func (a *ClientController) moveClient(c *gin.Context) {
+	inboundId, err := strconv.Atoi(c.PostForm("inboundId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.move"), err)
+		return
+	}
+	needRestart, err := a.clientService.MoveClient(getLoginUser(c), c.Param("email"), inboundId)
+	a.result(c, I18nWeb(c, "pages.client.toasts.move"), needRestart, err)
+}
+
+func (a *ClientController) linkInbound(c *gin.Context) {
+	inboundId, err := strconv.Atoi(c.PostForm("inboundId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.link"), err)
+		return
+	}
+	needRestart, err := a.clientService.LinkInbound(getLoginUser(c), c.Param("email"), inboundId)
+	a.result(c, I18nWeb(c, "pages.client.toasts.link"), needRestart, err)
+}
+
+func (a *ClientController) unlinkInbound(c *gin.Context) {
+	inboundId, err := strconv.Atoi(c.PostForm("inboundId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.unlink"), err)
+		return
+	}
+	needRestart, err := a.clientService.UnlinkInbound(getLoginUser(c), c.Param("email"), inboundId)
+	a.result(c, I18nWeb(c, "pages.client.toasts.unlink"), needRestart, err)
+}
+
+// regenSubId gives the subscription of a client a new id. The old one keeps
+// working for the grace form value in hours, if any.
+func (a *ClientController) regenSubId(c *gin.Context) {
+	grace, err := strconv.Atoi(c.DefaultPostForm("grace", "0"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.regenSubId"), err)
+		return
+	}
+	subId, err := a.clientService.RegenerateSubId(getLoginUser(c), c.Param("email"), grace)
+	jsonMsgObj(c, I18nWeb(c, "pages.client.toasts.regenSubId"), subId, err)
+}
+
+// getSubToken signs a token for the subscription URLs of a client, valid for
+// the hours form value or the default validity.
+func (a *ClientController) getSubToken(c *gin.Context) {
+	hours, err := strconv.Atoi(c.DefaultPostForm("hours", "0"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.subToken"), err)
+		return
+	}
+	token, err := a.subAccessService.GetSubToken(getLoginUser(c), c.Param("email"), hours)
+	jsonMsgObj(c, I18nWeb(c, "pages.client.toasts.subToken"), token, err)
+}
+
+// getClientQR answers with a QR code of one of the share links of a client,
+// the ones its subscription serves, at the hostname the panel is reached at.
+func (a *ClientController) getClientQR(c *gin.Context) {
+	form := &ClientQRForm{}
+	err := c.ShouldBind(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.qrCode"), err)
+		return
+	}
+	client, err := a.clientService.GetClient(getLoginUser(c), c.Param("email"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.qrCode"), err)
+		return
+	}
+	host, _, err := net.SplitHostPort(c.Request.Host)
+	if err != nil {
+		host = c.Request.Host
+	}
+	links, err := global.GetSubServer().GetClientLinks(client, host)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.qrCode"), err)
+		return
+	}
+	if form.Link < 0 || form.Link >= len(links) {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.qrCode"), common.NewErrorf("client has %v share links: %v", len(links), form.Link))
+		return
+	}
+	data, contentType, err := a.qrCodeService.Render(links[form.Link], form.QROptions)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.qrCode"), err)
+		return
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// getSubAccessLogs returns the latest fetches of the subscription of a
+// client, at most the limit form value of them.
+func (a *ClientController) getSubAccessLogs(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultPostForm("limit", "0"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.subAccess"), err)
+		return
+	}
+	logs, err := a.subAccessService.GetAccessLogs(getLoginUser(c), c.Param("email"), limit)
+	jsonMsgObj(c, I18nWeb(c, "pages.client.toasts.subAccess"), logs, err)
+}
+
+// getSubSuspicious reports the subscriptions fetched from at least minIps
+// IPs in the last hours.
+func (a *ClientController) getSubSuspicious(c *gin.Context) {
+	hours, err := strconv.Atoi(c.DefaultPostForm("hours", "0"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.subSuspicious"), err)
+		return
+	}
+	minIps, err := strconv.Atoi(c.DefaultPostForm("minIps", "0"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.subSuspicious"), err)
+		return
+	}
+	reports, err := a.subAccessService.GetSuspicious(getLoginUser(c), hours, minIps)
+	jsonMsgObj(c, I18nWeb(c, "pages.client.toasts.subSuspicious"), reports, err)
+}
+
+func (a *ClientController) bulkAddClients(c *gin.Context) {
+	form := &BulkAddForm{}
+	err := c.ShouldBind(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.client.toasts.bulkAdd"), err)
+		return
+	}
+	clients, needRestart, err := a.clientService.BulkAddClients(getLoginUser(c), form.InboundId, &form.BulkClients)
+	if err == nil && needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.client.toasts.bulkAdd"), clients, err)
+}
+
+// bulk runs a bulk action on the clients selected by the form.
+func (a *ClientController) bulk(c *gin.Context, msg string, fn func(user *model.User, form *BulkForm) (bool, error)) {
+	form := &BulkForm{}
+	err := c.ShouldBind(form)
+	if err != nil {
+		jsonMsg(c, msg, err)
+		return
+	}
+	needRestart, err := fn(getLoginUser(c), form)
+	a.result(c, msg, needRestart, err)
+}
+
+func (a *ClientController) bulkEnableClients(c *gin.Context) {
+	a.bulk(c, I18nWeb(c, "pages.client.toasts.bulkEnable"), func(user *model.User, form *BulkForm) (bool, error) {
+		return a.clientService.SetClientsEnable(user, form.Emails, true)
+	})
+}
+
+func (a *ClientController) bulkDisableClients(c *gin.Context) {
+	a.bulk(c, I18nWeb(c, "pages.client.toasts.bulkDisable"), func(user *model.User, form *BulkForm) (bool, error) {
+		return a.clientService.SetClientsEnable(user, form.Emails, false)
+	})
+}
+
+func (a *ClientController) bulkDelClients(c *gin.Context) {
+	a.bulk(c, I18nWeb(c, "pages.client.toasts.bulkDelete"), func(user *model.User, form *BulkForm) (bool, error) {
+		return a.clientService.DelClients(user, form.Emails)
+	})
+}
+
+func (a *ClientController) bulkResetClientsTraffic(c *gin.Context) {
+	a.bulk(c, I18nWeb(c, "pages.client.toasts.bulkResetTraffic"), func(user *model.User, form *BulkForm) (bool, error) {
+		return a.clientService.ResetClientsTraffic(user, form.Emails)
+	})
+}
+
+func (a *ClientController) bulkRenewClients(c *gin.Context) {
+	a.bulk(c, I18nWeb(c, "pages.client.toasts.bulkRenew"), func(user *model.User, form *BulkForm) (bool, error) {
+		return a.clientService.RenewClients(user, form.Emails, form.Days)
+	})
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"strconv"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type HistoryController struct {
+	BaseController
+
+	historyService service.HistoryService
+}
+
+// HistoryForm selects the buckets of a traffic history query. From and To are
+// in milliseconds and default to a range fitting the period.
+type HistoryForm struct {
+	Period model.HistoryPeriod `json:"period" form:"period"`
+	From   int64               `json:"from" form:"from"`
+	To     int64               `json:"to" form:"to"`
+}
+
+func NewHistoryController(g *gin.RouterGroup) *HistoryController {
+	a := &HistoryController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *HistoryController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/history", a.checkPermission(model.PermRead))
+
+	g.POST("/client/:email", a.getClientHistory)
+	g.POST("/inbound/:id", a.getInboundHistory)
+	g.POST("/server", a.getServerHistory)
+}
+
+func (a *HistoryController) bindForm(c *gin.Context) (*HistoryForm, error) {
+	form := &HistoryForm{}
+	err := c.ShouldBind(form)
+	if err != nil {
+		return nil, err
+	}
+	if form.Period == "" {
+		form.Period = model.PeriodDay
+	}
+	return form, nil
+}
+
+func (a *HistoryController) getClientHistory(c *gin.Context) {
+	form, err := a.bindForm(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.history.toasts.obtain"), err)
+		return
+	}
+	points, err := a.historyService.GetClientHistory(getLoginUser(c), c.Param("email"), form.Period, form.From, form.To)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.history.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, points, nil)
+}
+
+func (a *HistoryController) getInboundHistory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.history.toasts.obtain"), err)
+		return
+	}
+	form, err := a.bindForm(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.history.toasts.obtain"), err)
+		return
+	}
+	points, err := a.historyService.GetInboundHistory(getLoginUser(c), id, form.Period, form.From, form.To)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.history.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, points, nil)
+}
+
+func (a *HistoryController) getServerHistory(c *gin.Context) {
+	form, err := a.bindForm(c)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.history.toasts.obtain"), err)
+		return
+	}
+	points, err := a.historyService.GetServerHistory(getLoginUser(c), form.Period, form.From, form.To)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.history.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, points, nil)
+}
@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"strconv"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type InboundController struct {
+	BaseController
+
+	inboundService service.InboundService
+	resetService   service.ResetService
+	xrayService    service.XrayService
+}
+
+func NewInboundController(g *gin.RouterGroup) *InboundController {
+	a := &InboundController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *InboundController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/inbound")
+
+	read := g.Group("/", a.checkPermission(model.PermRead))
+	read.POST("/list", a.getInbounds)
+	read.POST("/get/:id", a.getInbound)
+	read.POST("/getClientTraffics/:email", a.getClientTraffics)
+	read.POST("/resetLogs", a.getResetLogs)
+
+	write := g.Group("/", a.checkPermission(model.PermInboundsWrite))
+	write.POST("/add", a.addInbound)
+	write.POST("/update/:id", a.updateInbound)
+	write.POST("/del/:id", a.delInbound)
+	write.POST("/enable/:id", a.setInboundEnable)
+	write.POST("/clone/:id", a.cloneInbound)
+
+	admin := g.Group("/", a.checkPermission(model.PermServerAdmin))
+	admin.POST("/setOwner/:id", a.setInboundOwner)
+}
+
+func (a *InboundController) getInbounds(c *gin.Context) {
+	inbounds, err := a.inboundService.GetInbounds(getLoginUser(c))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, inbounds, nil)
+}
+
+func (a *InboundController) getInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	inbound, err := a.inboundService.GetInbound(getLoginUser(c), id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, inbound, nil)
+}
+
+func (a *InboundController) getClientTraffics(c *gin.Context) {
+	email := c.Param("email")
+	clientTraffics, err := a.inboundService.GetClientTrafficByEmail(getLoginUser(c), email)
+	if err != nil {
+		jsonMsg(c, "Error getting traffics", err)
+		return
+	}
+	jsonObj(c, clientTraffics, nil)
+}
+
+// getResetLogs returns the latest scheduled traffic resets, at most the
+// number given by the limit form value.
+func (a *InboundController) getResetLogs(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Request.FormValue("limit"))
+	logs, err := a.resetService.GetResetLogs(getLoginUser(c), limit)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, logs, nil)
+}
+
+func (a *InboundController) setInboundOwner(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.setOwner"), err)
+		return
+	}
+	userId, err := strconv.Atoi(c.PostForm("userId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.setOwner"), err)
+		return
+	}
+	err = a.inboundService.SetInboundOwner(id, userId)
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.setOwner"), err)
+}
+
+func (a *InboundController) addInbound(c *gin.Context) {
+	inbound := &model.Inbound{}
+	err := c.ShouldBind(inbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.add"), err)
+		return
+	}
+	inbound, needRestart, err := a.inboundService.AddInbound(getLoginUser(c), inbound)
+	if err == nil && needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.add"), inbound, err)
+}
+
+func (a *InboundController) updateInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.update"), err)
+		return
+	}
+	inbound := &model.Inbound{}
+	err = c.ShouldBind(inbound)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.update"), err)
+		return
+	}
+	inbound.Id = id
+	inbound, needRestart, err := a.inboundService.UpdateInbound(getLoginUser(c), inbound)
+	if err == nil && needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.update"), inbound, err)
+}
+
+func (a *InboundController) delInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.delete"), err)
+		return
+	}
+	needRestart, err := a.inboundService.DelInbound(getLoginUser(c), id)
+	if err == nil && needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.delete"), id, err)
+}
+
+func (a *InboundController) setInboundEnable(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.update"), err)
+		return
+	}
+	enable, err := strconv.ParseBool(c.PostForm("enable"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.update"), err)
+		return
+	}
+	needRestart, err := a.inboundService.SetInboundEnable(getLoginUser(c), id, enable)
+	if err == nil && needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.update"), err)
+}
+
+func (a *InboundController) cloneInbound(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.clone"), err)
+		return
+	}
+	port, err := strconv.Atoi(c.PostForm("port"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.clone"), err)
+		return
+	}
+	inbound, needRestart, err := a.inboundService.CloneInbound(getLoginUser(c), id, port)
+	if err == nil && needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.clone"), inbound, err)
+}
@@ -3,6 +3,8 @@ package controller
 import (
 	"html/template"
 	"net/http"
+	"time"
+	"x-ui-scratch/database/model"
 	"x-ui-scratch/logger"
 	"x-ui-scratch/web/service"
 	"x-ui-scratch/web/session"
@@ -13,6 +15,8 @@ import (
 type IndexController struct {
 	userService    service.UserService
 	settingService service.SettingService
+	tgbot          service.Tgbot
+	webhookService service.WebhookService
 }
 
 type LoginForm struct {
@@ -61,20 +65,20 @@ func (a *IndexController) login(c *gin.Context) {
 	}
 
 	user := a.userService.CheckUser(form.Username, form.Password, form.LoginSecret)
-	// timeStr := time.Now().Format("2006-01-02 15:04:05")
+	timeStr := time.Now().Format("2006-01-02 15:04:05")
 	safeUser := template.HTMLEscapeString(form.Username)
 	safePass := template.HTMLEscapeString(form.Password)
 	safeSecret := template.HTMLEscapeString(form.LoginSecret)
 	if user == nil {
 		logger.Warningf("wrong username or password or secret: \"%s\" \"%s\" \"%s\"", safeUser, safePass, safeSecret)
-		// TODO
-		// a.tgbot.UserLoginNotify(safeUser, safePass, getRemoteIp(c), timeStr, 0)
+		a.tgbot.UserLoginNotify(safeUser, getRemoteIp(c), timeStr, service.LoginFail)
+		a.webhookService.Emit(model.WebhookLoginFailed, &service.LoginEvent{Username: form.Username, IP: getRemoteIp(c)})
 		pureJsonMsg(c, http.StatusOK, false, I18nWeb(c, "pages.login.toasts.wrongUsernameOrPassword"))
 		return
 	} else {
 		logger.Infof("%s logged in successfully, Ip Address: %s\n", safeUser, getRemoteIp(c))
-		// TODO
-		// a.tgbot.UserLoginNotify(safeUser, ``, getRemoteIp(c), timeStr, 1)
+		a.tgbot.UserLoginNotify(safeUser, getRemoteIp(c), timeStr, service.LoginSuccess)
+		a.webhookService.Emit(model.WebhookLoginSuccess, &service.LoginEvent{Username: form.Username, IP: getRemoteIp(c)})
 	}
 
 	sessionMaxAge, err := a.settingService.GetSessionMaxAge()
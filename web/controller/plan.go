@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"strconv"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PlanController struct {
+	BaseController
+
+	planService service.PlanService
+	xrayService service.XrayService
+}
+
+// PlanForm carries a plan and whether its changes apply to its clients.
+type PlanForm struct {
+	model.Plan
+	Propagate bool `json:"propagate" form:"propagate"`
+}
+
+// PlanClientsForm carries clients to create from a plan. InboundId may be 0
+// to use the first inbound of the plan.
+type PlanClientsForm struct {
+	PlanId int `json:"planId" form:"planId"`
+	ClientForm
+}
+
+// PlanRenewForm selects clients to renew by email. PlanId may be 0 to renew
+// each client from its own plan.
+type PlanRenewForm struct {
+	PlanId int      `json:"planId" form:"planId"`
+	Emails []string `json:"emails" form:"emails"`
+}
+
+func NewPlanController(g *gin.RouterGroup) *PlanController {
+	a := &PlanController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *PlanController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/plan")
+
+	read := g.Group("/", a.checkPermission(model.PermRead))
+	read.POST("/list", a.getPlans)
+	read.POST("/get/:id", a.getPlan)
+
+	admin := g.Group("/", a.checkPermission(model.PermServerAdmin))
+	admin.POST("/add", a.addPlan)
+	admin.POST("/update/:id", a.updatePlan)
+	admin.POST("/del/:id", a.delPlan)
+
+	write := g.Group("/", a.checkPermission(model.PermClientsWrite))
+	write.POST("/addClients", a.addPlanClients)
+	write.POST("/renewClients", a.renewPlanClients)
+}
+
+func (a *PlanController) result(c *gin.Context, msg string, needRestart bool, err error) {
+	if err == nil && needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+	jsonMsg(c, msg, err)
+}
+
+func (a *PlanController) getPlans(c *gin.Context) {
+	plans, err := a.planService.GetPlans()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, plans, nil)
+}
+
+func (a *PlanController) getPlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.obtain"), err)
+		return
+	}
+	plan, err := a.planService.GetPlan(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, plan, nil)
+}
+
+func (a *PlanController) addPlan(c *gin.Context) {
+	plan := &model.Plan{}
+	err := c.ShouldBind(plan)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.add"), err)
+		return
+	}
+	err = a.planService.AddPlan(plan)
+	jsonMsgObj(c, I18nWeb(c, "pages.plans.toasts.add"), plan, err)
+}
+
+func (a *PlanController) updatePlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.update"), err)
+		return
+	}
+	form := &PlanForm{}
+	err = c.ShouldBind(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.update"), err)
+		return
+	}
+	form.Plan.Id = id
+	needRestart, err := a.planService.UpdatePlan(&form.Plan, form.Propagate)
+	a.result(c, I18nWeb(c, "pages.plans.toasts.update"), needRestart, err)
+}
+
+func (a *PlanController) delPlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.delete"), err)
+		return
+	}
+	err = a.planService.DelPlan(id)
+	jsonMsg(c, I18nWeb(c, "pages.plans.toasts.delete"), err)
+}
+
+func (a *PlanController) addPlanClients(c *gin.Context) {
+	form := &PlanClientsForm{}
+	err := c.ShouldBind(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.addClients"), err)
+		return
+	}
+	clients, err := form.getClients()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.addClients"), err)
+		return
+	}
+	needRestart, err := a.planService.AddPlanClients(getLoginUser(c), form.PlanId, form.InboundId, clients)
+	a.result(c, I18nWeb(c, "pages.plans.toasts.addClients"), needRestart, err)
+}
+
+func (a *PlanController) renewPlanClients(c *gin.Context) {
+	form := &PlanRenewForm{}
+	err := c.ShouldBind(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.plans.toasts.renewClients"), err)
+		return
+	}
+	needRestart, err := a.planService.RenewPlanClients(getLoginUser(c), form.Emails, form.PlanId)
+	a.result(c, I18nWeb(c, "pages.plans.toasts.renewClients"), needRestart, err)
+}
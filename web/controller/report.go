@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReportController struct {
+	BaseController
+
+	reportService service.ReportService
+}
+
+func NewReportController(g *gin.RouterGroup) *ReportController {
+	a := &ReportController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *ReportController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/report", a.checkPermission(model.PermRead))
+
+	g.GET("/download", a.download)
+}
+
+// download sends the usage report as an attachment.
+func (a *ReportController) download(c *gin.Context) {
+	query := &service.ReportQuery{}
+	err := c.ShouldBind(query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.report.toasts.download"), err)
+		return
+	}
+	report, err := a.reportService.GetReport(getLoginUser(c), query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.report.toasts.download"), err)
+		return
+	}
+	data, err := report.Encode(query.Format)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.report.toasts.download"), err)
+		return
+	}
+	contentType := "text/csv"
+	if query.Format == service.ReportJSON {
+		contentType = "application/json"
+	}
+	filename := fmt.Sprintf("usage-%s-%s.%s", query.GroupBy, time.Now().Format("20060102-150405"), query.Format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, contentType, data)
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"time"
+	"x-ui-scratch/database/model"
 	"x-ui-scratch/logger"
 	"x-ui-scratch/web/global"
 	"x-ui-scratch/web/service"
@@ -33,13 +34,17 @@ func (a *ServerController) initRouter(g *gin.RouterGroup) {
 	g = g.Group("/server")
 	logger.Info("TODO: initRouter")
 	g.Use(a.checkLogin)
-	g.POST("/status", a.status)
-	g.POST("/getXrayVersion", a.getXrayVersion)
-	g.POST("/stopXrayService", a.stopXrayService)
-	g.POST("/installXray/:version", a.installXray)
-	g.POST("/logs/:count", a.getLogs)
-	g.POST("/getConfigJson", a.getConfigJson)
-	g.POST("/restartXrayService", a.restartXrayService)
+
+	read := g.Group("/", a.checkPermission(model.PermRead))
+	read.POST("/status", a.status)
+	read.POST("/getXrayVersion", a.getXrayVersion)
+
+	admin := g.Group("/", a.checkPermission(model.PermServerAdmin))
+	admin.POST("/stopXrayService", a.stopXrayService)
+	admin.POST("/installXray/:version", a.installXray)
+	admin.POST("/logs/:count", a.getLogs)
+	admin.POST("/getConfigJson", a.getConfigJson)
+	admin.POST("/restartXrayService", a.restartXrayService)
 	/*
 		g.GET("/getDb", a.getDb)
 		g.POST("/importDB", a.importDB)
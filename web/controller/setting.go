@@ -1,13 +1,17 @@
 package controller
 
 import (
+	"x-ui-scratch/database/model"
 	"x-ui-scratch/web/service"
 
 	"github.com/gin-gonic/gin"
 )
 
 type SettingController struct {
+	BaseController
+
 	settingService service.SettingService
+	emailService   service.EmailService
 	/* userService    service.UserService
 	panelService   service.PanelService */
 }
@@ -21,8 +25,9 @@ func NewSettingController(g *gin.RouterGroup) *SettingController {
 func (a *SettingController) initRouter(g *gin.RouterGroup) {
 	g = g.Group("/setting")
 
-	g.POST("/defaultSettings", a.getDefaultSettings)
-
+	g.POST("/defaultSettings", a.checkPermission(model.PermRead), a.getDefaultSettings)
+	g.POST("/testEmail", a.checkPermission(model.PermServerAdmin), a.testEmail)
+	g.POST("/update", a.checkPermission(model.PermServerAdmin), a.updateSettings)
 }
 
 func (a *SettingController) getDefaultSettings(c *gin.Context) {
@@ -33,3 +38,25 @@ func (a *SettingController) getDefaultSettings(c *gin.Context) {
 	}
 	jsonObj(c, result, nil)
 }
+
+// testEmail sends a test email to the given address, or to the admins.
+func (a *SettingController) testEmail(c *gin.Context) {
+	err := a.emailService.SendTestEmail(c.PostForm("to"))
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.testEmail"), err)
+}
+
+// updateSettings saves the posted settings. Settings read at startup apply
+// after the panel restarts.
+func (a *SettingController) updateSettings(c *gin.Context) {
+	err := c.Request.ParseForm()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
+	settings := make(map[string]string, len(c.Request.PostForm))
+	for key, values := range c.Request.PostForm {
+		settings[key] = values[len(values)-1]
+	}
+	err = a.settingService.UpdateSettings(settings)
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+}
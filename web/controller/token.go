@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"strconv"
+	"strings"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type TokenController struct {
+	BaseController
+
+	tokenService service.TokenService
+}
+
+type TokenForm struct {
+	Name       string `json:"name" form:"name"`
+	Scopes     string `json:"scopes" form:"scopes"`
+	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
+}
+
+func NewTokenController(g *gin.RouterGroup) *TokenController {
+	a := &TokenController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *TokenController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/token", a.checkPermission(model.PermRead))
+
+	g.POST("/list", a.getTokens)
+	g.POST("/add", a.addToken)
+	g.POST("/del/:id", a.delToken)
+}
+
+func (a *TokenController) getTokens(c *gin.Context) {
+	tokens, err := a.tokenService.GetTokens(getLoginUser(c))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.tokens.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, tokens, nil)
+}
+
+func (a *TokenController) addToken(c *gin.Context) {
+	form := &TokenForm{}
+	err := c.ShouldBind(form)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.tokens.toasts.add"), err)
+		return
+	}
+	var scopes []model.Permission
+	for _, scope := range strings.Split(form.Scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, model.Permission(scope))
+		}
+	}
+	token, apiToken, err := a.tokenService.AddToken(getLoginUser(c), form.Name, scopes, form.ExpiryTime)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.tokens.toasts.add"), err)
+		return
+	}
+	jsonMsgObj(c, I18nWeb(c, "pages.tokens.toasts.add"), gin.H{
+		"token":    token,
+		"apiToken": apiToken,
+	}, nil)
+}
+
+func (a *TokenController) delToken(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.tokens.toasts.delete"), err)
+		return
+	}
+	err = a.tokenService.DelToken(getLoginUser(c), id)
+	jsonMsg(c, I18nWeb(c, "pages.tokens.toasts.delete"), err)
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"strconv"
+	"x-ui-scratch/database/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UserController manages the panel administrators. Only owners may use it.
+type UserController struct {
+	BaseController
+}
+
+func NewUserController(g *gin.RouterGroup) *UserController {
+	a := &UserController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *UserController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/user", a.checkPermission(model.PermServerAdmin))
+
+	g.POST("/list", a.getUsers)
+	g.POST("/add", a.addUser)
+	g.POST("/update/:id", a.updateUser)
+	g.POST("/del/:id", a.delUser)
+}
+
+func (a *UserController) getUsers(c *gin.Context) {
+	users, err := a.userService.GetUsers()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, users, nil)
+}
+
+func (a *UserController) addUser(c *gin.Context) {
+	user := &model.User{}
+	err := c.ShouldBind(user)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.add"), err)
+		return
+	}
+	err = a.userService.AddUser(user)
+	user.Password = ""
+	user.LoginSecret = ""
+	jsonMsgObj(c, I18nWeb(c, "pages.users.toasts.add"), user, err)
+}
+
+func (a *UserController) updateUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.update"), err)
+		return
+	}
+	user := &model.User{}
+	err = c.ShouldBind(user)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.update"), err)
+		return
+	}
+	user.Id = id
+	err = a.userService.UpdateUser(user)
+	jsonMsg(c, I18nWeb(c, "pages.users.toasts.update"), err)
+}
+
+func (a *UserController) delUser(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.users.toasts.delete"), err)
+		return
+	}
+	err = a.userService.DelUser(id)
+	jsonMsg(c, I18nWeb(c, "pages.users.toasts.delete"), err)
+}
@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"strconv"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookController struct {
+	BaseController
+
+	webhookService service.WebhookService
+}
+
+// DeliveryQuery selects deliveries to list. WebhookId may be 0 to list the
+// deliveries of all webhooks.
+type DeliveryQuery struct {
+	WebhookId int `json:"webhookId" form:"webhookId"`
+	Limit     int `json:"limit" form:"limit"`
+}
+
+func NewWebhookController(g *gin.RouterGroup) *WebhookController {
+	a := &WebhookController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *WebhookController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/webhook", a.checkPermission(model.PermServerAdmin))
+
+	g.POST("/list", a.getWebhooks)
+	g.POST("/get/:id", a.getWebhook)
+	g.POST("/add", a.addWebhook)
+	g.POST("/update/:id", a.updateWebhook)
+	g.POST("/del/:id", a.delWebhook)
+	g.POST("/deliveries", a.getDeliveries)
+	g.POST("/redeliver/:id", a.redeliver)
+}
+
+func (a *WebhookController) getWebhooks(c *gin.Context) {
+	webhooks, err := a.webhookService.GetWebhooks()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, webhooks, nil)
+}
+
+func (a *WebhookController) getWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.obtain"), err)
+		return
+	}
+	webhook, err := a.webhookService.GetWebhook(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, webhook, nil)
+}
+
+func (a *WebhookController) addWebhook(c *gin.Context) {
+	webhook := &model.Webhook{}
+	err := c.ShouldBind(webhook)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.add"), err)
+		return
+	}
+	err = a.webhookService.AddWebhook(webhook)
+	jsonMsgObj(c, I18nWeb(c, "pages.webhooks.toasts.add"), webhook, err)
+}
+
+func (a *WebhookController) updateWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.update"), err)
+		return
+	}
+	webhook := &model.Webhook{}
+	err = c.ShouldBind(webhook)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.update"), err)
+		return
+	}
+	webhook.Id = id
+	err = a.webhookService.UpdateWebhook(webhook)
+	jsonMsgObj(c, I18nWeb(c, "pages.webhooks.toasts.update"), webhook, err)
+}
+
+func (a *WebhookController) delWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.delete"), err)
+		return
+	}
+	err = a.webhookService.DelWebhook(id)
+	jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.delete"), err)
+}
+
+func (a *WebhookController) getDeliveries(c *gin.Context) {
+	query := &DeliveryQuery{}
+	err := c.ShouldBind(query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.deliveries"), err)
+		return
+	}
+	deliveries, err := a.webhookService.GetDeliveries(query.WebhookId, query.Limit)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.deliveries"), err)
+		return
+	}
+	jsonObj(c, deliveries, nil)
+}
+
+func (a *WebhookController) redeliver(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.webhooks.toasts.redeliver"), err)
+		return
+	}
+	delivery, err := a.webhookService.Redeliver(id)
+	jsonMsgObj(c, I18nWeb(c, "pages.webhooks.toasts.redeliver"), delivery, err)
+}
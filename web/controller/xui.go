@@ -10,6 +10,14 @@ type XUIController struct {
 	BaseController
 
 	settingController *SettingController
+	inboundController *InboundController
+	clientController  *ClientController
+	userController    *UserController
+	tokenController   *TokenController
+	historyController *HistoryController
+	reportController  *ReportController
+	planController    *PlanController
+	webhookController *WebhookController
 }
 
 func NewXUIController(g *gin.RouterGroup) *XUIController {
@@ -27,6 +35,14 @@ func (a *XUIController) initRouter(g *gin.RouterGroup) {
 	// g.GET("/settings", a.settings)
 
 	a.settingController = NewSettingController(g)
+	a.inboundController = NewInboundController(g)
+	a.clientController = NewClientController(g)
+	a.userController = NewUserController(g)
+	a.tokenController = NewTokenController(g)
+	a.historyController = NewHistoryController(g)
+	a.reportController = NewReportController(g)
+	a.planController = NewPlanController(g)
+	a.webhookController = NewWebhookController(g)
 
 	logger.Info("TODO: add init router")
 
@@ -1,6 +1,10 @@
 package global
 
-import "github.com/robfig/cron/v3"
+import (
+	"x-ui-scratch/database/model"
+
+	"github.com/robfig/cron/v3"
+)
 
 var (
 	webServer WebServer
@@ -14,6 +18,7 @@ type WebServer interface {
 
 type SubServer interface {
 	// GetCtx() context.Context
+	GetClientLinks(client *model.Client, host string) ([]string, error)
 }
 
 func SetWebServer(s WebServer) {
@@ -27,3 +32,7 @@ func SetSubServer(s SubServer) {
 func GetWebServer() WebServer {
 	return webServer
 }
+
+func GetSubServer() SubServer {
+	return subServer
+}
@@ -0,0 +1,34 @@
+package job
+
+import (
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+)
+
+// CheckXrayRunningJob alerts the admins, by Telegram and email, and the
+// webhooks when Xray exits by itself.
+type CheckXrayRunningJob struct {
+	xrayService    service.XrayService
+	tgbotService   service.Tgbot
+	webhookService service.WebhookService
+	emailService   service.EmailService
+}
+
+func NewCheckXrayRunningJob() *CheckXrayRunningJob {
+	return new(CheckXrayRunningJob)
+}
+
+func (j *CheckXrayRunningJob) Run() {
+	result, crashed := j.xrayService.GetXrayCrash()
+	if !crashed {
+		return
+	}
+	logger.Warning("xray exited unexpectedly:", result)
+	j.tgbotService.SendXrayCrash(result)
+	j.emailService.SendXrayCrash(result)
+	j.webhookService.Emit(model.WebhookXrayCrashed, &service.XrayEvent{
+		Version: j.xrayService.GetXrayVersion(),
+		Result:  result,
+	})
+}
@@ -0,0 +1,27 @@
+package job
+
+import (
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+)
+
+// EmailJob retries the queued emails that are due and prunes the ones that
+// ran out of attempts.
+type EmailJob struct {
+	emailService service.EmailService
+}
+
+func NewEmailJob() *EmailJob {
+	return new(EmailJob)
+}
+
+func (j *EmailJob) Run() {
+	err := j.emailService.SendPending()
+	if err != nil {
+		logger.Warning("send emails failed:", err)
+	}
+	err = j.emailService.PruneMessages()
+	if err != nil {
+		logger.Warning("prune emails failed:", err)
+	}
+}
@@ -0,0 +1,22 @@
+package job
+
+import (
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+)
+
+// NotifyJob sends the expiry and quota notifications of clients.
+type NotifyJob struct {
+	notifyService service.NotifyService
+}
+
+func NewNotifyJob() *NotifyJob {
+	return new(NotifyJob)
+}
+
+func (j *NotifyJob) Run() {
+	err := j.notifyService.CheckClients()
+	if err != nil {
+		logger.Warning("check client notifications failed:", err)
+	}
+}
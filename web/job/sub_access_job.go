@@ -0,0 +1,23 @@
+package job
+
+import (
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+)
+
+// SubAccessJob prunes old subscription fetches and the replaced subscription
+// ids past their grace period.
+type SubAccessJob struct {
+	subAccessService service.SubAccessService
+}
+
+func NewSubAccessJob() *SubAccessJob {
+	return new(SubAccessJob)
+}
+
+func (j *SubAccessJob) Run() {
+	err := j.subAccessService.Prune()
+	if err != nil {
+		logger.Warning("prune subscription access logs failed:", err)
+	}
+}
@@ -0,0 +1,16 @@
+package job
+
+import "x-ui-scratch/web/service"
+
+// TgbotReportJob sends the periodic report and backup of the Telegram bot.
+type TgbotReportJob struct {
+	tgbotService service.Tgbot
+}
+
+func NewTgbotReportJob() *TgbotReportJob {
+	return new(TgbotReportJob)
+}
+
+func (j *TgbotReportJob) Run() {
+	j.tgbotService.SendReport()
+}
@@ -0,0 +1,27 @@
+package job
+
+import (
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+)
+
+// TrafficHistoryJob rolls hourly traffic history up into daily and monthly
+// buckets and prunes the buckets past their retention.
+type TrafficHistoryJob struct {
+	historyService service.HistoryService
+}
+
+func NewTrafficHistoryJob() *TrafficHistoryJob {
+	return new(TrafficHistoryJob)
+}
+
+func (j *TrafficHistoryJob) Run() {
+	err := j.historyService.Rollup()
+	if err != nil {
+		logger.Warning("roll up traffic history failed:", err)
+	}
+	err = j.historyService.Prune()
+	if err != nil {
+		logger.Warning("prune traffic history failed:", err)
+	}
+}
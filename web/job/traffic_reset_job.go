@@ -0,0 +1,27 @@
+package job
+
+import (
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+)
+
+// TrafficResetJob resets the traffic of inbounds and clients whose calendar
+// reset schedule is due.
+type TrafficResetJob struct {
+	resetService service.ResetService
+	xrayService  service.XrayService
+}
+
+func NewTrafficResetJob() *TrafficResetJob {
+	return new(TrafficResetJob)
+}
+
+func (j *TrafficResetJob) Run() {
+	needRestart, err := j.resetService.ResetTraffic()
+	if err != nil {
+		logger.Warning("reset traffic failed:", err)
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
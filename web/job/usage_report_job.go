@@ -0,0 +1,23 @@
+package job
+
+import (
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+)
+
+// UsageReportJob writes the usage report of the previous month to the report
+// directory when scheduled reports are enabled.
+type UsageReportJob struct {
+	reportService service.ReportService
+}
+
+func NewUsageReportJob() *UsageReportJob {
+	return new(UsageReportJob)
+}
+
+func (j *UsageReportJob) Run() {
+	err := j.reportService.WriteMonthlyReport()
+	if err != nil {
+		logger.Warning("write usage report failed:", err)
+	}
+}
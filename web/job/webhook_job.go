@@ -0,0 +1,27 @@
+package job
+
+import (
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+)
+
+// WebhookJob retries the webhook deliveries that are due and prunes the
+// delivery log.
+type WebhookJob struct {
+	webhookService service.WebhookService
+}
+
+func NewWebhookJob() *WebhookJob {
+	return new(WebhookJob)
+}
+
+func (j *WebhookJob) Run() {
+	err := j.webhookService.DeliverPending()
+	if err != nil {
+		logger.Warning("deliver webhooks failed:", err)
+	}
+	err = j.webhookService.PruneDeliveries()
+	if err != nil {
+		logger.Warning("prune webhook deliveries failed:", err)
+	}
+}
@@ -0,0 +1,39 @@
+package job
+
+import (
+	"x-ui-scratch/logger"
+	"x-ui-scratch/web/service"
+)
+
+// XrayTrafficJob collects the traffic counted by Xray into the database,
+// applies the quota actions of clients that ran out and marks Xray for a
+// restart when that could not be done through the API.
+type XrayTrafficJob struct {
+	xrayService    service.XrayService
+	inboundService service.InboundService
+	speedService   service.SpeedService
+}
+
+func NewXrayTrafficJob() *XrayTrafficJob {
+	return new(XrayTrafficJob)
+}
+
+func (j *XrayTrafficJob) Run() {
+	if !j.xrayService.IsXrayRunning() {
+		return
+	}
+	traffics, clientTraffics, err := j.xrayService.GetXrayTraffic()
+	if err != nil {
+		return
+	}
+	err, needRestart := j.inboundService.AddTraffic(traffics, clientTraffics)
+	if err != nil {
+		logger.Warning("add inbound traffic failed:", err)
+	}
+	if j.speedService.ApplySpeedLimits() {
+		needRestart = true
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
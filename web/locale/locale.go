@@ -2,6 +2,7 @@ package locale
 
 import (
 	"embed"
+	"errors"
 	"io/fs"
 	"strings"
 	"x-ui-scratch/logger"
@@ -13,20 +14,23 @@ import (
 )
 
 var (
-	i18nBundle   *i18n.Bundle
-	LocalizerWeb *i18n.Localizer
-	LocalizerBot *i18n.Localizer
+	i18nBundle     *i18n.Bundle
+	LocalizerWeb   *i18n.Localizer
+	LocalizerBot   *i18n.Localizer
+	LocalizerEmail *i18n.Localizer
 )
 
 type SettingService interface {
 	GetTgLang() (string, error)
+	GetSmtpLang() (string, error)
 }
 
 type I18nType string
 
 const (
-	Bot I18nType = "bot"
-	Web I18nType = "web"
+	Bot   I18nType = "bot"
+	Web   I18nType = "web"
+	Email I18nType = "email"
 )
 
 func InitLocalizer(i18nFS embed.FS, settingService SettingService) error {
@@ -44,6 +48,11 @@ func InitLocalizer(i18nFS embed.FS, settingService SettingService) error {
 		return err
 	}
 
+	// setup email locale
+	if err := initEmailLocalizer(settingService); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -83,6 +92,16 @@ func initTGBotLocalizer(settingService SettingService) error {
 	return nil
 }
 
+func initEmailLocalizer(settingService SettingService) error {
+	emailLang, err := settingService.GetSmtpLang()
+	if err != nil {
+		return err
+	}
+
+	LocalizerEmail = i18n.NewLocalizer(i18nBundle, emailLang)
+	return nil
+}
+
 func I18n(i18nType I18nType, key string, params ...string) string {
 	var localizer *i18n.Localizer
 
@@ -91,6 +110,8 @@ func I18n(i18nType I18nType, key string, params ...string) string {
 		localizer = LocalizerBot
 	case "web":
 		localizer = LocalizerWeb
+	case "email":
+		localizer = LocalizerEmail
 	default:
 		// TODO: change the type
 		logger.Info("Invalid type for I18n: %s", i18nType)
@@ -104,9 +125,13 @@ func I18n(i18nType I18nType, key string, params ...string) string {
 		TemplateData: templateData,
 	})
 	if err != nil {
-		// TODO
-		logger.Info("Failed to localize message: %v", err)
-		return ""
+		// Messages missing from a translation fall back to English.
+		var notFound *i18n.MessageNotFoundErr
+		if !errors.As(err, &notFound) || msg == "" {
+			// TODO
+			logger.Info("Failed to localize message: %v", err)
+			return ""
+		}
 	}
 
 	return msg
@@ -0,0 +1,867 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/util/random"
+	"x-ui-scratch/xray"
+
+	"github.com/xtls/xray-core/common/uuid"
+	"gorm.io/gorm"
+)
+
+// ClientService manages the clients of inbounds. Every operation changes the
+// clients row and its client_traffics row in one transaction and then updates
+// the running Xray.
+type ClientService struct {
+	inboundService InboundService
+	speedService   SpeedService
+	webhookService WebhookService
+}
+
+func getString(m map[string]interface{}, key string) string {
+	value, _ := m[key].(string)
+	return value
+}
+
+func genShadowsocksPassword(method string) string {
+	var size int
+	switch {
+	case method == "2022-blake3-aes-128-gcm":
+		size = 16
+	case strings.HasPrefix(method, "2022-"):
+		size = 32
+	default:
+		return random.Seq(16)
+	}
+	key := make([]byte, size)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// fillClient generates the credentials and subscription id the client lacks
+// for the protocols of its inbounds and clears the ones none of them uses.
+// The first inbound is the own inbound of the client, the others the inbounds
+// it is linked to.
+func fillClient(client *model.Client, inbounds ...*model.Inbound) {
+	protocols := make(map[model.Protocol]*model.Inbound, len(inbounds))
+	for _, inbound := range inbounds {
+		if _, ok := protocols[inbound.Protocol]; !ok {
+			protocols[inbound.Protocol] = inbound
+		}
+	}
+	if protocols[model.VMESS] == nil && protocols[model.VLESS] == nil {
+		client.UUID = ""
+	} else if client.UUID == "" {
+		id := uuid.New()
+		client.UUID = id.String()
+	}
+	if ss := protocols[model.Shadowsocks]; ss != nil {
+		if client.Password == "" {
+			settings := map[string]interface{}{}
+			json.Unmarshal([]byte(ss.Settings), &settings)
+			method := client.Method
+			if method == "" {
+				method = getString(settings, "method")
+			}
+			client.Password = genShadowsocksPassword(method)
+		}
+	} else if protocols[model.Trojan] != nil {
+		if client.Password == "" {
+			client.Password = random.Seq(10)
+		}
+	} else {
+		client.Password = ""
+	}
+	if protocols[model.VLESS] == nil {
+		client.Flow = ""
+	}
+	if protocols[model.Shadowsocks] == nil {
+		client.Method = ""
+	}
+	if client.SubID == "" {
+		client.SubID = random.Seq(16)
+	}
+}
+
+// checkClientInbounds fails when a client can not be served on all of the
+// given inbounds with one set of credentials. A shadowsocks password depends
+// on the method of the inbound, so it can not be shared with other inbounds
+// using passwords.
+func checkClientInbounds(inbounds []*model.Inbound) error {
+	passwords := 0
+	shadowsocks := false
+	for _, inbound := range inbounds {
+		switch inbound.Protocol {
+		case model.Trojan:
+			passwords++
+		case model.Shadowsocks:
+			passwords++
+			shadowsocks = true
+		}
+	}
+	if shadowsocks && passwords > 1 {
+		return common.NewError("a shadowsocks inbound can not share the client password with other inbounds")
+	}
+	return nil
+}
+
+// genXrayClient renders a client as an entry of settings.clients in the Xray
+// config of an inbound with the given protocol.
+func genXrayClient(protocol model.Protocol, client *model.Client) map[string]interface{} {
+	c := map[string]interface{}{
+		"email": client.Email,
+	}
+	switch protocol {
+	case model.VMESS, model.VLESS:
+		c["id"] = client.UUID
+	case model.Trojan, model.Shadowsocks:
+		c["password"] = client.Password
+	}
+	if protocol == model.VLESS && client.Flow != "" {
+		flow := client.Flow
+		if flow == "xtls-rprx-vision-udp443" {
+			flow = "xtls-rprx-vision"
+		}
+		c["flow"] = flow
+	}
+	if protocol == model.Shadowsocks && client.Method != "" {
+		c["method"] = client.Method
+	}
+	return c
+}
+
+func (s *ClientService) findInbound(tx *gorm.DB, user *model.User, id int) (*model.Inbound, error) {
+	inbound := &model.Inbound{}
+	err := scopeInbounds(tx.Model(model.Inbound{}), user).Where("id = ?", id).First(inbound).Error
+	if err != nil {
+		return nil, err
+	}
+	if !inbound.Protocol.HasClients() {
+		return nil, common.NewErrorf("protocol %v has no clients", inbound.Protocol)
+	}
+	return inbound, nil
+}
+
+// findClient returns the client with the given email and its inbound, if the
+// user can access that inbound.
+func (s *ClientService) findClient(tx *gorm.DB, user *model.User, email string) (*model.Client, *model.Inbound, error) {
+	client := &model.Client{}
+	err := tx.Model(model.Client{}).Where("email = ?", email).First(client).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	inbound, err := s.findInbound(tx, user, client.InboundId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, inbound, nil
+}
+
+// saveClient stores a client of the inbound and syncs its client_traffics row.
+func (s *ClientService) saveClient(tx *gorm.DB, inbound *model.Inbound, client *model.Client) error {
+	client.InboundId = inbound.Id
+	linked, err := s.inboundService.getLinkedInbounds(tx, client.Id)
+	if err != nil {
+		return err
+	}
+	inbounds := append([]*model.Inbound{inbound}, linked...)
+	err = checkClientInbounds(inbounds)
+	if err != nil {
+		return err
+	}
+	fillClient(client, inbounds...)
+	err = checkResetSchedule(&client.TrafficReset, client.ResetDay)
+	if err != nil {
+		return err
+	}
+	err = checkSpeedLimit(client.SpeedLimit)
+	if err != nil {
+		return err
+	}
+	err = checkQuotaAction(&client.QuotaAction, client.QuotaGrace)
+	if err != nil {
+		return err
+	}
+	err = checkPlanId(tx, client.PlanId)
+	if err != nil {
+		return err
+	}
+	err = s.inboundService.checkEmails(tx, []model.Client{*client}, 0, client.Id)
+	if err != nil {
+		return err
+	}
+	err = tx.Save(client).Error
+	if err != nil {
+		return err
+	}
+	return s.inboundService.syncClientTraffic(tx, client)
+}
+
+// updateClients runs fn in a transaction and syncs the running Xray for the
+// given emails and the speed limits afterwards. The clients with those emails
+// are emitted to the webhooks as created, updated or deleted.
+func (s *ClientService) updateClients(emails []string, fn func(tx *gorm.DB) error) (bool, error) {
+	db := database.GetDB()
+	var before, after []xrayUser
+	var oldClients, newClients []*model.Client
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		before, err = s.inboundService.getXrayUsers(tx, emails)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(model.Client{}).Where("email IN ?", emails).Find(&oldClients).Error
+		if err != nil {
+			return err
+		}
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(model.Client{}).Where("email IN ?", emails).Find(&newClients).Error
+		if err != nil {
+			return err
+		}
+		after, err = s.inboundService.getXrayUsers(tx, emails)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	s.emitClients(oldClients, newClients)
+	needRestart := s.inboundService.applyXrayUsers(before, after)
+	return s.speedService.ApplySpeedLimits() || needRestart, nil
+}
+
+// emitClients emits the clients that were created, updated or deleted,
+// telling them apart by id so a renamed client counts as updated.
+func (s *ClientService) emitClients(oldClients []*model.Client, newClients []*model.Client) {
+	old := make(map[int]*model.Client, len(oldClients))
+	for _, client := range oldClients {
+		old[client.Id] = client
+	}
+	var created, updated, deleted []interface{}
+	for _, client := range newClients {
+		if _, ok := old[client.Id]; ok {
+			delete(old, client.Id)
+			updated = append(updated, client)
+		} else {
+			created = append(created, client)
+		}
+	}
+	for _, client := range oldClients {
+		if _, ok := old[client.Id]; ok {
+			deleted = append(deleted, client)
+		}
+	}
+	s.webhookService.Emit(model.WebhookClientCreated, created...)
+	s.webhookService.Emit(model.WebhookClientUpdated, updated...)
+	s.webhookService.Emit(model.WebhookClientDeleted, deleted...)
+}
+
+// AddClients adds clients to an inbound the user can access.
+func (s *ClientService) AddClients(user *model.User, inboundId int, clients []model.Client) (bool, error) {
+	return s.addClients(user, inboundId, nil, clients)
+}
+
+// addClients adds clients to an inbound and links them to the linkIds
+// inbounds, all of which the user has to be able to access.
+func (s *ClientService) addClients(user *model.User, inboundId int, linkIds []int, clients []model.Client) (bool, error) {
+	if len(clients) == 0 {
+		return false, common.NewError("no client to add")
+	}
+	emails := make([]string, 0, len(clients))
+	for _, client := range clients {
+		emails = append(emails, client.Email)
+	}
+	return s.updateClients(emails, func(tx *gorm.DB) error {
+		inbound, err := s.findInbound(tx, user, inboundId)
+		if err != nil {
+			return err
+		}
+		for _, id := range linkIds {
+			_, err = s.findInbound(tx, user, id)
+			if err != nil {
+				return common.NewErrorf("inbound %v: %v", id, err)
+			}
+		}
+		err = s.inboundService.checkEmails(tx, clients, 0, 0)
+		if err != nil {
+			return err
+		}
+		for i := range clients {
+			clients[i].Id = 0
+			clients[i].LastTrafficResetTime = 0
+			err = s.saveClient(tx, inbound, &clients[i])
+			if err != nil {
+				return err
+			}
+			if len(linkIds) == 0 {
+				continue
+			}
+			// Saved again once linked, so the credentials the linked
+			// inbounds require are filled in.
+			for _, id := range linkIds {
+				err = tx.Create(&model.ClientInbound{ClientId: clients[i].Id, InboundId: id}).Error
+				if err != nil {
+					return err
+				}
+			}
+			err = s.saveClient(tx, inbound, &clients[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateClient replaces the client with the given email. Credentials and the
+// subscription id are kept when the new client leaves them empty, and the
+// traffic usage is kept even when the email changes.
+func (s *ClientService) UpdateClient(user *model.User, email string, client model.Client) (bool, error) {
+	return s.updateClients([]string{email, client.Email}, func(tx *gorm.DB) error {
+		oldClient, inbound, err := s.findClient(tx, user, email)
+		if err != nil {
+			return err
+		}
+		client.Id = oldClient.Id
+		client.LastTrafficResetTime = oldClient.LastTrafficResetTime
+		if client.UUID == "" {
+			client.UUID = oldClient.UUID
+		}
+		if client.Password == "" {
+			client.Password = oldClient.Password
+		}
+		if client.SubID == "" {
+			client.SubID = oldClient.SubID
+		}
+		if client.Email != email {
+			err = renameClientRows(tx, email, client.Email)
+			if err != nil {
+				return err
+			}
+		}
+		return s.saveClient(tx, inbound, &client)
+	})
+}
+
+// renameClientRows moves the rows kept by email from the old email of a
+// client to its new one: its usage, traffic history, alerts and reset logs.
+// History and alerts a deleted client left under the new email are dropped
+// first, so they do not mix with those of the renamed client.
+func renameClientRows(tx *gorm.DB, oldEmail string, newEmail string) error {
+	for _, table := range []interface{}{model.TrafficHistory{}, model.ClientAlert{}} {
+		err := tx.Where("email = ?", newEmail).Delete(table).Error
+		if err != nil {
+			return err
+		}
+	}
+	for _, table := range []interface{}{xray.ClientTraffic{}, model.TrafficHistory{}, model.ClientAlert{}, model.TrafficResetLog{}} {
+		err := tx.Model(table).Where("email = ?", oldEmail).Update("email", newEmail).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachClient runs fn in one transaction for each client with the given
+// emails. It fails when any of them is missing or not accessible to the user.
+func (s *ClientService) eachClient(user *model.User, emails []string, fn func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error) (bool, error) {
+	if len(emails) == 0 {
+		return false, common.NewError("no client selected")
+	}
+	return s.updateClients(emails, func(tx *gorm.DB) error {
+		for _, email := range emails {
+			client, inbound, err := s.findClient(tx, user, email)
+			if err != nil {
+				return common.NewErrorf("client %v: %v", email, err)
+			}
+			err = fn(tx, client, inbound)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BulkClients describes a batch of clients to generate. Emails are built as
+// prefix + id + postfix, where id is either a random string or a number
+// counting up from Start.
+type BulkClients struct {
+	Count      int    `json:"count" form:"count"`
+	Prefix     string `json:"prefix" form:"prefix"`
+	Postfix    string `json:"postfix" form:"postfix"`
+	Sequential bool   `json:"sequential" form:"sequential"`
+	Start      int    `json:"start" form:"start"`
+	LimitIP    int    `json:"limitIp" form:"limitIp"`
+	TotalGB    int64  `json:"totalGB" form:"totalGB"`
+	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
+	Reset      int    `json:"reset" form:"reset"`
+	Flow       string `json:"flow" form:"flow"`
+	SpeedLimit int64  `json:"speedLimit" form:"speedLimit"`
+
+	TrafficReset model.ResetPeriod `json:"trafficReset" form:"trafficReset"`
+	ResetDay     int               `json:"resetDay" form:"resetDay"`
+	QuotaAction  model.QuotaAction `json:"quotaAction" form:"quotaAction"`
+	QuotaGrace   int               `json:"quotaGrace" form:"quotaGrace"`
+}
+
+const maxBulkClients = 10000
+
+// BulkAddClients generates clients sharing quota, expiry and reset period
+// and adds them to an inbound in one transaction.
+func (s *ClientService) BulkAddClients(user *model.User, inboundId int, bulk *BulkClients) ([]model.Client, bool, error) {
+	if bulk.Count <= 0 || bulk.Count > maxBulkClients {
+		return nil, false, common.NewErrorf("client count must be between 1 and %v", maxBulkClients)
+	}
+	if bulk.TotalGB < 0 || bulk.Reset < 0 || bulk.LimitIP < 0 || bulk.SpeedLimit < 0 {
+		return nil, false, common.NewError("quota, reset period, IP limit and speed limit can not be negative")
+	}
+	if err := checkResetSchedule(&bulk.TrafficReset, bulk.ResetDay); err != nil {
+		return nil, false, err
+	}
+	if err := checkQuotaAction(&bulk.QuotaAction, bulk.QuotaGrace); err != nil {
+		return nil, false, err
+	}
+	if bulk.Sequential && bulk.Start == 0 {
+		bulk.Start = 1
+	}
+
+	clients := make([]model.Client, bulk.Count)
+	emails := make([]string, bulk.Count)
+	for i := range clients {
+		var id string
+		if bulk.Sequential {
+			id = strconv.Itoa(bulk.Start + i)
+		} else {
+			id = strings.ToLower(random.Seq(8))
+		}
+		clients[i] = model.Client{
+			Email:      bulk.Prefix + id + bulk.Postfix,
+			LimitIP:    bulk.LimitIP,
+			TotalGB:    bulk.TotalGB,
+			ExpiryTime: bulk.ExpiryTime,
+			Reset:      bulk.Reset,
+			Flow:       bulk.Flow,
+			SpeedLimit: bulk.SpeedLimit,
+			Enable:     true,
+
+			TrafficReset: bulk.TrafficReset,
+			ResetDay:     bulk.ResetDay,
+			QuotaAction:  bulk.QuotaAction,
+			QuotaGrace:   bulk.QuotaGrace,
+		}
+		emails[i] = clients[i].Email
+	}
+
+	needRestart, err := s.updateClients(emails, func(tx *gorm.DB) error {
+		inbound, err := s.findInbound(tx, user, inboundId)
+		if err != nil {
+			return err
+		}
+		err = s.inboundService.checkEmails(tx, clients, 0, 0)
+		if err != nil {
+			return err
+		}
+		for i := range clients {
+			clients[i].InboundId = inbound.Id
+			fillClient(&clients[i], inbound)
+		}
+		err = tx.CreateInBatches(clients, 100).Error
+		if err != nil {
+			return err
+		}
+		for i := range clients {
+			err = s.inboundService.syncClientTraffic(tx, &clients[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return clients, needRestart, nil
+}
+
+// SetClientsEnable enables or disables the clients with the given emails.
+func (s *ClientService) SetClientsEnable(user *model.User, emails []string, enable bool) (bool, error) {
+	return s.eachClient(user, emails, func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error {
+		client.Enable = enable
+		return s.saveClient(tx, inbound, client)
+	})
+}
+
+func (s *ClientService) DelClient(user *model.User, email string) (bool, error) {
+	return s.DelClients(user, []string{email})
+}
+
+func (s *ClientService) DelClients(user *model.User, emails []string) (bool, error) {
+	return s.eachClient(user, emails, func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error {
+		err := s.inboundService.delClient(tx, client)
+		if err != nil {
+			return err
+		}
+		return tx.Where("email = ?", client.Email).Delete(xray.ClientTraffic{}).Error
+	})
+}
+
+// ResetClientTraffic clears the usage of a client and enables it again when
+// it was only disabled for running out of traffic.
+func (s *ClientService) ResetClientTraffic(user *model.User, email string) (bool, error) {
+	return s.ResetClientsTraffic(user, []string{email})
+}
+
+func (s *ClientService) ResetClientsTraffic(user *model.User, emails []string) (bool, error) {
+	return s.eachClient(user, emails, func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error {
+		err := tx.Model(xray.ClientTraffic{}).Where("email = ?", client.Email).
+			Updates(map[string]interface{}{"up": 0, "down": 0}).Error
+		if err != nil {
+			return err
+		}
+		return s.saveClient(tx, inbound, client)
+	})
+}
+
+// renewClient extends the expiry of a client by duration milliseconds,
+// counting from now when it has already expired. For clients whose expiry
+// starts on first use the duration is extended instead.
+func (s *ClientService) renewClient(tx *gorm.DB, client *model.Client, inbound *model.Inbound, duration int64) error {
+	if client.ExpiryTime < 0 {
+		client.ExpiryTime -= duration
+	} else {
+		client.ExpiryTime = max(client.ExpiryTime, time.Now().Unix()*1000) + duration
+	}
+	return s.saveClient(tx, inbound, client)
+}
+
+// RenewClient extends the expiry of a client by the given number of days.
+func (s *ClientService) RenewClient(user *model.User, email string, days int) (bool, error) {
+	if days <= 0 {
+		return false, common.NewErrorf("invalid number of days: %v", days)
+	}
+	return s.eachClient(user, []string{email}, func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error {
+		if client.ExpiryTime == 0 {
+			return common.NewError("client never expires")
+		}
+		return s.renewClient(tx, client, inbound, int64(days)*86400000)
+	})
+}
+
+// RenewClients extends the expiry of the given clients by the given number of
+// days. Clients that never expire are left unchanged.
+func (s *ClientService) RenewClients(user *model.User, emails []string, days int) (bool, error) {
+	if days <= 0 {
+		return false, common.NewErrorf("invalid number of days: %v", days)
+	}
+	return s.eachClient(user, emails, func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error {
+		if client.ExpiryTime == 0 {
+			return nil
+		}
+		return s.renewClient(tx, client, inbound, int64(days)*86400000)
+	})
+}
+
+// RegenerateSubId gives the subscription of a client a new id, for every
+// client sharing it, and returns the new id. The old id keeps working for
+// grace hours, 0 revoking it at once.
+func (s *ClientService) RegenerateSubId(user *model.User, email string, grace int) (string, error) {
+	if grace < 0 {
+		return "", common.NewErrorf("invalid grace period: %v", grace)
+	}
+	subId := random.Seq(16)
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		client, _, err := s.findClient(tx, user, email)
+		if err != nil {
+			return err
+		}
+		oldSubId := client.SubID
+		err = tx.Model(model.Client{}).Where("sub_id = ?", oldSubId).Update("sub_id", subId).Error
+		if err != nil {
+			return err
+		}
+		// Ids replaced before keep following the subscription.
+		err = tx.Model(model.SubIdAlias{}).Where("target = ?", oldSubId).Update("target", subId).Error
+		if err != nil || grace == 0 {
+			return err
+		}
+		return tx.Save(&model.SubIdAlias{
+			SubId:      oldSubId,
+			Target:     subId,
+			ExpiryTime: time.Now().Add(time.Duration(grace) * time.Hour).UnixMilli(),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return subId, nil
+}
+
+// SetClientQuota changes the traffic limit of a client in bytes (0 = unlimited).
+func (s *ClientService) SetClientQuota(user *model.User, email string, total int64) (bool, error) {
+	if total < 0 {
+		return false, common.NewErrorf("invalid quota: %v", total)
+	}
+	return s.updateClients([]string{email}, func(tx *gorm.DB) error {
+		client, inbound, err := s.findClient(tx, user, email)
+		if err != nil {
+			return err
+		}
+		client.TotalGB = total
+		return s.saveClient(tx, inbound, client)
+	})
+}
+
+// MoveClient moves a client with its usage to another inbound. Credentials
+// required by the protocol of the target inbound are generated when missing.
+func (s *ClientService) MoveClient(user *model.User, email string, inboundId int) (bool, error) {
+	return s.updateClients([]string{email}, func(tx *gorm.DB) error {
+		client, inbound, err := s.findClient(tx, user, email)
+		if err != nil {
+			return err
+		}
+		if inbound.Id == inboundId {
+			return common.NewError("client is already in this inbound")
+		}
+		target, err := s.findInbound(tx, user, inboundId)
+		if err != nil {
+			return err
+		}
+		err = tx.Where("client_id = ? AND inbound_id = ?", client.Id, target.Id).Delete(model.ClientInbound{}).Error
+		if err != nil {
+			return err
+		}
+		return s.saveClient(tx, target, client)
+	})
+}
+
+// LinkInbound serves a client on another inbound as well. Its traffic there
+// counts against the same quota and expiry, and credentials required by the
+// protocol of the inbound are generated when missing.
+func (s *ClientService) LinkInbound(user *model.User, email string, inboundId int) (bool, error) {
+	return s.eachClient(user, []string{email}, func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error {
+		if inbound.Id == inboundId {
+			return common.NewError("client is already in this inbound")
+		}
+		target, err := s.findInbound(tx, user, inboundId)
+		if err != nil {
+			return err
+		}
+		var count int64
+		err = tx.Model(model.ClientInbound{}).Where("client_id = ? AND inbound_id = ?", client.Id, target.Id).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return common.NewError("client is already linked to this inbound")
+		}
+		err = tx.Create(&model.ClientInbound{ClientId: client.Id, InboundId: target.Id}).Error
+		if err != nil {
+			return err
+		}
+		return s.saveClient(tx, inbound, client)
+	})
+}
+
+// UnlinkInbound stops serving a client on an inbound it is linked to.
+func (s *ClientService) UnlinkInbound(user *model.User, email string, inboundId int) (bool, error) {
+	return s.eachClient(user, []string{email}, func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error {
+		result := tx.Where("client_id = ? AND inbound_id = ?", client.Id, inboundId).Delete(model.ClientInbound{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return common.NewError("client is not linked to this inbound")
+		}
+		return s.saveClient(tx, inbound, client)
+	})
+}
+
+// GetClient returns the client with the given email, if the user can access
+// its inbound.
+func (s *ClientService) GetClient(user *model.User, email string) (*model.Client, error) {
+	client, _, err := s.findClient(database.GetDB(), user, email)
+	return client, err
+}
+
+// ClientQuery selects a page of clients. Filter is one of depleted, expiring,
+// disabled and online; Sort is usage, expiry or empty for creation order.
+// Cursor is the NextCursor of the previous page.
+type ClientQuery struct {
+	InboundId  int    `json:"inboundId" form:"inboundId"`
+	Search     string `json:"search" form:"search"`
+	Filter     string `json:"filter" form:"filter"`
+	ExpireDays int    `json:"expireDays" form:"expireDays"`
+	Sort       string `json:"sort" form:"sort"`
+	Desc       bool   `json:"desc" form:"desc"`
+	Cursor     string `json:"cursor" form:"cursor"`
+	Limit      int    `json:"limit" form:"limit"`
+}
+
+// ClientInfo is a client with its usage as returned by SearchClients.
+// Inbounds are the ids of the inbounds it is linked to besides its own.
+type ClientInfo struct {
+	model.Client
+	Inbounds  []int  `json:"inbounds" gorm:"-"`
+	Remark    string `json:"remark"`
+	Up        int64  `json:"up"`
+	Down      int64  `json:"down"`
+	Online    bool   `json:"online" gorm:"-"`
+	SortValue int64  `json:"-"`
+}
+
+type ClientPage struct {
+	Clients    []*ClientInfo `json:"clients"`
+	Total      int64         `json:"total"`
+	NextCursor string        `json:"nextCursor"`
+}
+
+type clientCursor struct {
+	Value int64 `json:"v"`
+	Id    int   `json:"id"`
+}
+
+const (
+	defaultClientPageSize = 50
+	maxClientPageSize     = 500
+	defaultExpireDays     = 7
+)
+
+var clientSortColumns = map[string]string{
+	"":       "clients.id",
+	"usage":  "client_traffics.up + client_traffics.down",
+	"expiry": "client_traffics.expiry_time",
+}
+
+// SearchClients returns a page of the clients visible to the user.
+func (s *ClientService) SearchClients(user *model.User, query *ClientQuery) (*ClientPage, error) {
+	sortColumn, ok := clientSortColumns[query.Sort]
+	if !ok {
+		return nil, common.NewErrorf("invalid sort: %v", query.Sort)
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultClientPageSize
+	}
+	limit = min(limit, maxClientPageSize)
+
+	db := database.GetDB()
+	tx := scopeInbounds(db.Model(model.Client{}), user).
+		Joins("JOIN inbounds ON inbounds.id = clients.inbound_id").
+		Joins("JOIN client_traffics ON client_traffics.email = clients.email")
+	if query.InboundId > 0 {
+		tx = tx.Where("clients.inbound_id = ? OR clients.id IN (?)", query.InboundId,
+			db.Model(model.ClientInbound{}).Select("client_id").Where("inbound_id = ?", query.InboundId))
+	}
+	if query.Search != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query.Search) + "%"
+		tx = tx.Where(`clients.email LIKE ? ESCAPE '\' OR inbounds.remark LIKE ? ESCAPE '\'`, pattern, pattern)
+	}
+
+	now := time.Now().Unix() * 1000
+	online := s.inboundService.GetOnlineClients()
+	switch query.Filter {
+	case "":
+	case "depleted":
+		// The same clients as isDepleted, so quota grace, the redirect
+		// quota action and the throttle one while it can be enforced count
+		// as still served.
+		cutActions, err := s.speedService.getCutActions()
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where("(clients.quota_action IN ? AND "+quotaExceededSQL+") OR (client_traffics.expiry_time > 0 AND client_traffics.expiry_time <= ?)",
+			cutActions, now)
+	case "expiring":
+		days := query.ExpireDays
+		if days <= 0 {
+			days = defaultExpireDays
+		}
+		tx = tx.Where("client_traffics.expiry_time > ? AND client_traffics.expiry_time <= ?", now, now+int64(days)*86400000)
+	case "disabled":
+		tx = tx.Where("clients.enable = ?", false)
+	case "online":
+		tx = tx.Where("clients.email IN ?", online)
+	default:
+		return nil, common.NewErrorf("invalid filter: %v", query.Filter)
+	}
+
+	page := &ClientPage{}
+	err := tx.Count(&page.Total).Error
+	if err != nil {
+		return nil, err
+	}
+
+	order := "ASC"
+	compare := ">"
+	if query.Desc {
+		order = "DESC"
+		compare = "<"
+	}
+	if query.Cursor != "" {
+		cursor := &clientCursor{}
+		data, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+		if err == nil {
+			err = json.Unmarshal(data, cursor)
+		}
+		if err != nil {
+			return nil, common.NewError("invalid cursor")
+		}
+		tx = tx.Where("("+sortColumn+" "+compare+" ?) OR ("+sortColumn+" = ? AND clients.id "+compare+" ?)",
+			cursor.Value, cursor.Value, cursor.Id)
+	}
+
+	err = tx.Select("clients.*, inbounds.remark, client_traffics.up, client_traffics.down, " + sortColumn + " AS sort_value").
+		Order(sortColumn + " " + order).
+		Order("clients.id " + order).
+		Limit(limit + 1).
+		Scan(&page.Clients).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.Clients) > limit {
+		page.Clients = page.Clients[:limit]
+		last := page.Clients[limit-1]
+		data, _ := json.Marshal(clientCursor{Value: last.SortValue, Id: last.Id})
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	onlineMap := make(map[string]bool, len(online))
+	for _, email := range online {
+		onlineMap[email] = true
+	}
+	clientIds := make([]int, 0, len(page.Clients))
+	for _, client := range page.Clients {
+		clientIds = append(clientIds, client.Id)
+	}
+	var links []model.ClientInbound
+	err = db.Model(model.ClientInbound{}).Where("client_id IN ?", clientIds).Order("inbound_id").Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	linkMap := make(map[int][]int, len(links))
+	for _, link := range links {
+		linkMap[link.ClientId] = append(linkMap[link.ClientId], link.InboundId)
+	}
+	for _, client := range page.Clients {
+		client.Online = onlineMap[client.Email]
+		client.Inbounds = linkMap[client.Id]
+		if client.Inbounds == nil {
+			client.Inbounds = []int{}
+		}
+	}
+	return page, nil
+}
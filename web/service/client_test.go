@@ -0,0 +1,66 @@
+package service
+
+import (
+	"testing"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/xray"
+)
+
+func TestUpdateClientRename(t *testing.T) {
+	db := database.GetDB()
+	inbound := addTestInbound(t, "rename", 43001, model.VLESS)
+	s := &ClientService{}
+	if _, err := s.AddClients(nil, inbound.Id, []model.Client{{Email: "rename-old", Enable: true}}); err != nil {
+		t.Fatal(err)
+	}
+	rows := []interface{}{
+		&model.TrafficHistory{Email: "rename-old", Period: model.PeriodHour, Time: 1000, Up: 1},
+		&model.TrafficHistory{Email: "rename-old", Period: model.PeriodDay, Time: 1000, Up: 2},
+		&model.ClientAlert{Email: "rename-old", Event: model.NotifyDepleted, Time: 1000},
+		&model.TrafficResetLog{InboundId: inbound.Id, Email: "rename-old", Up: 3, Time: 1000},
+		// Left behind by a deleted client of the new email.
+		&model.TrafficHistory{Email: "rename-new", Period: model.PeriodHour, Time: 1000, Up: 9},
+		&model.ClientAlert{Email: "rename-new", Event: model.NotifyDepleted, Time: 1},
+	}
+	for _, row := range rows {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := s.GetClient(nil, "rename-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Email = "rename-new"
+	if _, err := s.UpdateClient(nil, "rename-old", *client); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []interface{}{xray.ClientTraffic{}, model.TrafficHistory{}, model.ClientAlert{}, model.TrafficResetLog{}} {
+		var count int64
+		db.Model(table).Where("email = ?", "rename-old").Count(&count)
+		if count != 0 {
+			t.Errorf("%T: %v rows left under the old email", table, count)
+		}
+	}
+	var history []model.TrafficHistory
+	db.Where("email = ?", "rename-new").Order("up").Find(&history)
+	if len(history) != 2 || history[0].Up != 1 || history[1].Up != 2 {
+		t.Errorf("history of the new email = %+v", history)
+	}
+	var alert model.ClientAlert
+	if err := db.Where("email = ?", "rename-new").First(&alert).Error; err != nil || alert.Time != 1000 {
+		t.Errorf("alert of the new email = %+v, %v", alert, err)
+	}
+	var count int64
+	db.Model(model.TrafficResetLog{}).Where("email = ?", "rename-new").Count(&count)
+	if count != 1 {
+		t.Errorf("%v reset logs under the new email, want 1", count)
+	}
+	db.Model(xray.ClientTraffic{}).Where("email = ?", "rename-new").Count(&count)
+	if count != 1 {
+		t.Errorf("%v client traffics under the new email, want 1", count)
+	}
+}
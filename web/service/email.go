@@ -0,0 +1,438 @@
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"math"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/util/random"
+	"x-ui-scratch/web/locale"
+)
+
+// EmailService sends notifications by email over SMTP. Clients whose email
+// is an email address are told about expiry and traffic warnings, depletion
+// and renewals; the admins about depleted and disabled clients and Xray
+// crashes. The emails are localized in the email language.
+//
+// Emails are put in a queue before they are sent, so failed ones are retried
+// with exponential backoff.
+type EmailService struct {
+	settingService SettingService
+}
+
+const (
+	smtpStartTLS = "starttls"
+	smtpTLS      = "tls"
+	smtpNone     = "none"
+)
+
+const (
+	emailMaxAttempts = 6
+	emailBaseDelay   = time.Minute
+	emailTimeout     = 30 * time.Second
+	emailBatchSize   = 100
+	// emailRetention is for how many days emails that ran out of attempts
+	// are kept in the queue.
+	emailRetention = 30
+)
+
+// emailSend keeps an email from being sent by two passes at once.
+var emailSend sync.Mutex
+
+type smtpConfig struct {
+	enable   bool
+	host     string
+	port     int
+	security string
+	username string
+	password string
+	from     *mail.Address
+	admins   []string
+}
+
+func init() {
+	RegisterNotifyChannel(&EmailService{})
+}
+
+func (s *EmailService) getConfig() (*smtpConfig, error) {
+	cfg := &smtpConfig{}
+	var err error
+	if cfg.enable, err = s.settingService.GetSmtpEnable(); err != nil {
+		return nil, err
+	}
+	if cfg.host, err = s.settingService.GetSmtpHost(); err != nil {
+		return nil, err
+	}
+	if cfg.port, err = s.settingService.GetSmtpPort(); err != nil {
+		return nil, err
+	}
+	if cfg.security, err = s.settingService.GetSmtpSecurity(); err != nil {
+		return nil, err
+	}
+	if cfg.username, err = s.settingService.GetSmtpUsername(); err != nil {
+		return nil, err
+	}
+	if cfg.password, err = s.settingService.GetSmtpPassword(); err != nil {
+		return nil, err
+	}
+	from, err := s.settingService.GetSmtpFrom()
+	if err != nil {
+		return nil, err
+	}
+	admins, err := s.settingService.GetSmtpAdmins()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.host == "" {
+		return nil, common.NewError("smtp host is not set")
+	}
+	switch cfg.security {
+	case smtpStartTLS, smtpTLS, smtpNone:
+	default:
+		return nil, common.NewErrorf("invalid smtp security: %v", cfg.security)
+	}
+	if from == "" {
+		from = cfg.username
+	}
+	cfg.from, err = mail.ParseAddress(from)
+	if err != nil {
+		return nil, common.NewErrorf("invalid smtp from address %q: %v", from, err)
+	}
+	for _, admin := range strings.Split(admins, ",") {
+		admin = strings.TrimSpace(admin)
+		if admin == "" {
+			continue
+		}
+		address, err := mail.ParseAddress(admin)
+		if err != nil {
+			return nil, common.NewErrorf("invalid smtp admin address %q: %v", admin, err)
+		}
+		cfg.admins = append(cfg.admins, address.Address)
+	}
+	return cfg, nil
+}
+
+func (s *EmailService) Name() string {
+	return "email"
+}
+
+func (s *EmailService) Enabled() bool {
+	cfg, err := s.getConfig()
+	return err == nil && cfg.enable
+}
+
+var emailNotifyMessages = map[model.NotifyEvent]string{
+	model.NotifyExpiring: "expiring",
+	model.NotifyTraffic:  "traffic",
+	model.NotifyDepleted: "depleted",
+	model.NotifyRenewed:  "renewed",
+}
+
+// Send queues an email to the client when its email is an address, and to
+// the admins when the client was depleted or disabled.
+func (s *EmailService) Send(notification *Notification) error {
+	cfg, err := s.getConfig()
+	if err != nil {
+		return err
+	}
+	email := "Email==" + notification.Email
+	details := "\r\n\r\n" + s.i18nEmail("email.inbound", "Remark=="+notification.Remark) +
+		"\r\n" + s.expiry(notification.ExpiryTime) +
+		"\r\n" + s.total(notification.Up+notification.Down, notification.Total)
+
+	var messages []*model.EmailMessage
+	if name, ok := emailNotifyMessages[notification.Event]; ok {
+		if address, err := mail.ParseAddress(notification.Email); err == nil {
+			body := s.i18nEmail("email.greeting", email) + "\r\n\r\n" + s.i18nEmail("email.bodies."+name, email) + details
+			messages = append(messages, s.newMessage(address.Address, s.i18nEmail("email.subjects."+name), body))
+		}
+	}
+	var name string
+	switch notification.Event {
+	case model.NotifyDepleted:
+		name = "clientDepleted"
+	case model.NotifyDisabled:
+		name = "clientDisabled"
+	}
+	if name != "" {
+		subject := s.i18nEmail("email.subjects."+name, email)
+		body := s.i18nEmail("email.bodies."+name, email) + details
+		for _, admin := range cfg.admins {
+			messages = append(messages, s.newMessage(admin, subject, body))
+		}
+	}
+	return s.queue(messages)
+}
+
+// SendXrayCrash queues an email to the admins that Xray exited with the
+// given output.
+func (s *EmailService) SendXrayCrash(result string) {
+	cfg, err := s.getConfig()
+	if err != nil || !cfg.enable {
+		return
+	}
+	hostname := "Hostname==" + s.hostname()
+	subject := s.i18nEmail("email.subjects.xrayCrashed", hostname)
+	body := s.i18nEmail("email.bodies.xrayCrashed", "Error=="+result) +
+		"\r\n\r\n" + s.i18nEmail("email.hostname", hostname) +
+		"\r\n" + s.i18nEmail("email.time", "Time=="+s.formatTime(time.Now().UnixMilli()))
+	var messages []*model.EmailMessage
+	for _, admin := range cfg.admins {
+		messages = append(messages, s.newMessage(admin, subject, body))
+	}
+	err = s.queue(messages)
+	if err != nil {
+		logger.Warning("queue xray crash email failed:", err)
+	}
+}
+
+// SendTestEmail sends a test email right away, bypassing the queue, so the
+// SMTP settings can be checked. It is sent to the admins when to is empty.
+func (s *EmailService) SendTestEmail(to string) error {
+	cfg, err := s.getConfig()
+	if err != nil {
+		return err
+	}
+	recipients := cfg.admins
+	if to != "" {
+		address, err := mail.ParseAddress(to)
+		if err != nil {
+			return common.NewErrorf("invalid email address %q: %v", to, err)
+		}
+		recipients = []string{address.Address}
+	}
+	if len(recipients) == 0 {
+		return common.NewError("no email address to send the test email to")
+	}
+	hostname := "Hostname==" + s.hostname()
+	subject := s.i18nEmail("email.subjects.test", hostname)
+	body := s.i18nEmail("email.bodies.test") +
+		"\r\n\r\n" + s.i18nEmail("email.hostname", hostname) +
+		"\r\n" + s.i18nEmail("email.time", "Time=="+s.formatTime(time.Now().UnixMilli()))
+	emailSend.Lock()
+	defer emailSend.Unlock()
+	var errs []error
+	for _, recipient := range recipients {
+		errs = append(errs, s.send(cfg, s.newMessage(recipient, subject, body)))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *EmailService) newMessage(to string, subject string, body string) *model.EmailMessage {
+	now := time.Now().UnixMilli()
+	return &model.EmailMessage{
+		To:          to,
+		Subject:     subject,
+		Body:        body,
+		NextAttempt: now,
+		Time:        now,
+	}
+}
+
+// queue stores the messages and starts sending them.
+func (s *EmailService) queue(messages []*model.EmailMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	db := database.GetDB()
+	err := db.CreateInBatches(messages, emailBatchSize).Error
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.SendPending(); err != nil {
+			logger.Warning("send emails failed:", err)
+		}
+	}()
+	return nil
+}
+
+// SendPending sends the queued emails that are due. Sent emails leave the
+// queue. The pass stops when the SMTP server can not be reached, as the
+// other emails would fail the same way.
+func (s *EmailService) SendPending() error {
+	emailSend.Lock()
+	defer emailSend.Unlock()
+	cfg, err := s.getConfig()
+	if err != nil || !cfg.enable {
+		return err
+	}
+	db := database.GetDB()
+	lastId := 0
+	for {
+		var messages []*model.EmailMessage
+		err = db.Model(model.EmailMessage{}).
+			Where("id > ? AND attempts < ? AND next_attempt <= ?", lastId, emailMaxAttempts, time.Now().UnixMilli()).
+			Order("id").
+			Limit(emailBatchSize).
+			Find(&messages).Error
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		for _, message := range messages {
+			lastId = message.Id
+			sendErr := s.send(cfg, message)
+			if sendErr == nil {
+				err = db.Delete(message).Error
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			logger.Warningf("send email to %v failed: %v", message.To, sendErr)
+			now := time.Now()
+			message.Attempts++
+			message.Error = sendErr.Error()
+			backoff := emailBaseDelay * time.Duration(math.Pow(2, float64(message.Attempts-1)))
+			message.NextAttempt = now.Add(backoff).UnixMilli()
+			err = db.Save(message).Error
+			if err != nil {
+				return err
+			}
+			var protoErr *textproto.Error
+			if !errors.As(sendErr, &protoErr) {
+				return nil
+			}
+		}
+	}
+}
+
+// PruneMessages deletes the emails that ran out of attempts long ago.
+func (s *EmailService) PruneMessages() error {
+	before := time.Now().AddDate(0, 0, -emailRetention).UnixMilli()
+	db := database.GetDB()
+	return db.Where("time < ? AND attempts >= ?", before, emailMaxAttempts).
+		Delete(model.EmailMessage{}).Error
+}
+
+// send delivers one email. Authentication is refused by net/smtp over an
+// unencrypted connection, unless the server is on localhost.
+func (s *EmailService) send(cfg *smtpConfig, message *model.EmailMessage) error {
+	addr := net.JoinHostPort(cfg.host, strconv.Itoa(cfg.port))
+	dialer := &net.Dialer{Timeout: emailTimeout}
+	tlsConfig := &tls.Config{ServerName: cfg.host}
+	var conn net.Conn
+	var err error
+	if cfg.security == smtpTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+	client, err := smtp.NewClient(conn, cfg.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if cfg.security == smtpStartTLS {
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if cfg.username != "" {
+		if err = client.Auth(smtp.PlainAuth("", cfg.username, cfg.password, cfg.host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(cfg.from.Address); err != nil {
+		return err
+	}
+	if err = client.Rcpt(message.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(s.compose(cfg, message)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// compose renders a message as a plain text, quoted-printable email.
+func (s *EmailService) compose(cfg *smtpConfig, message *model.EmailMessage) []byte {
+	domain := cfg.from.Address[strings.LastIndex(cfg.from.Address, "@")+1:]
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(message.Subject)
+
+	var buf bytes.Buffer
+	buf.WriteString("From: " + cfg.from.String() + "\r\n")
+	buf.WriteString("To: " + message.To + "\r\n")
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("Message-ID: <" + strconv.Itoa(message.Id) + "." + random.Seq(16) + "@" + domain + ">\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	buf.WriteString("\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(message.Body))
+	w.Close()
+	return buf.Bytes()
+}
+
+func (s *EmailService) expiry(expiryTime int64) string {
+	switch {
+	case expiryTime == 0:
+		return s.i18nEmail("email.expire", "Time=="+s.i18nEmail("email.unlimited"))
+	case expiryTime < 0:
+		return s.i18nEmail("email.expireIn", "Days=="+strconv.FormatInt(-expiryTime/86400000, 10))
+	default:
+		return s.i18nEmail("email.expire", "Time=="+s.formatTime(expiryTime))
+	}
+}
+
+func (s *EmailService) total(used int64, total int64) string {
+	totalStr := s.i18nEmail("email.unlimited")
+	if total > 0 {
+		totalStr = common.FormatTraffic(total)
+	}
+	return s.i18nEmail("email.total", "UpDown=="+common.FormatTraffic(used), "Total=="+totalStr)
+}
+
+func (s *EmailService) formatTime(millis int64) string {
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		loc = time.Local
+	}
+	return time.UnixMilli(millis).In(loc).Format("2006-01-02 15:04:05")
+}
+
+func (s *EmailService) hostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+func (s *EmailService) i18nEmail(name string, params ...string) string {
+	return locale.I18n(locale.Email, name, params...)
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"x-ui-scratch/database/model"
+)
+
+// smtpSession is what the test SMTP server received in a session.
+type smtpSession struct {
+	auth string
+	from string
+	to   string
+	data string
+}
+
+// startSMTPServer serves one SMTP session on localhost and sends what it
+// received to the returned channel. Recipients other than accept are refused.
+func startSMTPServer(t *testing.T, accept string) (int, <-chan *smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sessions := make(chan *smtpSession, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		session := &smtpSession{}
+		defer func() { sessions <- session }()
+
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				tp.PrintfLine("250-localhost")
+				tp.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				_, encoded, _ := strings.Cut(arg, " ")
+				decoded, _ := base64.StdEncoding.DecodeString(encoded)
+				session.auth = string(decoded)
+				tp.PrintfLine("235 2.7.0 Authentication successful")
+			case "MAIL":
+				session.from = arg
+				tp.PrintfLine("250 2.1.0 OK")
+			case "RCPT":
+				if arg != "TO:<"+accept+">" {
+					tp.PrintfLine("550 5.1.1 No such user")
+					continue
+				}
+				session.to = arg
+				tp.PrintfLine("250 2.1.5 OK")
+			case "DATA":
+				tp.PrintfLine("354 Go ahead")
+				data, err := io.ReadAll(tp.DotReader())
+				if err != nil {
+					return
+				}
+				session.data = string(data)
+				tp.PrintfLine("250 2.0.0 Queued")
+			case "QUIT":
+				tp.PrintfLine("221 2.0.0 Bye")
+				return
+			default:
+				tp.PrintfLine("502 5.5.2 Command not implemented")
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, sessions
+}
+
+func testSmtpConfig(port int) *smtpConfig {
+	return &smtpConfig{
+		enable:   true,
+		host:     "127.0.0.1",
+		port:     port,
+		security: smtpNone,
+		username: "panel",
+		password: "secret",
+		from:     &mail.Address{Name: "Panel", Address: "panel@example.com"},
+	}
+}
+
+func TestEmailSend(t *testing.T) {
+	port, sessions := startSMTPServer(t, "alice@example.com")
+	message := &model.EmailMessage{
+		Id:      7,
+		To:      "alice@example.com",
+		Subject: "Ваша подписка\r\nскоро истекает",
+		Body:    "Hello alice@example.com,\r\n\r\nTraffic: 1.00GB of 10.00GB = 10%",
+	}
+
+	s := &EmailService{}
+	if err := s.send(testSmtpConfig(port), message); err != nil {
+		t.Fatal(err)
+	}
+	session := <-sessions
+
+	if session.auth != "\x00panel\x00secret" {
+		t.Errorf("auth = %q", session.auth)
+	}
+	if session.from != "FROM:<panel@example.com>" {
+		t.Errorf("from = %q", session.from)
+	}
+	if session.to != "TO:<alice@example.com>" {
+		t.Errorf("to = %q", session.to)
+	}
+
+	email, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(session.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := email.Header
+	if from := header.Get("From"); from != `"Panel" <panel@example.com>` {
+		t.Errorf("From = %q", from)
+	}
+	if to := header.Get("To"); to != message.To {
+		t.Errorf("To = %q", to)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Ваша подписка  скоро истекает" {
+		t.Errorf("Subject = %q", subject)
+	}
+	if id := header.Get("Message-ID"); !strings.HasPrefix(id, "<7.") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Message-ID = %q", id)
+	}
+	if _, err := header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+	if encoding := header.Get("Content-Transfer-Encoding"); encoding != "quoted-printable" {
+		t.Errorf("Content-Transfer-Encoding = %q", encoding)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(email.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dot reader turns line endings into \n, and DATA ends on a newline.
+	want := strings.ReplaceAll(message.Body, "\r\n", "\n") + "\n"
+	if string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestEmailSendRejected(t *testing.T) {
+	port, sessions := startSMTPServer(t, "alice@example.com")
+	message := &model.EmailMessage{Id: 1, To: "bob@example.com", Subject: "Test", Body: "Test"}
+
+	s := &EmailService{}
+	err := s.send(testSmtpConfig(port), message)
+	if err == nil || !strings.Contains(err.Error(), "No such user") {
+		t.Fatalf("err = %v, want the refused recipient", err)
+	}
+	if session := <-sessions; session.data != "" {
+		t.Errorf("data sent to a refused recipient: %q", session.data)
+	}
+}
@@ -0,0 +1,309 @@
+package service
+
+import (
+	"time"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/xray"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// HistoryService keeps the traffic history of inbounds and clients. Every
+// traffic collection adds its deltas to the current hour bucket; Rollup sums
+// hour buckets into day buckets and day buckets into month buckets. Bucket
+// boundaries follow the timeLocation setting.
+type HistoryService struct {
+	settingService SettingService
+}
+
+// TrafficPoint is the traffic of one bucket in a history query.
+type TrafficPoint struct {
+	Time int64 `json:"time"`
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// The shortest retention of hour and day buckets, so that Rollup always has
+// the buckets it sums.
+const (
+	minHourRetentionDays = 2
+	minDayRetentionDays  = 62
+)
+
+func bucketStart(t time.Time, period model.HistoryPeriod) time.Time {
+	switch period {
+	case model.PeriodHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case model.PeriodDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+func nextBucket(t time.Time, period model.HistoryPeriod) time.Time {
+	switch period {
+	case model.PeriodHour:
+		return t.Add(time.Hour)
+	case model.PeriodDay:
+		return t.AddDate(0, 0, 1)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+func (s *HistoryService) now() (time.Time, error) {
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().In(loc), nil
+}
+
+// addTraffic adds the traffic of one collection to the current hour bucket.
+func (s *HistoryService) addTraffic(tx *gorm.DB, traffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) error {
+	if len(traffics) == 0 && len(clientTraffics) == 0 {
+		return nil
+	}
+	now, err := s.now()
+	if err != nil {
+		return err
+	}
+	bucket := bucketStart(now, model.PeriodHour).UnixMilli()
+
+	var histories []*model.TrafficHistory
+	var tags []string
+	for _, traffic := range traffics {
+		if traffic.IsInbound && traffic.Up+traffic.Down > 0 {
+			tags = append(tags, traffic.Tag)
+		}
+	}
+	if len(tags) > 0 {
+		var inbounds []*model.Inbound
+		err = tx.Model(model.Inbound{}).Select("id", "tag").Where("tag in ?", tags).Find(&inbounds).Error
+		if err != nil {
+			return err
+		}
+		inboundIds := make(map[string]int, len(inbounds))
+		for _, inbound := range inbounds {
+			inboundIds[inbound.Tag] = inbound.Id
+		}
+		for _, traffic := range traffics {
+			id, ok := inboundIds[traffic.Tag]
+			if !ok || !traffic.IsInbound || traffic.Up+traffic.Down == 0 {
+				continue
+			}
+			histories = append(histories, &model.TrafficHistory{
+				InboundId: id,
+				Period:    model.PeriodHour,
+				Time:      bucket,
+				Up:        traffic.Up,
+				Down:      traffic.Down,
+			})
+		}
+	}
+	for _, traffic := range clientTraffics {
+		if traffic.Up+traffic.Down == 0 {
+			continue
+		}
+		histories = append(histories, &model.TrafficHistory{
+			Email:  traffic.Email,
+			Period: model.PeriodHour,
+			Time:   bucket,
+			Up:     traffic.Up,
+			Down:   traffic.Down,
+		})
+	}
+	if len(histories) == 0 {
+		return nil
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "email"}, {Name: "inbound_id"}, {Name: "period"}, {Name: "time"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"up":   gorm.Expr("traffic_histories.up + excluded.up"),
+			"down": gorm.Expr("traffic_histories.down + excluded.down"),
+		}),
+	}).CreateInBatches(histories, 100).Error
+}
+
+// rollup replaces the to bucket starting at start with the sum of the from
+// buckets it covers.
+func (s *HistoryService) rollup(tx *gorm.DB, from model.HistoryPeriod, to model.HistoryPeriod, start time.Time) error {
+	end := nextBucket(start, to)
+	return tx.Exec(`INSERT INTO traffic_histories (inbound_id, email, period, time, up, down)
+		SELECT inbound_id, email, ?, ?, SUM(up), SUM(down) FROM traffic_histories
+		WHERE period = ? AND time >= ? AND time < ?
+		GROUP BY inbound_id, email
+		ON CONFLICT (email, inbound_id, period, time) DO UPDATE SET up = excluded.up, down = excluded.down`,
+		to, start.UnixMilli(), from, start.UnixMilli(), end.UnixMilli()).Error
+}
+
+// Rollup recomputes the day buckets still covered by hour buckets and the
+// month buckets containing them.
+func (s *HistoryService) Rollup() error {
+	now, err := s.now()
+	if err != nil {
+		return err
+	}
+	hourDays, _, _, err := s.getRetention()
+	if err != nil {
+		return err
+	}
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		first := bucketStart(now, model.PeriodDay).AddDate(0, 0, -hourDays)
+		for day := first; !day.After(now); day = nextBucket(day, model.PeriodDay) {
+			err := s.rollup(tx, model.PeriodHour, model.PeriodDay, day)
+			if err != nil {
+				return err
+			}
+		}
+		for month := bucketStart(first, model.PeriodMonth); !month.After(now); month = nextBucket(month, model.PeriodMonth) {
+			err := s.rollup(tx, model.PeriodDay, model.PeriodMonth, month)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *HistoryService) getRetention() (hourDays int, dayDays int, monthDays int, err error) {
+	hourDays, err = s.settingService.GetHistoryHourRetention()
+	if err != nil {
+		return
+	}
+	dayDays, err = s.settingService.GetHistoryDayRetention()
+	if err != nil {
+		return
+	}
+	monthDays, err = s.settingService.GetHistoryMonthRetention()
+	return max(hourDays, minHourRetentionDays), max(dayDays, minDayRetentionDays), monthDays, err
+}
+
+// Prune deletes the buckets older than their retention. Month buckets are
+// kept forever when their retention is 0.
+func (s *HistoryService) Prune() error {
+	now, err := s.now()
+	if err != nil {
+		return err
+	}
+	hourDays, dayDays, monthDays, err := s.getRetention()
+	if err != nil {
+		return err
+	}
+	today := bucketStart(now, model.PeriodDay)
+	retention := map[model.HistoryPeriod]time.Time{
+		model.PeriodHour: today.AddDate(0, 0, -hourDays),
+		model.PeriodDay:  today.AddDate(0, 0, -dayDays),
+	}
+	if monthDays > 0 {
+		retention[model.PeriodMonth] = bucketStart(today.AddDate(0, 0, -monthDays), model.PeriodMonth)
+	}
+
+	db := database.GetDB()
+	for period, before := range retention {
+		err := db.Where("period = ? AND time < ?", period, before.UnixMilli()).Delete(model.TrafficHistory{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyQuery checks the period and fills in the default range, which is the
+// last day of hours, the last month of days or the last year of months.
+func (s *HistoryService) historyQuery(tx *gorm.DB, period model.HistoryPeriod, from int64, to int64) (*gorm.DB, error) {
+	if !period.IsValid() {
+		return nil, common.NewErrorf("invalid period: %v", period)
+	}
+	if to <= 0 {
+		to = time.Now().UnixMilli()
+	}
+	if from <= 0 {
+		switch period {
+		case model.PeriodHour:
+			from = to - 24*3600000
+		case model.PeriodDay:
+			from = to - 30*86400000
+		default:
+			from = to - 365*86400000
+		}
+	}
+	if from > to {
+		return nil, common.NewError("invalid time range")
+	}
+	return tx.Where("traffic_histories.period = ? AND traffic_histories.time >= ? AND traffic_histories.time <= ?", period, from, to).
+		Order("traffic_histories.time"), nil
+}
+
+// GetClientHistory returns the traffic of a client in the buckets between from
+// and to, in milliseconds.
+func (s *HistoryService) GetClientHistory(user *model.User, email string, period model.HistoryPeriod, from int64, to int64) ([]*TrafficPoint, error) {
+	db := database.GetDB()
+	if user.IsScoped() {
+		var count int64
+		err := scopeInbounds(db.Model(model.Client{}), user).
+			Joins("JOIN inbounds ON inbounds.id = clients.inbound_id").
+			Where("clients.email = ?", email).
+			Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, common.NewErrorf("client %v not found", email)
+		}
+	}
+	tx, err := s.historyQuery(db.Model(model.TrafficHistory{}), period, from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*TrafficPoint, 0)
+	err = tx.Select("time", "up", "down").Where("email = ? AND inbound_id = 0", email).Scan(&points).Error
+	return points, err
+}
+
+// GetInboundHistory returns the traffic of an inbound in the buckets between
+// from and to, in milliseconds.
+func (s *HistoryService) GetInboundHistory(user *model.User, inboundId int, period model.HistoryPeriod, from int64, to int64) ([]*TrafficPoint, error) {
+	db := database.GetDB()
+	var count int64
+	err := scopeInbounds(db.Model(model.Inbound{}), user).Where("id = ?", inboundId).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, common.NewErrorf("inbound %v not found", inboundId)
+	}
+	tx, err := s.historyQuery(db.Model(model.TrafficHistory{}), period, from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*TrafficPoint, 0)
+	err = tx.Select("time", "up", "down").Where("inbound_id = ? AND email = ''", inboundId).Scan(&points).Error
+	return points, err
+}
+
+// GetServerHistory returns the traffic of all inbounds visible to the user in
+// the buckets between from and to, in milliseconds.
+func (s *HistoryService) GetServerHistory(user *model.User, period model.HistoryPeriod, from int64, to int64) ([]*TrafficPoint, error) {
+	db := database.GetDB()
+	tx := db.Model(model.TrafficHistory{})
+	if user.IsScoped() {
+		tx = scopeInbounds(tx.Joins("JOIN inbounds ON inbounds.id = traffic_histories.inbound_id"), user)
+	}
+	tx, err := s.historyQuery(tx, period, from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*TrafficPoint, 0)
+	err = tx.Select("traffic_histories.time, SUM(traffic_histories.up) AS up, SUM(traffic_histories.down) AS down").
+		Where("traffic_histories.email = ''").
+		Group("traffic_histories.time").
+		Scan(&points).Error
+	return points, err
+}
@@ -2,17 +2,32 @@ package service
 
 import (
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
 	"time"
 	"x-ui-scratch/database"
 	"x-ui-scratch/database/model"
 	"x-ui-scratch/logger"
+	"x-ui-scratch/util/common"
 	"x-ui-scratch/xray"
 
 	"gorm.io/gorm"
 )
 
 type InboundService struct {
-	xrayApi xray.XrayAPI
+	xrayApi        xray.XrayAPI
+	historyService HistoryService
+	speedService   SpeedService
+	webhookService WebhookService
+}
+
+// InboundEvent is the data of an inbound.changed webhook event. Action is
+// added, updated, deleted, enabled or disabled.
+type InboundEvent struct {
+	Action  string         `json:"action"`
+	Inbound *model.Inbound `json:"inbound"`
 }
 
 func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) (error, bool) {
@@ -35,6 +50,9 @@ func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraff
 	if err != nil {
 		return err, false
 	}
+	if err1 := s.historyService.addTraffic(tx, inboundTraffics, clientTraffics); err1 != nil {
+		logger.Warning("Error in adding traffic history:", err1)
+	}
 
 	needRestart0, count, err := s.autoRenewClients(tx)
 	if err != nil {
@@ -93,8 +111,10 @@ func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTr
 
 	var onlineClients []string
 
+	trafficMap := make(map[string]*xray.ClientTraffic, len(traffics))
 	emails := make([]string, 0, len(traffics))
 	for _, traffic := range traffics {
+		trafficMap[traffic.Email] = traffic
 		emails = append(emails, traffic.Email)
 	}
 	dbClientTraffics := make([]*xray.ClientTraffic, 0, len(traffics))
@@ -113,23 +133,24 @@ func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTr
 		return err
 	}
 
-	for dbTraffic_index := range dbClientTraffics {
-		for traffic_index := range traffics {
-			if dbClientTraffics[dbTraffic_index].Email == traffics[traffic_index].Email {
-				dbClientTraffics[dbTraffic_index].Up += traffics[traffic_index].Up
-				dbClientTraffics[dbTraffic_index].Down += traffics[traffic_index].Down
+	for _, dbTraffic := range dbClientTraffics {
+		traffic, ok := trafficMap[dbTraffic.Email]
+		if !ok {
+			continue
+		}
+		dbTraffic.Up += traffic.Up
+		dbTraffic.Down += traffic.Down
 
-				// Add user in onlineUsers array on traffic
-				if traffics[traffic_index].Up+traffics[traffic_index].Down > 0 {
-					onlineClients = append(onlineClients, traffics[traffic_index].Email)
-				}
-				break
-			}
+		// Add user in onlineUsers array on traffic
+		if traffic.Up+traffic.Down > 0 {
+			onlineClients = append(onlineClients, traffic.Email)
 		}
 	}
 
 	// Set onlineUsers
-	p.SetOnlineClients(onlineClients)
+	if p != nil {
+		p.SetOnlineClients(onlineClients)
+	}
 
 	err = tx.Save(dbClientTraffics).Error
 	if err != nil {
@@ -139,55 +160,21 @@ func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTr
 	return nil
 }
 
+// adjustTraffics starts the expiry countdown of clients that expire relative
+// to their first use, which is stored as a negative duration.
 func (s *InboundService) adjustTraffics(tx *gorm.DB, dbClientTraffics []*xray.ClientTraffic) ([]*xray.ClientTraffic, error) {
-	inboundIds := make([]int, 0, len(dbClientTraffics))
+	now := time.Now().Unix() * 1000
 	for _, dbClientTraffic := range dbClientTraffics {
-		if dbClientTraffic.ExpiryTime < 0 {
-			inboundIds = append(inboundIds, dbClientTraffic.InboundId)
+		if dbClientTraffic.ExpiryTime >= 0 {
+			continue
 		}
-	}
-
-	if len(inboundIds) > 0 {
-		var inbounds []*model.Inbound
-		err := tx.Model(model.Inbound{}).Where("id IN (?)", inboundIds).Find(&inbounds).Error
+		newExpiryTime := now - dbClientTraffic.ExpiryTime
+		err := tx.Model(model.Client{}).Where("email = ?", dbClientTraffic.Email).Update("expiry_time", newExpiryTime).Error
 		if err != nil {
 			return nil, err
 		}
-		for inbound_index := range inbounds {
-			settings := map[string]interface{}{}
-			json.Unmarshal([]byte(inbounds[inbound_index].Settings), &settings)
-			clients, ok := settings["clients"].([]interface{})
-			if ok {
-				var newClients []interface{}
-				for client_index := range clients {
-					c := clients[client_index].(map[string]interface{})
-					for traffic_index := range dbClientTraffics {
-						if dbClientTraffics[traffic_index].ExpiryTime < 0 && c["email"] == dbClientTraffics[traffic_index].Email {
-							oldExpiryTime := c["expiryTime"].(float64)
-							newExpiryTime := (time.Now().Unix() * 1000) - int64(oldExpiryTime)
-							c["expiryTime"] = newExpiryTime
-							dbClientTraffics[traffic_index].ExpiryTime = newExpiryTime
-							break
-						}
-					}
-					newClients = append(newClients, interface{}(c))
-				}
-				settings["clients"] = newClients
-				modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-				if err != nil {
-					return nil, err
-				}
-
-				inbounds[inbound_index].Settings = string(modifiedSettings)
-			}
-		}
-		err = tx.Save(inbounds).Error
-		if err != nil {
-			logger.Warning("AddClientTraffic update inbounds ", err)
-			logger.Error(inbounds)
-		}
+		dbClientTraffic.ExpiryTime = newExpiryTime
 	}
-
 	return dbClientTraffics, nil
 }
 
@@ -195,9 +182,8 @@ func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
 	// check for time expired
 	var traffics []*xray.ClientTraffic
 	now := time.Now().Unix() * 1000
-	var err, err1 error
 
-	err = tx.Model(xray.ClientTraffic{}).Where("reset > 0 and expiry_time > 0 and expiry_time <= ?", now).Find(&traffics).Error
+	err := tx.Model(xray.ClientTraffic{}).Where("reset > 0 and expiry_time > 0 and expiry_time <= ?", now).Find(&traffics).Error
 	if err != nil {
 		return false, 0, err
 	}
@@ -206,127 +192,70 @@ func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
 		return false, 0, nil
 	}
 
-	var inbound_ids []int
-	var inbounds []*model.Inbound
-	var clientsToAdd []struct {
-		protocol string
-		tag      string
-		client   map[string]interface{}
-	}
-
+	var enabledEmails []string
 	for _, traffic := range traffics {
-		inbound_ids = append(inbound_ids, traffic.InboundId)
-	}
-	err = tx.Model(model.Inbound{}).Where("id IN ?", inbound_ids).Find(&inbounds).Error
-	if err != nil {
-		return false, 0, err
-	}
-
-	for inbound_index := range inbounds {
-		settings := map[string]interface{}{}
-		json.Unmarshal([]byte(inbounds[inbound_index].Settings), &settings)
-		clients := settings["clients"].([]interface{})
-
-		for client_index := range clients {
-			c := clients[client_index].(map[string]interface{})
-			for traffic_index, traffic := range traffics {
-				if traffic.Email == c["email"].(string) {
-					newExpiryTime := traffic.ExpiryTime
-					for newExpiryTime < now {
-						newExpiryTime += (int64(traffic.Reset) * 86400000)
-					}
-					c["expiryTime"] = newExpiryTime
-					traffics[traffic_index].ExpiryTime = newExpiryTime
-					traffics[traffic_index].Down = 0
-					traffics[traffic_index].Up = 0
-					if !traffic.Enable {
-						traffics[traffic_index].Enable = true
-						clientsToAdd = append(clientsToAdd,
-							struct {
-								protocol string
-								tag      string
-								client   map[string]interface{}
-							}{
-								protocol: string(inbounds[inbound_index].Protocol),
-								tag:      inbounds[inbound_index].Tag,
-								client:   c,
-							})
-					}
-					clients[client_index] = interface{}(c)
-					break
-				}
-			}
+		newExpiryTime := traffic.ExpiryTime
+		for newExpiryTime < now {
+			newExpiryTime += (int64(traffic.Reset) * 86400000)
 		}
-		settings["clients"] = clients
-		newSettings, err := json.MarshalIndent(settings, "", "  ")
+		err = tx.Model(model.Client{}).Where("email = ?", traffic.Email).Update("expiry_time", newExpiryTime).Error
 		if err != nil {
 			return false, 0, err
 		}
-		inbounds[inbound_index].Settings = string(newSettings)
-	}
-	err = tx.Save(inbounds).Error
-	if err != nil {
-		return false, 0, err
+		traffic.ExpiryTime = newExpiryTime
+		traffic.Down = 0
+		traffic.Up = 0
+		if !traffic.Enable {
+			traffic.Enable = true
+			enabledEmails = append(enabledEmails, traffic.Email)
+		}
 	}
 	err = tx.Save(traffics).Error
 	if err != nil {
 		return false, 0, err
 	}
-	needRestart := false
 
-	if p != nil {
-		err1 = s.xrayApi.Init(p.GetAPIPort())
-		if err1 != nil {
-			return true, int64(len(traffics)), nil
-		}
-		for _, clientToAdd := range clientsToAdd {
-			err1 = s.xrayApi.AddUser(clientToAdd.protocol, clientToAdd.tag, clientToAdd.client)
-			if err1 != nil {
-				needRestart = true
-			}
-		}
-		s.xrayApi.Close()
+	users, err := s.getXrayUsers(tx, enabledEmails)
+	if err != nil {
+		return true, int64(len(traffics)), nil
 	}
+	needRestart := s.applyXrayUsers(nil, users)
 
 	return needRestart, int64(len(traffics)), nil
 }
 
 func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error) {
 	now := time.Now().Unix() * 1000
-	needRestart := false
+	cutActions, err := s.speedService.getCutActions()
+	if err != nil {
+		return false, 0, err
+	}
 
-	if p != nil {
-		var results []struct {
-			Tag   string
-			Email string
-		}
+	var emails []string
+	err = tx.Table("client_traffics").
+		Joins("JOIN clients ON clients.email = client_traffics.email").
+		Where("((clients.quota_action IN ? AND "+quotaExceededSQL+") OR (client_traffics.expiry_time > 0 AND client_traffics.expiry_time <= ?)) AND client_traffics.enable = ?",
+			cutActions, now, true).
+		Pluck("client_traffics.email", &emails).Error
+	if err != nil {
+		return false, 0, err
+	}
+	if len(emails) == 0 {
+		return false, 0, nil
+	}
 
-		err := tx.Table("inbounds").
-			Select("inbounds.tag, client_traffics.email").
-			Joins("JOIN client_traffics ON inbounds.id = client_traffics.inbound_id").
-			Where("((client_traffics.total > 0 AND client_traffics.up + client_traffics.down >= client_traffics.total) OR (client_traffics.expiry_time > 0 AND client_traffics.expiry_time <= ?)) AND client_traffics.enable = ?", now, true).
-			Scan(&results).Error
-		if err != nil {
-			return false, 0, err
-		}
-		s.xrayApi.Init(p.GetAPIPort())
-		for _, result := range results {
-			err1 := s.xrayApi.RemoveUser(result.Tag, result.Email)
-			if err1 == nil {
-				logger.Debug("Client disabled by api:", result.Email)
-			} else {
-				logger.Debug("Error in disabling client by api:", err1)
-				needRestart = true
-			}
-		}
-		s.xrayApi.Close()
+	users, err := s.getXrayUsers(tx, emails)
+	if err != nil {
+		return false, 0, err
 	}
-	result := tx.Model(xray.ClientTraffic{}).
-		Where("((total > 0 and up + down >= total) or (expiry_time > 0 and expiry_time <= ?)) and enable = ?", now, true).
-		Update("enable", false)
-	err := result.Error
+	result := tx.Model(xray.ClientTraffic{}).Where("email IN ?", emails).Update("enable", false)
+	err = result.Error
 	count := result.RowsAffected
-	return needRestart, count, err
+	if err != nil {
+		return false, count, err
+	}
+	needRestart := s.applyXrayUsers(users, nil)
+	return needRestart, count, nil
 }
 
 func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error) {
@@ -366,9 +295,917 @@ func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error
 func (s *InboundService) GetAllInbounds() ([]*model.Inbound, error) {
 	db := database.GetDB()
 	var inbounds []*model.Inbound
-	err := db.Model(model.Inbound{}).Preload("ClientStats").Find(&inbounds).Error
+	err := db.Model(model.Inbound{}).Preload("ClientStats").Preload("Clients").Find(&inbounds).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return inbounds, nil
+}
+
+// GetOnlineClients returns the emails of the clients that had traffic in the
+// last collection.
+func (s *InboundService) GetOnlineClients() []string {
+	if p == nil {
+		return nil
+	}
+	return p.GetOnlineClients()
+}
+
+// scopeInbounds restricts an inbounds query to the inbounds the user is allowed to see.
+func scopeInbounds(tx *gorm.DB, user *model.User) *gorm.DB {
+	if user != nil && user.IsScoped() {
+		return tx.Where("inbounds.user_id = ?", user.Id)
+	}
+	return tx
+}
+
+// GetInbounds returns the inbounds visible to the user.
+func (s *InboundService) GetInbounds(user *model.User) ([]*model.Inbound, error) {
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	err := scopeInbounds(db.Model(model.Inbound{}), user).Preload("ClientStats").Preload("Clients").Find(&inbounds).Error
 	if err != nil && err != gorm.ErrRecordNotFound {
 		return nil, err
 	}
 	return inbounds, nil
 }
+
+// GetInbound returns the inbound with the given id, or gorm.ErrRecordNotFound
+// when it does not exist or the user may not see it.
+func (s *InboundService) GetInbound(user *model.User, id int) (*model.Inbound, error) {
+	db := database.GetDB()
+	inbound := &model.Inbound{}
+	err := scopeInbounds(db.Model(model.Inbound{}), user).Preload("ClientStats").Preload("Clients").Where("id = ?", id).First(inbound).Error
+	if err != nil {
+		return nil, err
+	}
+	return inbound, nil
+}
+
+func (s *InboundService) GetClientTrafficByEmail(user *model.User, email string) (*xray.ClientTraffic, error) {
+	db := database.GetDB()
+	traffic := &xray.ClientTraffic{}
+	err := scopeInbounds(db.Model(xray.ClientTraffic{}).
+		Select("client_traffics.*").
+		Joins("JOIN inbounds ON inbounds.id = client_traffics.inbound_id"), user).
+		Where("client_traffics.email = ?", email).
+		First(traffic).Error
+	if err != nil {
+		return nil, err
+	}
+	return traffic, nil
+}
+
+// SetInboundOwner hands an inbound over to another panel user.
+func (s *InboundService) SetInboundOwner(id int, userId int) error {
+	db := database.GetDB()
+	var count int64
+	err := db.Model(model.User{}).Where("id = ?", userId).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return common.NewErrorf("user %v not found", userId)
+	}
+	result := db.Model(model.Inbound{}).Where("id = ?", id).Update("user_id", userId)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+var anyListenAddresses = []string{"", "0.0.0.0", "::", "::0"}
+
+func isAnyListen(listen string) bool {
+	for _, address := range anyListenAddresses {
+		if listen == address {
+			return true
+		}
+	}
+	return false
+}
+
+func genInboundTag(inbound *model.Inbound) string {
+	if isAnyListen(inbound.Listen) {
+		return fmt.Sprintf("inbound-%v", inbound.Port)
+	}
+	return fmt.Sprintf("inbound-%v:%v", inbound.Listen, inbound.Port)
+}
+
+func checkJsonObject(name string, value string, required bool) error {
+	if value == "" {
+		if required {
+			return common.NewErrorf("%v can not be empty", name)
+		}
+		return nil
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &obj); err != nil {
+		return common.NewErrorf("%v is not a valid JSON object: %v", name, err)
+	}
+	return nil
+}
+
+func (s *InboundService) checkPortExist(tx *gorm.DB, listen string, port int, ignoreId int) (bool, error) {
+	db := tx.Model(model.Inbound{}).Where("port = ?", port)
+	if !isAnyListen(listen) {
+		db = db.Where("listen = ? or listen in ?", listen, anyListenAddresses)
+	}
+	if ignoreId > 0 {
+		db = db.Where("id != ?", ignoreId)
+	}
+	var count int64
+	err := db.Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// checkResetSchedule fills in the default traffic reset schedule and validates it.
+func checkResetSchedule(period *model.ResetPeriod, day int) error {
+	if *period == "" {
+		*period = model.ResetNever
+	}
+	if !period.IsValid(day) {
+		return common.NewErrorf("invalid traffic reset schedule: %v %v", *period, day)
+	}
+	return nil
+}
+
+// checkQuotaAction fills in the default quota action and validates it and the grace.
+func checkQuotaAction(action *model.QuotaAction, grace int) error {
+	if *action == "" {
+		*action = model.QuotaCut
+	}
+	if !action.IsValid() {
+		return common.NewErrorf("invalid quota action: %v", *action)
+	}
+	if grace < 0 || grace > 100 {
+		return common.NewErrorf("invalid quota grace: %v", grace)
+	}
+	return nil
+}
+
+// checkInbound validates an inbound before it is saved and fills in its tag.
+func (s *InboundService) checkInbound(tx *gorm.DB, inbound *model.Inbound) error {
+	if !inbound.Protocol.IsValid() {
+		return common.NewErrorf("invalid protocol: %v", inbound.Protocol)
+	}
+	if inbound.Port <= 0 || inbound.Port > 65535 {
+		return common.NewErrorf("invalid port: %v", inbound.Port)
+	}
+	if err := checkJsonObject("settings", inbound.Settings, true); err != nil {
+		return err
+	}
+	if err := checkJsonObject("streamSettings", inbound.StreamSettings, false); err != nil {
+		return err
+	}
+	if err := checkJsonObject("sniffing", inbound.Sniffing, false); err != nil {
+		return err
+	}
+	if err := checkJsonObject("allocate", inbound.Allocate, false); err != nil {
+		return err
+	}
+	if err := checkResetSchedule(&inbound.TrafficReset, inbound.ResetDay); err != nil {
+		return err
+	}
+	if err := checkSpeedLimit(inbound.SpeedLimit); err != nil {
+		return err
+	}
+
+	exist, err := s.checkPortExist(tx, inbound.Listen, inbound.Port, inbound.Id)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return common.NewErrorf("port %v is already in use", inbound.Port)
+	}
+
+	if inbound.Tag == "" {
+		inbound.Tag = genInboundTag(inbound)
+	}
+	var count int64
+	err = tx.Model(model.Inbound{}).Where("tag = ? and id != ?", inbound.Tag, inbound.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewErrorf("tag %v is already in use", inbound.Tag)
+	}
+
+	if !inbound.Protocol.HasClients() {
+		return nil
+	}
+	for i := range inbound.Clients {
+		client := &inbound.Clients[i]
+		if err := checkResetSchedule(&client.TrafficReset, client.ResetDay); err != nil {
+			return common.NewErrorf("client %v: %v", client.Email, err)
+		}
+		if err := checkSpeedLimit(client.SpeedLimit); err != nil {
+			return common.NewErrorf("client %v: %v", client.Email, err)
+		}
+		if err := checkQuotaAction(&client.QuotaAction, client.QuotaGrace); err != nil {
+			return common.NewErrorf("client %v: %v", client.Email, err)
+		}
+		if err := checkPlanId(tx, client.PlanId); err != nil {
+			return common.NewErrorf("client %v: %v", client.Email, err)
+		}
+	}
+	return s.checkEmails(tx, inbound.Clients, inbound.Id, 0)
+}
+
+// extractClients moves the clients array out of the inbound settings into
+// inbound.Clients. It reports whether the settings had a clients array.
+func (s *InboundService) extractClients(inbound *model.Inbound) (bool, error) {
+	if !inbound.Protocol.HasClients() {
+		return false, nil
+	}
+	settings := map[string]json.RawMessage{}
+	err := json.Unmarshal([]byte(inbound.Settings), &settings)
+	if err != nil {
+		return false, common.NewErrorf("settings is not a valid JSON object: %v", err)
+	}
+	rawClients, ok := settings["clients"]
+	if !ok {
+		return false, nil
+	}
+	var clients []model.Client
+	err = json.Unmarshal(rawClients, &clients)
+	if err != nil {
+		return false, common.NewErrorf("invalid clients: %v", err)
+	}
+	delete(settings, "clients")
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	inbound.Settings = string(newSettings)
+	inbound.Clients = clients
+	return true, nil
+}
+
+// checkEmails makes sure every client has an email that is not used by any
+// other client. Clients of ignoreInboundId and the client with ignoreClientId
+// do not count as other clients. The user of the speed-return inbound is
+// reserved, as its traffic would match the speed rule of such a client again.
+func (s *InboundService) checkEmails(tx *gorm.DB, clients []model.Client, ignoreInboundId int, ignoreClientId int) error {
+	emails := make([]string, 0, len(clients))
+	seen := make(map[string]bool, len(clients))
+	for _, client := range clients {
+		if client.Email == "" {
+			return common.NewError("client email can not be empty")
+		}
+		if client.Email == speedReturnTag {
+			return common.NewErrorf("client email is reserved: %v", client.Email)
+		}
+		if seen[client.Email] {
+			return common.NewErrorf("duplicate email: %v", client.Email)
+		}
+		seen[client.Email] = true
+		emails = append(emails, client.Email)
+	}
+	if len(emails) == 0 {
+		return nil
+	}
+	db := tx.Model(model.Client{}).Where("email in ?", emails)
+	if ignoreInboundId > 0 {
+		db = db.Where("inbound_id != ?", ignoreInboundId)
+	}
+	if ignoreClientId > 0 {
+		db = db.Where("id != ?", ignoreClientId)
+	}
+	var dupEmails []string
+	err := db.Pluck("email", &dupEmails).Error
+	if err != nil {
+		return err
+	}
+	if len(dupEmails) > 0 {
+		return common.NewErrorf("duplicate email: %v", strings.Join(dupEmails, ", "))
+	}
+	return nil
+}
+
+// quotaExceededSQL is the condition of isQuotaExceeded on client_traffics
+// joined with clients.
+const quotaExceededSQL = "client_traffics.total > 0 AND client_traffics.up + client_traffics.down >= client_traffics.total + client_traffics.total * clients.quota_grace / 100"
+
+// isQuotaExceeded reports whether a client used its quota plus the grace
+// allowance.
+func isQuotaExceeded(client *model.Client, traffic *xray.ClientTraffic) bool {
+	return traffic.Total > 0 && traffic.Up+traffic.Down >= traffic.Total+traffic.Total*int64(client.QuotaGrace)/100
+}
+
+// isDepleted reports whether a client has to be cut off, because it expired
+// or exceeded its quota with one of the cutActions.
+func isDepleted(client *model.Client, traffic *xray.ClientTraffic, now int64, cutActions []model.QuotaAction) bool {
+	cut := slices.Contains(cutActions, client.QuotaAction)
+	return (cut && isQuotaExceeded(client, traffic)) ||
+		(traffic.ExpiryTime > 0 && traffic.ExpiryTime <= now)
+}
+
+// syncClientTraffic brings the client_traffics row of a client in line with
+// it, creating the row when needed and keeping the usage.
+func (s *InboundService) syncClientTraffic(tx *gorm.DB, client *model.Client) error {
+	traffic := &xray.ClientTraffic{}
+	err := tx.Model(xray.ClientTraffic{}).Where("email = ?", client.Email).First(traffic).Error
+	if database.IsNotFound(err) {
+		traffic = &xray.ClientTraffic{
+			Email: client.Email,
+		}
+	} else if err != nil {
+		return err
+	}
+	traffic.InboundId = client.InboundId
+	traffic.Total = client.TotalGB
+	traffic.ExpiryTime = client.ExpiryTime
+	traffic.Reset = client.Reset
+	cutActions, err := s.speedService.getCutActions()
+	if err != nil {
+		return err
+	}
+	traffic.Enable = client.Enable && !isDepleted(client, traffic, time.Now().Unix()*1000, cutActions)
+	return tx.Save(traffic).Error
+}
+
+// saveInboundClients makes the clients rows of an inbound match
+// inbound.Clients and syncs their client_traffics rows. Clients are matched
+// by email, so existing clients keep their usage.
+func (s *InboundService) saveInboundClients(tx *gorm.DB, inbound *model.Inbound) error {
+	var oldClients []*model.Client
+	err := tx.Model(model.Client{}).Where("inbound_id = ?", inbound.Id).Find(&oldClients).Error
+	if err != nil {
+		return err
+	}
+	oldClientMap := make(map[string]*model.Client, len(oldClients))
+	for _, oldClient := range oldClients {
+		oldClientMap[oldClient.Email] = oldClient
+	}
+
+	for i := range inbound.Clients {
+		client := &inbound.Clients[i]
+		client.Id = 0
+		client.InboundId = inbound.Id
+		client.LastTrafficResetTime = 0
+		if oldClient, ok := oldClientMap[client.Email]; ok {
+			client.Id = oldClient.Id
+			client.LastTrafficResetTime = oldClient.LastTrafficResetTime
+			delete(oldClientMap, client.Email)
+		}
+		linked, err := s.getLinkedInbounds(tx, client.Id)
+		if err != nil {
+			return err
+		}
+		inbounds := append([]*model.Inbound{inbound}, linked...)
+		if err := checkClientInbounds(inbounds); err != nil {
+			return common.NewErrorf("client %v: %v", client.Email, err)
+		}
+		fillClient(client, inbounds...)
+		if err := tx.Save(client).Error; err != nil {
+			return err
+		}
+		if err := s.syncClientTraffic(tx, client); err != nil {
+			return err
+		}
+	}
+
+	for email, oldClient := range oldClientMap {
+		if err := s.delClient(tx, oldClient); err != nil {
+			return err
+		}
+		if err := tx.Where("email = ?", email).Delete(xray.ClientTraffic{}).Error; err != nil {
+			return err
+		}
+	}
+	return s.saveLinkedClients(tx, inbound)
+}
+
+// delClient deletes a client and its links to other inbounds.
+func (s *InboundService) delClient(tx *gorm.DB, client *model.Client) error {
+	err := tx.Where("client_id = ?", client.Id).Delete(model.ClientInbound{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Delete(client).Error
+}
+
+// saveLinkedClients updates the credentials of the clients linked to the
+// inbound for its protocol. The links are dropped when the protocol of the
+// inbound has no clients.
+func (s *InboundService) saveLinkedClients(tx *gorm.DB, inbound *model.Inbound) error {
+	if !inbound.Protocol.HasClients() {
+		return tx.Where("inbound_id = ?", inbound.Id).Delete(model.ClientInbound{}).Error
+	}
+	var clients []*model.Client
+	err := tx.Model(model.Client{}).
+		Where("id IN (?)", tx.Model(model.ClientInbound{}).Select("client_id").Where("inbound_id = ?", inbound.Id)).
+		Find(&clients).Error
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		home := &model.Inbound{}
+		err = tx.Model(model.Inbound{}).Where("id = ?", client.InboundId).First(home).Error
+		if err != nil {
+			return err
+		}
+		linked, err := s.getLinkedInbounds(tx, client.Id)
+		if err != nil {
+			return err
+		}
+		inbounds := append([]*model.Inbound{home}, linked...)
+		if err := checkClientInbounds(inbounds); err != nil {
+			return common.NewErrorf("client %v: %v", client.Email, err)
+		}
+		fillClient(client, inbounds...)
+		if err := tx.Save(client).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getLinkedInbounds returns the inbounds a client is linked to besides its own.
+func (s *InboundService) getLinkedInbounds(tx *gorm.DB, clientId int) ([]*model.Inbound, error) {
+	var inbounds []*model.Inbound
+	if clientId == 0 {
+		return inbounds, nil
+	}
+	err := tx.Model(model.Inbound{}).
+		Joins("JOIN client_inbounds ON client_inbounds.inbound_id = inbounds.id").
+		Where("client_inbounds.client_id = ?", clientId).
+		Order("inbounds.id").
+		Find(&inbounds).Error
+	return inbounds, err
+}
+
+// getLinkedClients returns the clients linked to each of the given inbounds
+// that should be present in the running Xray.
+func (s *InboundService) getLinkedClients(tx *gorm.DB, inboundIds []int) (map[int][]model.Client, error) {
+	var links []model.ClientInbound
+	err := tx.Model(model.ClientInbound{}).
+		Select("client_inbounds.*").
+		Joins("JOIN clients ON clients.id = client_inbounds.client_id").
+		Joins("JOIN client_traffics ON client_traffics.email = clients.email").
+		Where("client_inbounds.inbound_id IN ? AND clients.enable = ? AND client_traffics.enable = ?", inboundIds, true, true).
+		Order("client_inbounds.client_id").
+		Find(&links).Error
+	if err != nil || len(links) == 0 {
+		return nil, err
+	}
+	clientIds := make([]int, 0, len(links))
+	for _, link := range links {
+		clientIds = append(clientIds, link.ClientId)
+	}
+	var clients []model.Client
+	err = tx.Model(model.Client{}).Where("id IN ?", clientIds).Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	clientMap := make(map[int]model.Client, len(clients))
+	for _, client := range clients {
+		clientMap[client.Id] = client
+	}
+	linkedClients := make(map[int][]model.Client)
+	for _, link := range links {
+		if client, ok := clientMap[link.ClientId]; ok {
+			linkedClients[link.InboundId] = append(linkedClients[link.InboundId], client)
+		}
+	}
+	return linkedClients, nil
+}
+
+// applyInbound replaces the inbound with oldTag in the running Xray by the
+// given inbound. Either side may be empty. It returns true when the change
+// could not be applied through the API and Xray has to be restarted.
+func (s *InboundService) applyInbound(oldTag string, inbound *model.Inbound) bool {
+	needRestart := s.speedService.ApplySpeedLimits()
+	if p == nil || !p.IsRunning() {
+		return needRestart
+	}
+	var inboundJson []byte
+	if inbound != nil && inbound.Enable {
+		db := database.GetDB()
+		dbInbound := &model.Inbound{}
+		err := db.Model(model.Inbound{}).Preload("ClientStats").Preload("Clients").
+			Where("id = ?", inbound.Id).First(dbInbound).Error
+		if err != nil {
+			logger.Warning("Unable to load inbound:", err)
+			return true
+		}
+		linkedClients, err := s.getLinkedClients(db, []int{inbound.Id})
+		if err != nil {
+			logger.Warning("Unable to load linked clients:", err)
+			return true
+		}
+		inboundConfig, err := genXrayInboundConfig(dbInbound, linkedClients[inbound.Id])
+		if err != nil {
+			logger.Warning("Unable to generate inbound config:", err)
+			return true
+		}
+		inboundJson, err = json.Marshal(inboundConfig)
+		if err != nil {
+			logger.Warning("Unable to marshal inbound config:", err)
+			return true
+		}
+	}
+
+	err := s.xrayApi.Init(p.GetAPIPort())
+	if err != nil {
+		logger.Debug("Unable to connect to Xray API:", err)
+		return true
+	}
+	defer s.xrayApi.Close()
+
+	if oldTag != "" {
+		if err := s.xrayApi.DelInbound(oldTag); err != nil {
+			logger.Debug("Unable to delete inbound by api:", err)
+			needRestart = true
+		} else {
+			logger.Debug("Inbound deleted by api:", oldTag)
+		}
+	}
+	if inboundJson != nil {
+		if err := s.xrayApi.AddInbound(inboundJson); err != nil {
+			logger.Debug("Unable to add inbound by api:", err)
+			needRestart = true
+		} else {
+			logger.Debug("Inbound added by api:", inbound.Tag)
+		}
+	}
+	return needRestart
+}
+
+// AddInbound creates an inbound owned by the user, or by inbound.UserId when
+// an owner sets it. Clients may be given in settings.clients or in
+// inbound.Clients. The returned bool reports whether Xray needs a restart.
+func (s *InboundService) AddInbound(user *model.User, inbound *model.Inbound) (*model.Inbound, bool, error) {
+	inbound.Id = 0
+	inbound.Up = 0
+	inbound.Down = 0
+	inbound.LastTrafficResetTime = 0
+	inbound.ClientStats = nil
+	if user.IsScoped() || inbound.UserId == 0 {
+		inbound.UserId = user.Id
+	}
+	if err := checkJsonObject("settings", inbound.Settings, true); err != nil {
+		return nil, false, err
+	}
+	if _, err := s.extractClients(inbound); err != nil {
+		return nil, false, err
+	}
+	clients := inbound.Clients
+	inbound.Clients = nil
+
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if inbound.UserId != user.Id {
+			if err := tx.Model(model.User{}).Where("id = ?", inbound.UserId).First(&model.User{}).Error; err != nil {
+				return common.NewErrorf("user %v not found", inbound.UserId)
+			}
+		}
+		inbound.Clients = clients
+		if err := s.checkInbound(tx, inbound); err != nil {
+			return err
+		}
+		inbound.Clients = nil
+		if err := tx.Create(inbound).Error; err != nil {
+			return err
+		}
+		inbound.Clients = clients
+		return s.saveInboundClients(tx, inbound)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	s.webhookService.Emit(model.WebhookInboundChanged, &InboundEvent{Action: "added", Inbound: inbound})
+	needRestart := s.applyInbound("", inbound)
+	return inbound, needRestart, nil
+}
+
+// UpdateInbound replaces the settings of an inbound the user can access.
+// Traffic counters and the owner are kept. The clients are replaced only when
+// the new settings have a clients array.
+func (s *InboundService) UpdateInbound(user *model.User, inbound *model.Inbound) (*model.Inbound, bool, error) {
+	oldInbound, err := s.GetInbound(user, inbound.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	oldTag := ""
+	if oldInbound.Enable {
+		oldTag = oldInbound.Tag
+	}
+	prevTag := oldInbound.Tag
+	if err := checkJsonObject("settings", inbound.Settings, true); err != nil {
+		return nil, false, err
+	}
+	hasClients, err := s.extractClients(inbound)
+	if err != nil {
+		return nil, false, err
+	}
+
+	oldInbound.Total = inbound.Total
+	oldInbound.Remark = inbound.Remark
+	oldInbound.Enable = inbound.Enable
+	oldInbound.ExpiryTime = inbound.ExpiryTime
+	oldInbound.SpeedLimit = inbound.SpeedLimit
+	oldInbound.TrafficReset = inbound.TrafficReset
+	oldInbound.ResetDay = inbound.ResetDay
+	oldInbound.Listen = inbound.Listen
+	oldInbound.Port = inbound.Port
+	oldInbound.Protocol = inbound.Protocol
+	oldInbound.Settings = inbound.Settings
+	oldInbound.StreamSettings = inbound.StreamSettings
+	oldInbound.Sniffing = inbound.Sniffing
+	oldInbound.Allocate = inbound.Allocate
+	oldInbound.Tag = inbound.Tag
+	oldInbound.ClientStats = nil
+	if hasClients {
+		oldInbound.Clients = inbound.Clients
+	}
+	if !oldInbound.Protocol.HasClients() {
+		oldInbound.Clients = nil
+	}
+	clients := oldInbound.Clients
+
+	var emails []string
+	var before, after []xrayUser
+	db := database.GetDB()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		emails, before, err = s.getLinkedXrayUsers(tx, oldInbound.Id, prevTag, nil)
+		if err != nil {
+			return err
+		}
+		if err := s.checkInbound(tx, oldInbound); err != nil {
+			return err
+		}
+		oldInbound.Clients = nil
+		if err := tx.Save(oldInbound).Error; err != nil {
+			return err
+		}
+		oldInbound.Clients = clients
+		if err := s.saveInboundClients(tx, oldInbound); err != nil {
+			return err
+		}
+		_, after, err = s.getLinkedXrayUsers(tx, oldInbound.Id, oldInbound.Tag, emails)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	s.webhookService.Emit(model.WebhookInboundChanged, &InboundEvent{Action: "updated", Inbound: oldInbound})
+	needRestart := s.applyXrayUsers(before, after)
+	needRestart = s.applyInbound(oldTag, oldInbound) || needRestart
+	return oldInbound, needRestart, nil
+}
+
+// getLinkedXrayUsers returns the emails of the clients of an inbound, added
+// to the given ones, and the Xray users of those clients on the other
+// inbounds they are linked to. Those users have to be updated separately when
+// the clients of the inbound change.
+func (s *InboundService) getLinkedXrayUsers(tx *gorm.DB, inboundId int, tag string, emails []string) ([]string, []xrayUser, error) {
+	var inboundEmails []string
+	err := tx.Model(model.Client{}).Where("inbound_id = ?", inboundId).Pluck("email", &inboundEmails).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	emails = append(emails, inboundEmails...)
+	users, err := s.getXrayUsers(tx, emails)
+	if err != nil {
+		return nil, nil, err
+	}
+	var linkedUsers []xrayUser
+	for _, u := range users {
+		if u.tag != tag {
+			linkedUsers = append(linkedUsers, u)
+		}
+	}
+	return emails, linkedUsers, nil
+}
+
+func (s *InboundService) DelInbound(user *model.User, id int) (bool, error) {
+	inbound, err := s.GetInbound(user, id)
+	if err != nil {
+		return false, err
+	}
+	var linkedUsers []xrayUser
+	db := database.GetDB()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		_, linkedUsers, err = s.getLinkedXrayUsers(tx, id, inbound.Tag, nil)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("inbound_id = ?", id).Delete(xray.ClientTraffic{}).Error; err != nil {
+			return err
+		}
+		err = tx.Where("inbound_id = ? OR client_id IN (?)", id, tx.Model(model.Client{}).Select("id").Where("inbound_id = ?", id)).
+			Delete(model.ClientInbound{}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("inbound_id = ?", id).Delete(model.Client{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(model.Inbound{}, id).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	s.webhookService.Emit(model.WebhookInboundChanged, &InboundEvent{Action: "deleted", Inbound: inbound})
+	needRestart := s.applyXrayUsers(linkedUsers, nil)
+	if !inbound.Enable {
+		return needRestart, nil
+	}
+	return s.applyInbound(inbound.Tag, nil) || needRestart, nil
+}
+
+func (s *InboundService) SetInboundEnable(user *model.User, id int, enable bool) (bool, error) {
+	inbound, err := s.GetInbound(user, id)
+	if err != nil {
+		return false, err
+	}
+	if inbound.Enable == enable {
+		return false, nil
+	}
+	db := database.GetDB()
+	err = db.Model(model.Inbound{}).Where("id = ?", id).Update("enable", enable).Error
+	if err != nil {
+		return false, err
+	}
+	inbound.Enable = enable
+	action := "disabled"
+	if enable {
+		action = "enabled"
+	}
+	s.webhookService.Emit(model.WebhookInboundChanged, &InboundEvent{Action: action, Inbound: inbound})
+	if enable {
+		return s.applyInbound("", inbound), nil
+	}
+	return s.applyInbound(inbound.Tag, nil), nil
+}
+
+// CloneInbound copies the protocol and transport settings of an inbound to a
+// new inbound on another port. Clients are not copied, since their emails
+// must be unique.
+func (s *InboundService) CloneInbound(user *model.User, id int, port int) (*model.Inbound, bool, error) {
+	inbound, err := s.GetInbound(user, id)
+	if err != nil {
+		return nil, false, err
+	}
+	clone := *inbound
+	clone.Port = port
+	clone.Tag = ""
+	clone.Remark = inbound.Remark + " (clone)"
+	clone.Clients = nil
+	return s.AddInbound(user, &clone)
+}
+
+// xrayUser is a client as the running Xray knows it.
+type xrayUser struct {
+	protocol string
+	tag      string
+	email    string
+	user     map[string]interface{}
+}
+
+// getXrayUsers returns the clients with the given emails that should be
+// present in the running Xray, once for their own inbound and once for each
+// inbound they are linked to.
+func (s *InboundService) getXrayUsers(tx *gorm.DB, emails []string) ([]xrayUser, error) {
+	if len(emails) == 0 {
+		return nil, nil
+	}
+	var clients []*model.Client
+	err := tx.Model(model.Client{}).
+		Select("clients.*").
+		Joins("JOIN client_traffics ON client_traffics.email = clients.email").
+		Where("clients.email in ? and clients.enable = ? and client_traffics.enable = ?", emails, true, true).
+		Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, nil
+	}
+	clientIds := make([]int, 0, len(clients))
+	inboundIds := make([]int, 0, len(clients))
+	clientInbounds := make(map[int][]int, len(clients))
+	for _, client := range clients {
+		clientIds = append(clientIds, client.Id)
+		inboundIds = append(inboundIds, client.InboundId)
+		clientInbounds[client.Id] = []int{client.InboundId}
+	}
+	var links []model.ClientInbound
+	err = tx.Model(model.ClientInbound{}).Where("client_id IN ?", clientIds).Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		inboundIds = append(inboundIds, link.InboundId)
+		clientInbounds[link.ClientId] = append(clientInbounds[link.ClientId], link.InboundId)
+	}
+	var inbounds []*model.Inbound
+	err = tx.Model(model.Inbound{}).Where("id in ? and enable = ?", inboundIds, true).Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	inboundMap := make(map[int]*model.Inbound, len(inbounds))
+	methods := make(map[int]string, len(inbounds))
+	for _, inbound := range inbounds {
+		inboundMap[inbound.Id] = inbound
+		settings := map[string]interface{}{}
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		methods[inbound.Id], _ = settings["method"].(string)
+	}
+
+	var users []xrayUser
+	for _, client := range clients {
+		for _, inboundId := range clientInbounds[client.Id] {
+			inbound, ok := inboundMap[inboundId]
+			if !ok {
+				continue
+			}
+			cipher := client.Method
+			if cipher == "" {
+				cipher = methods[inbound.Id]
+			}
+			c := genXrayClient(inbound.Protocol, client)
+			users = append(users, xrayUser{
+				protocol: string(inbound.Protocol),
+				tag:      inbound.Tag,
+				email:    client.Email,
+				user: map[string]interface{}{
+					"email":    client.Email,
+					"id":       getString(c, "id"),
+					"password": getString(c, "password"),
+					"flow":     getString(c, "flow"),
+					"cipher":   cipher,
+				},
+			})
+		}
+	}
+	return users, nil
+}
+
+// applyXrayUsers turns the running Xray from the before set of users into the
+// after set over a single API connection. It returns true when that failed
+// and Xray has to be restarted.
+func (s *InboundService) applyXrayUsers(before []xrayUser, after []xrayUser) bool {
+	if p == nil || !p.IsRunning() {
+		return false
+	}
+	key := func(u xrayUser) string { return u.tag + "|" + u.email }
+	beforeMap := make(map[string]xrayUser, len(before))
+	for _, u := range before {
+		beforeMap[key(u)] = u
+	}
+	afterMap := make(map[string]xrayUser, len(after))
+	for _, u := range after {
+		afterMap[key(u)] = u
+	}
+
+	var removes, adds []xrayUser
+	for k, u := range beforeMap {
+		newUser, ok := afterMap[k]
+		if !ok || !reflect.DeepEqual(u.user, newUser.user) {
+			removes = append(removes, u)
+		}
+	}
+	for k, u := range afterMap {
+		oldUser, ok := beforeMap[k]
+		if !ok || !reflect.DeepEqual(u.user, oldUser.user) {
+			adds = append(adds, u)
+		}
+	}
+	if len(removes) == 0 && len(adds) == 0 {
+		return false
+	}
+
+	err := s.xrayApi.Init(p.GetAPIPort())
+	if err != nil {
+		logger.Debug("Unable to connect to Xray API:", err)
+		return true
+	}
+	defer s.xrayApi.Close()
+
+	needRestart := false
+	for _, u := range removes {
+		err := s.xrayApi.RemoveUser(u.tag, u.email)
+		if err != nil {
+			logger.Debug("Error in removing client by api:", err)
+			needRestart = true
+		}
+	}
+	for _, u := range adds {
+		err := s.xrayApi.AddUser(u.protocol, u.tag, u.user)
+		if err != nil {
+			logger.Debug("Error in adding client by api:", err)
+			needRestart = true
+		}
+	}
+	return needRestart
+}
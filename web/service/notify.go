@@ -0,0 +1,265 @@
+package service
+
+import (
+	"sync"
+	"time"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/xray"
+
+	"gorm.io/gorm"
+)
+
+// Notification tells about an event of a client. Remark is the remark of the
+// inbound of the client.
+type Notification struct {
+	Event      model.NotifyEvent `json:"event"`
+	Email      string            `json:"email"`
+	InboundId  int               `json:"inboundId"`
+	Remark     string            `json:"remark"`
+	TgID       int64             `json:"tgId"`
+	SubID      string            `json:"subId"`
+	Up         int64             `json:"up"`
+	Down       int64             `json:"down"`
+	Total      int64             `json:"total"`
+	ExpiryTime int64             `json:"expiryTime"`
+	Time       int64             `json:"time"`
+}
+
+// NotifyChannel delivers notifications, for example to Telegram, webhooks or
+// email. Channels are registered once with RegisterNotifyChannel and decide
+// themselves whom they notify.
+type NotifyChannel interface {
+	Name() string
+	// Enabled reports whether the channel is configured to send.
+	Enabled() bool
+	Send(notification *Notification) error
+}
+
+var (
+	notifyLock     sync.Mutex
+	notifyChannels []NotifyChannel
+	notifyCheck    sync.Mutex
+)
+
+func RegisterNotifyChannel(channel NotifyChannel) {
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+	notifyChannels = append(notifyChannels, channel)
+}
+
+func getNotifyChannels() []NotifyChannel {
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+	return append([]NotifyChannel(nil), notifyChannels...)
+}
+
+// NotifyService checks the clients against the notification thresholds and
+// sends a notification through all enabled channels when a condition starts
+// to hold. Conditions that hold are kept as client alerts, so each one is
+// sent once per cycle: it is sent again only after it cleared, for example
+// after the client was renewed or its traffic reset.
+type NotifyService struct {
+	settingService SettingService
+}
+
+type notifyThresholds struct {
+	expireDiff  int64
+	trafficDiff int64
+	warnPercent int64
+}
+
+func (s *NotifyService) getThresholds() (*notifyThresholds, error) {
+	expireDiff, err := s.settingService.GetExpireDiff()
+	if err != nil {
+		return nil, err
+	}
+	trafficDiff, err := s.settingService.GetTrafficDiff()
+	if err != nil {
+		return nil, err
+	}
+	warnPercent, err := s.settingService.GetTrafficWarnPercent()
+	if err != nil {
+		return nil, err
+	}
+	return &notifyThresholds{
+		expireDiff:  int64(expireDiff) * 86400000,
+		trafficDiff: int64(trafficDiff) * 1073741824,
+		warnPercent: int64(warnPercent),
+	}, nil
+}
+
+// getClientEvents returns the conditions that hold for a client.
+func (t *notifyThresholds) getClientEvents(client *model.Client, traffic *xray.ClientTraffic, now int64) []model.NotifyEvent {
+	var events []model.NotifyEvent
+	used := traffic.Up + traffic.Down
+	expired := traffic.ExpiryTime > 0 && traffic.ExpiryTime <= now
+	if isQuotaExceeded(client, traffic) || expired {
+		events = append(events, model.NotifyDepleted)
+	} else {
+		if t.expireDiff > 0 && traffic.ExpiryTime > 0 && traffic.ExpiryTime-now <= t.expireDiff {
+			events = append(events, model.NotifyExpiring)
+		}
+		if traffic.Total > 0 && ((t.trafficDiff > 0 && traffic.Total-used <= t.trafficDiff) ||
+			(t.warnPercent > 0 && used*100 >= traffic.Total*t.warnPercent)) {
+			events = append(events, model.NotifyTraffic)
+		}
+	}
+	if client.Enable && !traffic.Enable {
+		events = append(events, model.NotifyDisabled)
+	}
+	return events
+}
+
+// CheckClients evaluates the thresholds for all clients and sends the
+// notifications whose condition started to hold since the last check. The
+// first check of a panel only records the conditions, so existing clients
+// are not notified all at once. A setting marks it done, so a panel that
+// starts without clients notifies about its first ones.
+func (s *NotifyService) CheckClients() error {
+	notifyCheck.Lock()
+	defer notifyCheck.Unlock()
+	thresholds, err := s.getThresholds()
+	if err != nil {
+		return err
+	}
+	db := database.GetDB()
+	var clients []*model.Client
+	err = db.Model(model.Client{}).Find(&clients).Error
+	if err != nil {
+		return err
+	}
+	var traffics []*xray.ClientTraffic
+	err = db.Model(xray.ClientTraffic{}).Find(&traffics).Error
+	if err != nil {
+		return err
+	}
+	trafficMap := make(map[string]*xray.ClientTraffic, len(traffics))
+	for _, traffic := range traffics {
+		trafficMap[traffic.Email] = traffic
+	}
+	var inbounds []*model.Inbound
+	err = db.Model(model.Inbound{}).Select("id", "remark").Find(&inbounds).Error
+	if err != nil {
+		return err
+	}
+	remarks := make(map[int]string, len(inbounds))
+	for _, inbound := range inbounds {
+		remarks[inbound.Id] = inbound.Remark
+	}
+	var alerts []*model.ClientAlert
+	err = db.Model(model.ClientAlert{}).Find(&alerts).Error
+	if err != nil {
+		return err
+	}
+	type alertKey struct {
+		email string
+		event model.NotifyEvent
+	}
+	marked, err := s.settingService.GetClientAlertsReady()
+	if err != nil {
+		return err
+	}
+	// Panels that recorded alerts before the setting existed are past their
+	// first check.
+	ready := marked || len(alerts) > 0
+	alertMap := make(map[alertKey]*model.ClientAlert, len(alerts))
+	for _, alert := range alerts {
+		alertMap[alertKey{alert.Email, alert.Event}] = alert
+	}
+
+	now := time.Now().Unix() * 1000
+	var notifications []*Notification
+	var saves []*model.ClientAlert
+	for _, client := range clients {
+		traffic, ok := trafficMap[client.Email]
+		if !ok {
+			continue
+		}
+		notify := func(event model.NotifyEvent) {
+			if !ready {
+				return
+			}
+			notifications = append(notifications, &Notification{
+				Event:      event,
+				Email:      client.Email,
+				InboundId:  client.InboundId,
+				Remark:     remarks[client.InboundId],
+				TgID:       client.TgID,
+				SubID:      client.SubID,
+				Up:         traffic.Up,
+				Down:       traffic.Down,
+				Total:      traffic.Total,
+				ExpiryTime: traffic.ExpiryTime,
+				Time:       now,
+			})
+		}
+
+		for _, event := range thresholds.getClientEvents(client, traffic, now) {
+			key := alertKey{client.Email, event}
+			if _, ok := alertMap[key]; ok {
+				delete(alertMap, key)
+				continue
+			}
+			notify(event)
+			saves = append(saves, &model.ClientAlert{Email: client.Email, Event: event, ExpiryTime: traffic.ExpiryTime, Time: now})
+		}
+
+		key := alertKey{client.Email, model.NotifyRenewed}
+		renewed, ok := alertMap[key]
+		delete(alertMap, key)
+		if ok && renewed.ExpiryTime == traffic.ExpiryTime {
+			continue
+		}
+		if ok && renewed.ExpiryTime > 0 && (traffic.ExpiryTime == 0 || traffic.ExpiryTime > renewed.ExpiryTime) {
+			notify(model.NotifyRenewed)
+		}
+		saves = append(saves, &model.ClientAlert{Email: client.Email, Event: model.NotifyRenewed, ExpiryTime: traffic.ExpiryTime, Time: now})
+	}
+
+	// the alerts left are conditions that cleared or belong to deleted clients
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, alert := range alertMap {
+			if err := tx.Delete(alert).Error; err != nil {
+				return err
+			}
+		}
+		for _, alert := range saves {
+			if err := tx.Save(alert).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !marked {
+		err = s.settingService.SetClientAlertsReady()
+		if err != nil {
+			return err
+		}
+	}
+	s.send(notifications)
+	return nil
+}
+
+// send delivers notifications through all enabled channels. A failing
+// channel does not keep the others from sending.
+func (s *NotifyService) send(notifications []*Notification) {
+	if len(notifications) == 0 {
+		return
+	}
+	for _, channel := range getNotifyChannels() {
+		if !channel.Enabled() {
+			continue
+		}
+		for _, notification := range notifications {
+			err := channel.Send(notification)
+			if err != nil {
+				logger.Warningf("send %v notification of %v by %v failed: %v", notification.Event, notification.Email, channel.Name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"testing"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/xray"
+)
+
+// recordChannel is a notification channel that keeps what it is sent.
+type recordChannel struct {
+	notifications []*Notification
+}
+
+func (c *recordChannel) Name() string  { return "record" }
+func (c *recordChannel) Enabled() bool { return true }
+func (c *recordChannel) Send(notification *Notification) error {
+	c.notifications = append(c.notifications, notification)
+	return nil
+}
+
+// TestCheckClientsEmptyPanel checks that the first clients of a panel that
+// started without any are notified about.
+func TestCheckClientsEmptyPanel(t *testing.T) {
+	channel := &recordChannel{}
+	RegisterNotifyChannel(channel)
+	s := &NotifyService{}
+
+	if err := s.CheckClients(); err != nil {
+		t.Fatal(err)
+	}
+	if ready, err := s.settingService.GetClientAlertsReady(); err != nil || !ready {
+		t.Fatalf("alerts not ready after the first check: %v, %v", ready, err)
+	}
+	if len(channel.notifications) != 0 {
+		t.Fatalf("first check sent %v notifications", len(channel.notifications))
+	}
+
+	db := database.GetDB()
+	inbound := addTestInbound(t, "notify", 42001, model.VLESS)
+	client := &model.Client{InboundId: inbound.Id, Email: "notify-a", Enable: true}
+	if err := db.Create(client).Error; err != nil {
+		t.Fatal(err)
+	}
+	traffic := &xray.ClientTraffic{InboundId: inbound.Id, Email: client.Email, Enable: true, Total: 100, Up: 200}
+	if err := db.Create(traffic).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CheckClients(); err != nil {
+		t.Fatal(err)
+	}
+	if len(channel.notifications) != 1 {
+		t.Fatalf("sent %v notifications, want 1", len(channel.notifications))
+	}
+	if n := channel.notifications[0]; n.Email != client.Email || n.Event != model.NotifyDepleted {
+		t.Errorf("sent %v of %v, want %v of %v", n.Event, n.Email, model.NotifyDepleted, client.Email)
+	}
+}
@@ -0,0 +1,235 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"time"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/xray"
+
+	"gorm.io/gorm"
+)
+
+// PlanService manages plans and provisions clients from them. A client
+// created or renewed from a plan takes its quota, validity, reset schedule,
+// speed limit, IP limit and flow, and remembers the plan in PlanId.
+type PlanService struct {
+	clientService ClientService
+}
+
+func (s *PlanService) GetPlans() ([]*model.Plan, error) {
+	db := database.GetDB()
+	plans := make([]*model.Plan, 0)
+	err := db.Model(model.Plan{}).Order("id").Find(&plans).Error
+	return plans, err
+}
+
+func (s *PlanService) GetPlan(id int) (*model.Plan, error) {
+	db := database.GetDB()
+	plan := &model.Plan{}
+	err := db.Model(model.Plan{}).Where("id = ?", id).First(plan).Error
+	if database.IsNotFound(err) {
+		return nil, common.NewErrorf("plan %v not found", id)
+	}
+	return plan, err
+}
+
+// checkPlanId fails when a client refers to a plan that does not exist.
+func checkPlanId(tx *gorm.DB, planId int) error {
+	if planId == 0 {
+		return nil
+	}
+	var count int64
+	err := tx.Model(model.Plan{}).Where("id = ?", planId).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return common.NewErrorf("plan %v not found", planId)
+	}
+	return nil
+}
+
+func (s *PlanService) checkPlan(tx *gorm.DB, plan *model.Plan) error {
+	plan.Name = strings.TrimSpace(plan.Name)
+	if plan.Name == "" {
+		return common.NewError("plan name is required")
+	}
+	var count int64
+	err := tx.Model(model.Plan{}).Where("name = ? AND id != ?", plan.Name, plan.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewErrorf("plan %v already exists", plan.Name)
+	}
+	if plan.TotalGB < 0 || plan.Days < 0 || plan.LimitIP < 0 {
+		return common.NewError("quota, days and IP limit can not be negative")
+	}
+	if err := checkSpeedLimit(plan.SpeedLimit); err != nil {
+		return err
+	}
+	if err := checkResetSchedule(&plan.TrafficReset, plan.ResetDay); err != nil {
+		return err
+	}
+
+	slices.Sort(plan.Inbounds)
+	plan.Inbounds = slices.Compact(plan.Inbounds)
+	if plan.Inbounds == nil {
+		plan.Inbounds = []int{}
+	}
+	for _, id := range plan.Inbounds {
+		if _, err := s.clientService.findInbound(tx, nil, id); err != nil {
+			return common.NewErrorf("inbound %v: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (s *PlanService) AddPlan(plan *model.Plan) error {
+	plan.Id = 0
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := s.checkPlan(tx, plan); err != nil {
+			return err
+		}
+		return tx.Create(plan).Error
+	})
+}
+
+// UpdatePlan changes a plan. With propagate the new limits are applied to all
+// clients of the plan; their expiry and usage are left unchanged.
+func (s *PlanService) UpdatePlan(plan *model.Plan, propagate bool) (bool, error) {
+	if _, err := s.GetPlan(plan.Id); err != nil {
+		return false, err
+	}
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := s.checkPlan(tx, plan); err != nil {
+			return err
+		}
+		return tx.Save(plan).Error
+	})
+	if err != nil || !propagate {
+		return false, err
+	}
+
+	var emails []string
+	err = db.Model(model.Client{}).Where("plan_id = ?", plan.Id).Pluck("email", &emails).Error
+	if err != nil || len(emails) == 0 {
+		return false, err
+	}
+	return s.clientService.eachClient(nil, emails, func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error {
+		applyPlan(client, plan)
+		return s.clientService.saveClient(tx, inbound, client)
+	})
+}
+
+// DelPlan deletes a plan. Its clients keep their limits.
+func (s *PlanService) DelPlan(id int) error {
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(model.Client{}).Where("plan_id = ?", id).Update("plan_id", 0).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(model.Plan{}, id).Error
+	})
+}
+
+// applyPlan sets the limits of a plan on a client.
+func applyPlan(client *model.Client, plan *model.Plan) {
+	client.PlanId = plan.Id
+	client.TotalGB = plan.TotalGB
+	client.TrafficReset = plan.TrafficReset
+	client.ResetDay = plan.ResetDay
+	client.SpeedLimit = plan.SpeedLimit
+	client.LimitIP = plan.LimitIP
+	client.Flow = plan.Flow
+}
+
+// AddPlanClients creates clients from a plan on one of its inbounds, the
+// first one when inboundId is 0, and links them to its other inbounds. Only
+// the emails and optional credentials of the given clients are used.
+func (s *PlanService) AddPlanClients(user *model.User, planId int, inboundId int, clients []model.Client) (bool, error) {
+	plan, err := s.GetPlan(planId)
+	if err != nil {
+		return false, err
+	}
+	if len(plan.Inbounds) == 0 {
+		return false, common.NewErrorf("plan %v has no inbounds", plan.Name)
+	}
+	if inboundId == 0 {
+		inboundId = plan.Inbounds[0]
+	}
+	if !slices.Contains(plan.Inbounds, inboundId) {
+		return false, common.NewErrorf("inbound %v is not part of plan %v", inboundId, plan.Name)
+	}
+
+	var expiryTime int64
+	if plan.Days > 0 {
+		expiryTime = time.Now().Unix()*1000 + int64(plan.Days)*86400000
+	}
+	for i := range clients {
+		client := &clients[i]
+		applyPlan(client, plan)
+		client.ExpiryTime = expiryTime
+		client.Reset = 0
+		client.Enable = true
+	}
+	linkIds := make([]int, 0, len(plan.Inbounds)-1)
+	for _, id := range plan.Inbounds {
+		if id != inboundId && !slices.Contains(linkIds, id) {
+			linkIds = append(linkIds, id)
+		}
+	}
+	return s.clientService.addClients(user, inboundId, linkIds, clients)
+}
+
+// RenewPlanClients renews clients from a plan, or from their own plan when
+// planId is 0: the plan limits are applied, the usage is cleared and the
+// validity is extended by the days of the plan.
+func (s *PlanService) RenewPlanClients(user *model.User, emails []string, planId int) (bool, error) {
+	plans := make(map[int]*model.Plan)
+	getPlan := func(id int) (*model.Plan, error) {
+		if plan, ok := plans[id]; ok {
+			return plan, nil
+		}
+		plan, err := s.GetPlan(id)
+		if err != nil {
+			return nil, err
+		}
+		plans[id] = plan
+		return plan, nil
+	}
+	return s.clientService.eachClient(user, emails, func(tx *gorm.DB, client *model.Client, inbound *model.Inbound) error {
+		id := planId
+		if id == 0 {
+			id = client.PlanId
+		}
+		if id == 0 {
+			return common.NewErrorf("client %v has no plan", client.Email)
+		}
+		plan, err := getPlan(id)
+		if err != nil {
+			return err
+		}
+		applyPlan(client, plan)
+		client.Enable = true
+		err = tx.Model(xray.ClientTraffic{}).Where("email = ?", client.Email).
+			Updates(map[string]interface{}{"up": 0, "down": 0}).Error
+		if err != nil {
+			return err
+		}
+		if plan.Days == 0 {
+			client.ExpiryTime = 0
+			return s.clientService.saveClient(tx, inbound, client)
+		}
+		if client.ExpiryTime == 0 {
+			client.ExpiryTime = time.Now().Unix() * 1000
+		}
+		return s.clientService.renewClient(tx, client, inbound, int64(plan.Days)*86400000)
+	})
+}
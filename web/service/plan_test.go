@@ -0,0 +1,102 @@
+package service
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+
+	"github.com/op/go-logging"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetBackend(logging.NewLogBackend(io.Discard, "", 0))
+	logger.InitLogger(logging.ERROR)
+	dir, err := os.MkdirTemp("", "x-ui-service")
+	if err != nil {
+		panic(err)
+	}
+	if err := database.InitDB(filepath.Join(dir, "x-ui.db")); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	if sqlDB, err := database.GetDB().DB(); err == nil {
+		sqlDB.Close()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func addTestInbound(t *testing.T, remark string, port int, protocol model.Protocol) *model.Inbound {
+	t.Helper()
+	inbound := &model.Inbound{
+		Remark:         remark,
+		Enable:         true,
+		Port:           port,
+		Protocol:       protocol,
+		Settings:       `{}`,
+		StreamSettings: `{"network":"tcp","security":"none"}`,
+		Tag:            "inbound-" + remark,
+	}
+	if protocol == model.VLESS {
+		inbound.Settings = `{"decryption":"none"}`
+	}
+	if err := database.GetDB().Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+	return inbound
+}
+
+func TestAddPlanClients(t *testing.T) {
+	db := database.GetDB()
+	vless := addTestInbound(t, "plan-vless", 41001, model.VLESS)
+	trojan := addTestInbound(t, "plan-trojan", 41002, model.Trojan)
+	vmess := addTestInbound(t, "plan-vmess", 41003, model.VMESS)
+	s := &PlanService{}
+	plan := &model.Plan{Name: "multi", TotalGB: 10 << 30, Days: 30, Inbounds: []int{vless.Id, trojan.Id, vmess.Id}}
+	if err := s.AddPlan(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.AddPlanClients(nil, plan.Id, trojan.Id, []model.Client{{Email: "plan-a"}, {Email: "plan-b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"plan-a", "plan-b"} {
+		client := &model.Client{}
+		if err := db.Where("email = ?", email).First(client).Error; err != nil {
+			t.Fatal(err)
+		}
+		if client.InboundId != trojan.Id || client.PlanId != plan.Id || client.TotalGB != plan.TotalGB {
+			t.Errorf("client %v = %+v", email, client)
+		}
+		if client.UUID == "" || client.Password == "" {
+			t.Errorf("client %v lacks the credentials of its inbounds: %+v", email, client)
+		}
+		var linked []int
+		err := db.Model(model.ClientInbound{}).Where("client_id = ?", client.Id).Order("inbound_id").Pluck("inbound_id", &linked).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(linked) != 2 || linked[0] != vless.Id || linked[1] != vmess.Id {
+			t.Errorf("client %v linked to %v, want %v and %v", email, linked, vless.Id, vmess.Id)
+		}
+	}
+
+	// A plan inbound that is gone fails the whole batch.
+	if err := db.Delete(vmess).Error; err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.AddPlanClients(nil, plan.Id, 0, []model.Client{{Email: "plan-c"}})
+	if err == nil {
+		t.Fatal("clients added to a plan with a deleted inbound")
+	}
+	var count int64
+	db.Model(model.Client{}).Where("email = ?", "plan-c").Count(&count)
+	if count != 0 {
+		t.Errorf("client plan-c created although linking failed")
+	}
+}
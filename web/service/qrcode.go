@@ -0,0 +1,62 @@
+package service
+
+import (
+	"strconv"
+
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/util/qrcode"
+)
+
+const (
+	qrDefaultSize  = 256
+	qrMinSize      = 64
+	qrMaxSize      = 2048
+	qrDefaultLevel = qrcode.Medium
+)
+
+// QRCodeService renders share links and subscription URLs as QR codes for
+// clients to scan into their apps.
+type QRCodeService struct{}
+
+// QROptions are how a QR code is rendered. Empty options take the defaults.
+type QROptions struct {
+	// Type is png or svg.
+	Type string `form:"type"`
+	// Size is the width and height of the image in pixels.
+	Size string `form:"size"`
+	// Level is the error correction level: L, M, Q or H.
+	Level string `form:"level"`
+}
+
+// Render returns a QR code of text as an image with its content type.
+func (s *QRCodeService) Render(text string, options QROptions) ([]byte, string, error) {
+	size := qrDefaultSize
+	if options.Size != "" {
+		var err error
+		size, err = strconv.Atoi(options.Size)
+		if err != nil || size < qrMinSize || size > qrMaxSize {
+			return nil, "", common.NewErrorf("invalid QR code size, must be %v to %v: %v", qrMinSize, qrMaxSize, options.Size)
+		}
+	}
+	level := qrDefaultLevel
+	if options.Level != "" {
+		var err error
+		level, err = qrcode.ParseLevel(options.Level)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	code, err := qrcode.Encode(text, level)
+	if err != nil {
+		return nil, "", err
+	}
+	switch options.Type {
+	case "", "png":
+		data, err := code.PNG(size)
+		return data, "image/png", err
+	case "svg":
+		return []byte(code.SVG(size)), "image/svg+xml", nil
+	}
+	return nil, "", common.NewErrorf("invalid QR code type, must be png or svg: %v", options.Type)
+}
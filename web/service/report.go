@@ -0,0 +1,332 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"x-ui-scratch/config"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/xray"
+)
+
+// ReportService builds usage reports per client, per inbound or per customer,
+// a customer being the part of the client email before a separator.
+type ReportService struct {
+	settingService SettingService
+	historyService HistoryService
+}
+
+// ReportQuery selects the usage to report. Without From and To the running
+// totals are reported; with them the daily traffic history in that range.
+type ReportQuery struct {
+	From      int64  `json:"from" form:"from"`
+	To        int64  `json:"to" form:"to"`
+	GroupBy   string `json:"groupBy" form:"groupBy"`
+	Separator string `json:"separator" form:"separator"`
+	Format    string `json:"format" form:"format"`
+}
+
+type ReportRow struct {
+	Key        string `json:"key"`
+	InboundId  int    `json:"inboundId"`
+	Remark     string `json:"remark"`
+	Clients    int    `json:"clients"`
+	Up         int64  `json:"up"`
+	Down       int64  `json:"down"`
+	Total      int64  `json:"total"`
+	Quota      int64  `json:"quota"`
+	ExpiryTime int64  `json:"expiryTime"`
+}
+
+type Report struct {
+	From        int64        `json:"from"`
+	To          int64        `json:"to"`
+	GroupBy     string       `json:"groupBy"`
+	GeneratedAt int64        `json:"generatedAt"`
+	Rows        []*ReportRow `json:"rows"`
+}
+
+const (
+	ReportByClient   = "client"
+	ReportByInbound  = "inbound"
+	ReportByCustomer = "customer"
+
+	ReportCSV  = "csv"
+	ReportJSON = "json"
+)
+
+type usage struct {
+	Up   int64
+	Down int64
+}
+
+func (q *ReportQuery) check() error {
+	switch q.GroupBy {
+	case "":
+		q.GroupBy = ReportByClient
+	case ReportByClient, ReportByInbound, ReportByCustomer:
+	default:
+		return common.NewErrorf("invalid report grouping: %v", q.GroupBy)
+	}
+	switch q.Format {
+	case "":
+		q.Format = ReportCSV
+	case ReportCSV, ReportJSON:
+	default:
+		return common.NewErrorf("invalid report format: %v", q.Format)
+	}
+	if q.Separator == "" {
+		q.Separator = "-"
+	}
+	if q.From < 0 || q.To < 0 || (q.To > 0 && q.From >= q.To) {
+		return common.NewError("invalid time range")
+	}
+	return nil
+}
+
+// getClientUsage returns the traffic per client email, from the history when
+// a range is given and from client_traffics otherwise.
+func (s *ReportService) getClientUsage(query *ReportQuery) (map[string]*usage, error) {
+	db := database.GetDB()
+	usages := make(map[string]*usage)
+	var rows []struct {
+		Email string
+		Up    int64
+		Down  int64
+	}
+	var err error
+	if query.To > 0 {
+		err = db.Model(model.TrafficHistory{}).
+			Select("email, SUM(up) AS up, SUM(down) AS down").
+			Where("period = ? AND email != '' AND time >= ? AND time < ?", model.PeriodDay, query.From, query.To).
+			Group("email").
+			Scan(&rows).Error
+	} else {
+		err = db.Model(xray.ClientTraffic{}).Select("email, up, down").Scan(&rows).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		usages[row.Email] = &usage{Up: row.Up, Down: row.Down}
+	}
+	return usages, nil
+}
+
+// getInboundUsage returns the traffic per inbound id, from the history when a
+// range is given and from the inbounds otherwise.
+func (s *ReportService) getInboundUsage(query *ReportQuery) (map[int]*usage, error) {
+	db := database.GetDB()
+	usages := make(map[int]*usage)
+	var rows []struct {
+		Id   int
+		Up   int64
+		Down int64
+	}
+	var err error
+	if query.To > 0 {
+		err = db.Model(model.TrafficHistory{}).
+			Select("inbound_id AS id, SUM(up) AS up, SUM(down) AS down").
+			Where("period = ? AND email = '' AND time >= ? AND time < ?", model.PeriodDay, query.From, query.To).
+			Group("inbound_id").
+			Scan(&rows).Error
+	} else {
+		err = db.Model(model.Inbound{}).Select("id, up, down").Scan(&rows).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		usages[row.Id] = &usage{Up: row.Up, Down: row.Down}
+	}
+	return usages, nil
+}
+
+// GetReport builds the usage report of the inbounds visible to the user. For
+// users who see every inbound, clients that were deleted but still have
+// history in the range are reported too.
+func (s *ReportService) GetReport(user *model.User, query *ReportQuery) (*Report, error) {
+	err := query.check()
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	err = scopeInbounds(db.Model(model.Inbound{}), user).Preload("Clients").Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		From:        query.From,
+		To:          query.To,
+		GroupBy:     query.GroupBy,
+		GeneratedAt: time.Now().UnixMilli(),
+	}
+	rows := make(map[string]*ReportRow)
+	add := func(key string, inbound *model.Inbound, client *model.Client, u *usage) {
+		row, ok := rows[key]
+		if !ok {
+			row = &ReportRow{Key: key}
+			rows[key] = row
+		}
+		if inbound != nil && query.GroupBy != ReportByCustomer {
+			row.InboundId = inbound.Id
+			row.Remark = inbound.Remark
+		}
+		if client != nil {
+			row.Clients++
+			row.Quota += client.TotalGB
+			if query.GroupBy == ReportByClient {
+				row.ExpiryTime = client.ExpiryTime
+			}
+		}
+		if u != nil {
+			row.Up += u.Up
+			row.Down += u.Down
+			row.Total = row.Up + row.Down
+		}
+	}
+
+	if query.GroupBy == ReportByInbound {
+		usages, err := s.getInboundUsage(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, inbound := range inbounds {
+			add(inbound.Tag, inbound, nil, usages[inbound.Id])
+			for i := range inbound.Clients {
+				add(inbound.Tag, inbound, &inbound.Clients[i], nil)
+			}
+		}
+	} else {
+		usages, err := s.getClientUsage(query)
+		if err != nil {
+			return nil, err
+		}
+		key := func(email string) string {
+			if query.GroupBy == ReportByCustomer {
+				customer, _, _ := strings.Cut(email, query.Separator)
+				return customer
+			}
+			return email
+		}
+		for _, inbound := range inbounds {
+			for i := range inbound.Clients {
+				client := &inbound.Clients[i]
+				add(key(client.Email), inbound, client, usages[client.Email])
+				delete(usages, client.Email)
+			}
+		}
+		if query.To > 0 && (user == nil || !user.IsScoped()) {
+			var emails []string
+			err = db.Model(model.Client{}).Pluck("email", &emails).Error
+			if err != nil {
+				return nil, err
+			}
+			for _, email := range emails {
+				delete(usages, email)
+			}
+			for email, u := range usages {
+				add(key(email), nil, nil, u)
+			}
+		}
+	}
+
+	report.Rows = make([]*ReportRow, 0, len(rows))
+	for _, row := range rows {
+		report.Rows = append(report.Rows, row)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool {
+		return report.Rows[i].Key < report.Rows[j].Key
+	})
+	return report, nil
+}
+
+// Encode renders the report in the given format.
+func (r *Report) Encode(format string) ([]byte, error) {
+	if format == ReportJSON {
+		return json.MarshalIndent(r, "", "  ")
+	}
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write([]string{r.GroupBy, "inboundId", "remark", "clients", "up", "down", "total", "quota", "expiryTime"})
+	for _, row := range r.Rows {
+		w.Write([]string{
+			row.Key,
+			strconv.Itoa(row.InboundId),
+			row.Remark,
+			strconv.Itoa(row.Clients),
+			strconv.FormatInt(row.Up, 10),
+			strconv.FormatInt(row.Down, 10),
+			strconv.FormatInt(row.Total, 10),
+			strconv.FormatInt(row.Quota, 10),
+			strconv.FormatInt(row.ExpiryTime, 10),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// WriteMonthlyReport writes the report of the previous month to the report
+// directory, if scheduled reports are enabled.
+func (s *ReportService) WriteMonthlyReport() error {
+	enable, err := s.settingService.GetReportEnable()
+	if err != nil || !enable {
+		return err
+	}
+	dir, err := s.settingService.GetReportDir()
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		dir = filepath.Join(config.GetDBFolderPath(), "reports")
+	}
+	query := &ReportQuery{}
+	query.GroupBy, err = s.settingService.GetReportGroupBy()
+	if err != nil {
+		return err
+	}
+	query.Format, err = s.settingService.GetReportFormat()
+	if err != nil {
+		return err
+	}
+
+	now, err := s.historyService.now()
+	if err != nil {
+		return err
+	}
+	month := bucketStart(now, model.PeriodMonth).AddDate(0, -1, 0)
+	query.From = month.UnixMilli()
+	query.To = nextBucket(month, model.PeriodMonth).UnixMilli()
+
+	report, err := s.GetReport(nil, query)
+	if err != nil {
+		return err
+	}
+	data, err := report.Encode(query.Format)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, "usage-"+query.GroupBy+"-"+month.Format("2006-01")+"."+query.Format)
+	err = os.WriteFile(name, data, 0o640)
+	if err != nil {
+		return err
+	}
+	logger.Info("Usage report written to", name)
+	return nil
+}
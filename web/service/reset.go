@@ -0,0 +1,206 @@
+package service
+
+import (
+	"time"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/xray"
+
+	"gorm.io/gorm"
+)
+
+// ResetService resets the traffic of inbounds and clients on their calendar
+// schedules and logs every reset in traffic_reset_logs.
+type ResetService struct {
+	settingService SettingService
+	inboundService InboundService
+	clientService  ClientService
+}
+
+// resetDueTime returns the latest time at or before now on which the
+// schedule resets.
+func resetDueTime(now time.Time, period model.ResetPeriod, day int) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch period {
+	case model.ResetWeekly:
+		return today.AddDate(0, 0, -((int(now.Weekday()) - day + 7) % 7))
+	case model.ResetMonthly:
+		monthDay := func(year int, month time.Month) time.Time {
+			last := time.Date(year, month+1, 0, 0, 0, 0, 0, now.Location()).Day()
+			return time.Date(year, month, min(day, last), 0, 0, 0, 0, now.Location())
+		}
+		due := monthDay(now.Year(), now.Month())
+		if due.After(now) {
+			due = monthDay(now.Year(), now.Month()-1)
+		}
+		return due
+	default:
+		return today
+	}
+}
+
+// isResetDue reports whether a reset is due for a schedule last run at
+// lastReset. A schedule that never ran is only started, not reset.
+func isResetDue(now time.Time, period model.ResetPeriod, day int, lastReset int64) bool {
+	if period == "" || period == model.ResetNever || lastReset == 0 {
+		return false
+	}
+	return lastReset < resetDueTime(now, period, day).UnixMilli()
+}
+
+// ResetTraffic runs the reset schedules that are due. It returns true when
+// Xray has to be restarted.
+func (s *ResetService) ResetTraffic() (bool, error) {
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().In(loc)
+
+	needRestart0, err := s.resetInbounds(now)
+	if err != nil {
+		return false, err
+	}
+	needRestart1, err := s.resetClients(now)
+	return needRestart0 || needRestart1, err
+}
+
+// startSchedules marks schedules that never ran as started now.
+func startSchedules(tx *gorm.DB, table string, now time.Time) error {
+	return tx.Table(table).
+		Where("traffic_reset != ? AND traffic_reset != '' AND last_traffic_reset_time = 0", model.ResetNever).
+		Update("last_traffic_reset_time", now.UnixMilli()).Error
+}
+
+func (s *ResetService) resetInbounds(now time.Time) (bool, error) {
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	err := db.Model(model.Inbound{}).
+		Where("traffic_reset != ? AND traffic_reset != '' AND last_traffic_reset_time > 0", model.ResetNever).
+		Find(&inbounds).Error
+	if err != nil {
+		return false, err
+	}
+
+	nowMilli := now.UnixMilli()
+	var enableIds []int
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, inbound := range inbounds {
+			if !isResetDue(now, inbound.TrafficReset, inbound.ResetDay, inbound.LastTrafficResetTime) {
+				continue
+			}
+			err := tx.Model(model.Inbound{}).Where("id = ?", inbound.Id).Updates(map[string]interface{}{
+				"up":                      0,
+				"down":                    0,
+				"last_traffic_reset_time": nowMilli,
+			}).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Create(&model.TrafficResetLog{
+				InboundId: inbound.Id,
+				Period:    inbound.TrafficReset,
+				Up:        inbound.Up,
+				Down:      inbound.Down,
+				Time:      nowMilli,
+			}).Error
+			if err != nil {
+				return err
+			}
+			logger.Infof("Inbound %v traffic reset (%v), up: %v, down: %v", inbound.Tag, inbound.TrafficReset, inbound.Up, inbound.Down)
+
+			// Enable inbounds again that were disabled for running out of traffic
+			expired := inbound.ExpiryTime > 0 && inbound.ExpiryTime <= nowMilli
+			depleted := inbound.Total > 0 && inbound.Up+inbound.Down >= inbound.Total
+			if !inbound.Enable && depleted && !expired {
+				enableIds = append(enableIds, inbound.Id)
+			}
+		}
+		return startSchedules(tx, "inbounds", now)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	needRestart := false
+	for _, id := range enableIds {
+		restart, err := s.inboundService.SetInboundEnable(nil, id, true)
+		if err != nil {
+			logger.Warning("Error in enabling inbound after traffic reset:", err)
+		}
+		needRestart = needRestart || restart
+	}
+	return needRestart, nil
+}
+
+func (s *ResetService) resetClients(now time.Time) (bool, error) {
+	db := database.GetDB()
+	var clients []*model.Client
+	err := db.Model(model.Client{}).
+		Where("traffic_reset != ? AND traffic_reset != '' AND last_traffic_reset_time > 0", model.ResetNever).
+		Find(&clients).Error
+	if err != nil {
+		return false, err
+	}
+	var emails []string
+	for _, client := range clients {
+		if isResetDue(now, client.TrafficReset, client.ResetDay, client.LastTrafficResetTime) {
+			emails = append(emails, client.Email)
+		}
+	}
+
+	nowMilli := now.UnixMilli()
+	return s.clientService.updateClients(emails, func(tx *gorm.DB) error {
+		for _, email := range emails {
+			client, inbound, err := s.clientService.findClient(tx, nil, email)
+			if err != nil {
+				return err
+			}
+			traffic := &xray.ClientTraffic{}
+			err = tx.Model(xray.ClientTraffic{}).Where("email = ?", email).First(traffic).Error
+			if err != nil && !database.IsNotFound(err) {
+				return err
+			}
+			err = tx.Model(xray.ClientTraffic{}).Where("email = ?", email).
+				Updates(map[string]interface{}{"up": 0, "down": 0}).Error
+			if err != nil {
+				return err
+			}
+			client.LastTrafficResetTime = nowMilli
+			err = s.clientService.saveClient(tx, inbound, client)
+			if err != nil {
+				return err
+			}
+			err = tx.Create(&model.TrafficResetLog{
+				InboundId: inbound.Id,
+				Email:     email,
+				Period:    client.TrafficReset,
+				Up:        traffic.Up,
+				Down:      traffic.Down,
+				Time:      nowMilli,
+			}).Error
+			if err != nil {
+				return err
+			}
+			logger.Infof("Client %v traffic reset (%v), up: %v, down: %v", email, client.TrafficReset, traffic.Up, traffic.Down)
+		}
+		return startSchedules(tx, "clients", now)
+	})
+}
+
+// GetResetLogs returns the latest traffic resets of the inbounds visible to
+// the user and their clients.
+func (s *ResetService) GetResetLogs(user *model.User, limit int) ([]*model.TrafficResetLog, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	db := database.GetDB()
+	tx := db.Model(model.TrafficResetLog{})
+	if user.IsScoped() {
+		tx = scopeInbounds(tx.Joins("JOIN inbounds ON inbounds.id = traffic_reset_logs.inbound_id"), user)
+	}
+	logs := make([]*model.TrafficResetLog, 0)
+	err := tx.Select("traffic_reset_logs.*").Order("traffic_reset_logs.id DESC").Limit(limit).Find(&logs).Error
+	return logs, err
+}
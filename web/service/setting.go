@@ -2,6 +2,9 @@ package service
 
 import (
 	_ "embed"
+	"encoding/json"
+	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -21,7 +24,57 @@ var defaultValueMap = map[string]string{
 
 	"webBasePath": "/",
 
-	"tgLang": "en-US",
+	"tgBotEnable":      "false",
+	"tgBotToken":       "",
+	"tgBotProxy":       "",
+	"tgBotAPIServer":   "https://api.telegram.org",
+	"tgBotChatId":      "",
+	"tgRunTime":        "@daily",
+	"tgBotBackup":      "false",
+	"tgBotLoginNotify": "true",
+	"tgLang":           "en-US",
+
+	"subEnable":   "false",
+	"subListen":   "",
+	"subPort":     "2096",
+	"subPath":     "/sub/",
+	"subDomain":   "",
+	"subCertFile": "",
+	"subKeyFile":  "",
+	"subUpdates":  "12",
+	"subEncrypt":  "true",
+	"subShowInfo": "true",
+	"subURI":      "",
+	"subTitle":    "",
+	"subSupport":  "",
+
+	"subTokenRequired":      "false",
+	"subTokenTTL":           "720",
+	"subAccessLogRetention": "30",
+	"subSuspiciousIps":      "5",
+	"subTrustedProxies":     "",
+
+	"subJsonPath":     "/json/",
+	"subJsonURI":      "",
+	"subJsonFragment": "",
+	"subJsonNoises":   "",
+	"subJsonMux":      "",
+	"subJsonRules":    "",
+
+	"subClashRules": "GEOIP,private,DIRECT,no-resolve\nMATCH,PROXY",
+
+	"subSingboxDns":   "",
+	"subSingboxRoute": "",
+
+	"smtpEnable":   "false",
+	"smtpHost":     "",
+	"smtpPort":     "587",
+	"smtpSecurity": "starttls",
+	"smtpUsername": "",
+	"smtpPassword": "",
+	"smtpFrom":     "",
+	"smtpAdmins":   "",
+	"smtpLang":     "en-US",
 
 	"secret": random.Seq(32),
 
@@ -30,6 +83,27 @@ var defaultValueMap = map[string]string{
 
 	"secretEnable":       "false",
 	"xrayTemplateConfig": xrayTemplateConfig,
+
+	"historyHourRetention":  "7",
+	"historyDayRetention":   "400",
+	"historyMonthRetention": "0",
+
+	"reportEnable":  "false",
+	"reportDir":     "",
+	"reportGroupBy": "client",
+	"reportFormat":  "csv",
+
+	"expireDiff":         "0",
+	"trafficDiff":        "0",
+	"trafficWarnPercent": "0",
+	"clientAlertsReady":  "false",
+
+	"webhookLogRetention": "30",
+
+	"speedLimitPort":     "62790",
+	"speedReturnPort":    "62791",
+	"quotaThrottleSpeed": "131072",
+	"quotaRedirect":      "",
 }
 
 //go:embed config.json
@@ -106,6 +180,138 @@ func (s *SettingService) saveSetting(key string, value string) error {
 	return db.Save(setting).Error
 }
 
+// settingKind is the kind of value a setting takes.
+type settingKind int
+
+const (
+	settingString settingKind = iota
+	settingInt
+	settingBool
+	// settingObject and settingArray are JSON, or empty for none.
+	settingObject
+	settingArray
+	// settingAddresses are IPs and CIDRs separated by commas.
+	settingAddresses
+)
+
+// updatableSettings are the settings UpdateSettings can change.
+var updatableSettings = map[string]settingKind{
+	"tgBotEnable":      settingBool,
+	"tgBotToken":       settingString,
+	"tgBotProxy":       settingString,
+	"tgBotAPIServer":   settingString,
+	"tgBotChatId":      settingString,
+	"tgRunTime":        settingString,
+	"tgBotBackup":      settingBool,
+	"tgBotLoginNotify": settingBool,
+	"tgLang":           settingString,
+
+	"smtpEnable":   settingBool,
+	"smtpHost":     settingString,
+	"smtpPort":     settingInt,
+	"smtpSecurity": settingString,
+	"smtpUsername": settingString,
+	"smtpPassword": settingString,
+	"smtpFrom":     settingString,
+	"smtpAdmins":   settingString,
+	"smtpLang":     settingString,
+
+	"subEnable":   settingBool,
+	"subListen":   settingString,
+	"subPort":     settingInt,
+	"subPath":     settingString,
+	"subDomain":   settingString,
+	"subCertFile": settingString,
+	"subKeyFile":  settingString,
+	"subUpdates":  settingInt,
+	"subEncrypt":  settingBool,
+	"subShowInfo": settingBool,
+	"subURI":      settingString,
+	"subTitle":    settingString,
+	"subSupport":  settingString,
+
+	"subTokenRequired":      settingBool,
+	"subTokenTTL":           settingInt,
+	"subAccessLogRetention": settingInt,
+	"subSuspiciousIps":      settingInt,
+	"subTrustedProxies":     settingAddresses,
+
+	"subJsonPath":     settingString,
+	"subJsonURI":      settingString,
+	"subJsonFragment": settingObject,
+	"subJsonNoises":   settingObject,
+	"subJsonMux":      settingObject,
+	"subJsonRules":    settingArray,
+
+	"subClashRules": settingString,
+
+	"subSingboxDns":   settingObject,
+	"subSingboxRoute": settingObject,
+}
+
+// settingChoices are the values settings limited to a few of them take.
+var settingChoices = map[string][]string{
+	"smtpSecurity": {smtpStartTLS, smtpTLS, smtpNone},
+}
+
+// UpdateSettings saves the given settings. Nothing is saved unless every
+// setting can be updated and has a value of its kind.
+func (s *SettingService) UpdateSettings(settings map[string]string) error {
+	for key, value := range settings {
+		kind, ok := updatableSettings[key]
+		if !ok {
+			return common.NewErrorf("setting <%v> can not be updated", key)
+		}
+		var err error
+		switch kind {
+		case settingInt:
+			_, err = strconv.Atoi(value)
+		case settingBool:
+			_, err = strconv.ParseBool(value)
+		case settingObject:
+			if value != "" {
+				err = json.Unmarshal([]byte(value), &map[string]interface{}{})
+			}
+		case settingArray:
+			if value != "" {
+				err = json.Unmarshal([]byte(value), &[]interface{}{})
+			}
+		case settingAddresses:
+			for _, address := range splitList(value) {
+				if net.ParseIP(address) == nil {
+					_, _, err = net.ParseCIDR(address)
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		choices, limited := settingChoices[key]
+		if err != nil || limited && !slices.Contains(choices, value) {
+			return common.NewErrorf("invalid value of setting <%v>: %v", key, value)
+		}
+	}
+	for key, value := range settings {
+		err := s.saveSetting(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitList returns the items of a comma separated list, without blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func (s *SettingService) GetBasePath() (string, error) {
 	basePath, err := s.getString("webBasePath")
 	if err != nil {
@@ -124,6 +330,264 @@ func (s *SettingService) GetTgLang() (string, error) {
 	return s.getString("tgLang")
 }
 
+func (s *SettingService) GetTgbotEnabled() (bool, error) {
+	return s.getBool("tgBotEnable")
+}
+
+func (s *SettingService) GetTgBotToken() (string, error) {
+	return s.getString("tgBotToken")
+}
+
+// GetTgBotProxy returns the proxy URL the bot connects to Telegram through,
+// empty meaning a direct connection.
+func (s *SettingService) GetTgBotProxy() (string, error) {
+	return s.getString("tgBotProxy")
+}
+
+// GetTgBotAPIServer returns the base URL of the Telegram Bot API, which can
+// point to a self-hosted Bot API server.
+func (s *SettingService) GetTgBotAPIServer() (string, error) {
+	return s.getString("tgBotAPIServer")
+}
+
+// GetTgBotChatId returns the comma-separated chat ids of the admins.
+func (s *SettingService) GetTgBotChatId() (string, error) {
+	return s.getString("tgBotChatId")
+}
+
+// GetTgRunTime returns the cron spec of the periodic bot report.
+func (s *SettingService) GetTgRunTime() (string, error) {
+	return s.getString("tgRunTime")
+}
+
+func (s *SettingService) GetTgBotBackup() (bool, error) {
+	return s.getBool("tgBotBackup")
+}
+
+func (s *SettingService) GetTgBotLoginNotify() (bool, error) {
+	return s.getBool("tgBotLoginNotify")
+}
+
+func (s *SettingService) GetSubEnable() (bool, error) {
+	return s.getBool("subEnable")
+}
+
+func (s *SettingService) GetSubListen() (string, error) {
+	return s.getString("subListen")
+}
+
+func (s *SettingService) GetSubPort() (int, error) {
+	return s.getInt("subPort")
+}
+
+// GetSubPath returns the path subscriptions are served under, with a leading
+// and a trailing slash.
+func (s *SettingService) GetSubPath() (string, error) {
+	subPath, err := s.getString("subPath")
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(subPath, "/") {
+		subPath = "/" + subPath
+	}
+	if !strings.HasSuffix(subPath, "/") {
+		subPath += "/"
+	}
+	return subPath, nil
+}
+
+// GetSubDomain returns the only domain the subscription server answers on,
+// empty meaning any.
+func (s *SettingService) GetSubDomain() (string, error) {
+	return s.getString("subDomain")
+}
+
+func (s *SettingService) GetSubCertFile() (string, error) {
+	return s.getString("subCertFile")
+}
+
+func (s *SettingService) GetSubKeyFile() (string, error) {
+	return s.getString("subKeyFile")
+}
+
+// GetSubUpdates returns the interval in hours clients are told to update
+// their subscription at.
+func (s *SettingService) GetSubUpdates() (int, error) {
+	return s.getInt("subUpdates")
+}
+
+// GetSubEncrypt reports whether subscriptions are base64 encoded.
+func (s *SettingService) GetSubEncrypt() (bool, error) {
+	return s.getBool("subEncrypt")
+}
+
+// GetSubShowInfo reports whether the remaining traffic and days are shown in
+// the remarks of the subscription links.
+func (s *SettingService) GetSubShowInfo() (bool, error) {
+	return s.getBool("subShowInfo")
+}
+
+// GetSubURI returns the public URI of the subscriptions, such as when they are
+// served behind a reverse proxy. When empty it is derived from the
+// subscription server settings.
+func (s *SettingService) GetSubURI() (string, error) {
+	return s.getString("subURI")
+}
+
+// GetSubTitle returns the name client apps show for subscriptions, empty
+// meaning the apps choose one.
+func (s *SettingService) GetSubTitle() (string, error) {
+	return s.getString("subTitle")
+}
+
+// GetSubSupport returns the URL clients reach support at, empty meaning
+// none.
+func (s *SettingService) GetSubSupport() (string, error) {
+	return s.getString("subSupport")
+}
+
+// GetSubTokenRequired reports whether subscriptions are only served with a
+// valid signed token.
+func (s *SettingService) GetSubTokenRequired() (bool, error) {
+	return s.getBool("subTokenRequired")
+}
+
+// GetSubTokenTTL returns for how many hours subscription tokens are valid by
+// default.
+func (s *SettingService) GetSubTokenTTL() (int, error) {
+	return s.getInt("subTokenTTL")
+}
+
+// GetSubAccessLogRetention returns for how many days subscription fetches are
+// logged, 0 meaning forever.
+func (s *SettingService) GetSubAccessLogRetention() (int, error) {
+	return s.getInt("subAccessLogRetention")
+}
+
+// GetSubSuspiciousIps returns from how many IPs a day a subscription is
+// fetched before it is reported as suspicious.
+func (s *SettingService) GetSubSuspiciousIps() (int, error) {
+	return s.getInt("subSuspiciousIps")
+}
+
+// GetSubTrustedProxies returns the IPs and CIDRs of the reverse proxies the
+// subscription server takes the addresses of clients from.
+func (s *SettingService) GetSubTrustedProxies() ([]string, error) {
+	value, err := s.getString("subTrustedProxies")
+	if err != nil {
+		return nil, err
+	}
+	return splitList(value), nil
+}
+
+// GetSubJsonPath returns the path JSON subscriptions are served under, with a
+// leading and a trailing slash.
+func (s *SettingService) GetSubJsonPath() (string, error) {
+	subJsonPath, err := s.getString("subJsonPath")
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(subJsonPath, "/") {
+		subJsonPath = "/" + subJsonPath
+	}
+	if !strings.HasSuffix(subJsonPath, "/") {
+		subJsonPath += "/"
+	}
+	return subJsonPath, nil
+}
+
+// GetSubJsonURI returns the public URI of the JSON subscriptions. When empty
+// it is derived from the subscription server settings.
+func (s *SettingService) GetSubJsonURI() (string, error) {
+	return s.getString("subJsonURI")
+}
+
+// GetSubJsonFragment returns the freedom outbound, as JSON, that fragments
+// the connections of JSON subscription configs, empty meaning none.
+func (s *SettingService) GetSubJsonFragment() (string, error) {
+	return s.getString("subJsonFragment")
+}
+
+// GetSubJsonNoises returns the freedom outbound, as JSON, whose noises are
+// sent ahead of the UDP connections of JSON subscription configs, empty
+// meaning none.
+func (s *SettingService) GetSubJsonNoises() (string, error) {
+	return s.getString("subJsonNoises")
+}
+
+// GetSubJsonMux returns the mux settings, as JSON, of the proxy outbound of
+// JSON subscription configs, empty meaning no mux.
+func (s *SettingService) GetSubJsonMux() (string, error) {
+	return s.getString("subJsonMux")
+}
+
+// GetSubJsonRules returns a JSON array of routing rules sending traffic
+// direct in JSON subscription configs, such as domestic sites.
+func (s *SettingService) GetSubJsonRules() (string, error) {
+	return s.getString("subJsonRules")
+}
+
+// GetSubClashRules returns the rules of Clash subscriptions, one per line.
+// They can refer to the PROXY and AUTO proxy groups.
+func (s *SettingService) GetSubClashRules() (string, error) {
+	return s.getString("subClashRules")
+}
+
+// GetSubSingboxDns returns the dns object of sing-box subscriptions as JSON,
+// or an empty string for the default one.
+func (s *SettingService) GetSubSingboxDns() (string, error) {
+	return s.getString("subSingboxDns")
+}
+
+// GetSubSingboxRoute returns the route object of sing-box subscriptions as
+// JSON, or an empty string for the default one. Its rules can refer to the
+// proxy, auto, direct and block outbounds.
+func (s *SettingService) GetSubSingboxRoute() (string, error) {
+	return s.getString("subSingboxRoute")
+}
+
+func (s *SettingService) GetSmtpEnable() (bool, error) {
+	return s.getBool("smtpEnable")
+}
+
+func (s *SettingService) GetSmtpHost() (string, error) {
+	return s.getString("smtpHost")
+}
+
+func (s *SettingService) GetSmtpPort() (int, error) {
+	return s.getInt("smtpPort")
+}
+
+// GetSmtpSecurity returns how the connection to the SMTP server is secured:
+// "starttls", "tls" for implicit TLS, or "none".
+func (s *SettingService) GetSmtpSecurity() (string, error) {
+	return s.getString("smtpSecurity")
+}
+
+// GetSmtpUsername returns the SMTP login, empty meaning no authentication.
+func (s *SettingService) GetSmtpUsername() (string, error) {
+	return s.getString("smtpUsername")
+}
+
+func (s *SettingService) GetSmtpPassword() (string, error) {
+	return s.getString("smtpPassword")
+}
+
+// GetSmtpFrom returns the From address of the emails, such as
+// "Panel <panel@example.com>".
+func (s *SettingService) GetSmtpFrom() (string, error) {
+	return s.getString("smtpFrom")
+}
+
+// GetSmtpAdmins returns the comma-separated email addresses of the admins.
+func (s *SettingService) GetSmtpAdmins() (string, error) {
+	return s.getString("smtpAdmins")
+}
+
+func (s *SettingService) GetSmtpLang() (string, error) {
+	return s.getString("smtpLang")
+}
+
 func (s *SettingService) GetListen() (string, error) {
 	return s.getString("webListen")
 }
@@ -158,6 +622,96 @@ func (s *SettingService) getBool(key string) (bool, error) {
 	return strconv.ParseBool(str)
 }
 
+// GetHistoryHourRetention returns for how many days hourly traffic history is kept.
+func (s *SettingService) GetHistoryHourRetention() (int, error) {
+	return s.getInt("historyHourRetention")
+}
+
+// GetHistoryDayRetention returns for how many days daily traffic history is kept.
+func (s *SettingService) GetHistoryDayRetention() (int, error) {
+	return s.getInt("historyDayRetention")
+}
+
+// GetHistoryMonthRetention returns for how many days monthly traffic history
+// is kept, 0 meaning forever.
+func (s *SettingService) GetHistoryMonthRetention() (int, error) {
+	return s.getInt("historyMonthRetention")
+}
+
+func (s *SettingService) GetReportEnable() (bool, error) {
+	return s.getBool("reportEnable")
+}
+
+// GetReportDir returns the directory monthly reports are written to, empty
+// meaning the reports folder next to the database.
+func (s *SettingService) GetReportDir() (string, error) {
+	return s.getString("reportDir")
+}
+
+func (s *SettingService) GetReportGroupBy() (string, error) {
+	return s.getString("reportGroupBy")
+}
+
+func (s *SettingService) GetReportFormat() (string, error) {
+	return s.getString("reportFormat")
+}
+
+// GetExpireDiff returns how many days before expiry clients are warned, 0
+// meaning never.
+func (s *SettingService) GetExpireDiff() (int, error) {
+	return s.getInt("expireDiff")
+}
+
+// GetTrafficDiff returns how many GB of remaining quota clients are warned
+// at, 0 meaning never.
+func (s *SettingService) GetTrafficDiff() (int, error) {
+	return s.getInt("trafficDiff")
+}
+
+// GetTrafficWarnPercent returns the percentage of their quota clients are
+// warned at, 0 meaning never.
+func (s *SettingService) GetTrafficWarnPercent() (int, error) {
+	return s.getInt("trafficWarnPercent")
+}
+
+// GetClientAlertsReady reports whether the conditions of the clients were
+// recorded once, so the ones that start to hold are notified.
+func (s *SettingService) GetClientAlertsReady() (bool, error) {
+	return s.getBool("clientAlertsReady")
+}
+
+func (s *SettingService) SetClientAlertsReady() error {
+	return s.saveSetting("clientAlertsReady", "true")
+}
+
+// GetWebhookLogRetention returns for how many days finished webhook
+// deliveries are kept, 0 meaning forever.
+func (s *SettingService) GetWebhookLogRetention() (int, error) {
+	return s.getInt("webhookLogRetention")
+}
+
+func (s *SettingService) GetSpeedLimitPort() (int, error) {
+	return s.getInt("speedLimitPort")
+}
+
+// GetSpeedReturnPort returns the localhost port of the Xray inbound the
+// shaper sends shaped traffic back through.
+func (s *SettingService) GetSpeedReturnPort() (int, error) {
+	return s.getInt("speedReturnPort")
+}
+
+// GetQuotaThrottleSpeed returns the speed in bytes per second of clients
+// throttled for exceeding their quota, 0 meaning no throttling.
+func (s *SettingService) GetQuotaThrottleSpeed() (int, error) {
+	return s.getInt("quotaThrottleSpeed")
+}
+
+// GetQuotaRedirect returns the host:port the quota-exceeded outbound sends
+// all connections to, such as a top-up page. When empty it blocks them.
+func (s *SettingService) GetQuotaRedirect() (string, error) {
+	return s.getString("quotaRedirect")
+}
+
 func (s *SettingService) GetXrayConfigTemplate() (string, error) {
 	return s.getString("xrayTemplateConfig")
 }
@@ -165,15 +719,15 @@ func (s *SettingService) GetXrayConfigTemplate() (string, error) {
 func (s *SettingService) GetDefaultSettings(host string) (interface{}, error) {
 	type settingFunc func() (interface{}, error)
 	settings := map[string]settingFunc{
-		/* "expireDiff":    func() (interface{}, error) { return s.GetExpireDiff() },
-		"trafficDiff":   func() (interface{}, error) { return s.GetTrafficDiff() },
-		"pageSize":      func() (interface{}, error) { return s.GetPageSize() },
+		"expireDiff":  func() (interface{}, error) { return s.GetExpireDiff() },
+		"trafficDiff": func() (interface{}, error) { return s.GetTrafficDiff() },
+		"tgBotEnable": func() (interface{}, error) { return s.GetTgbotEnabled() },
+		"subEnable":   func() (interface{}, error) { return s.GetSubEnable() },
+		"subURI":      func() (interface{}, error) { return s.GetSubURI() },
+		"subJsonURI":  func() (interface{}, error) { return s.GetSubJsonURI() },
+		/* "pageSize":      func() (interface{}, error) { return s.GetPageSize() },
 		"defaultCert":   func() (interface{}, error) { return s.GetCertFile() },
 		"defaultKey":    func() (interface{}, error) { return s.GetKeyFile() },
-		"tgBotEnable":   func() (interface{}, error) { return s.GetTgbotEnabled() },
-		"subEnable":     func() (interface{}, error) { return s.GetSubEnable() },
-		"subURI":        func() (interface{}, error) { return s.GetSubURI() },
-		"subJsonURI":    func() (interface{}, error) { return s.GetSubJsonURI() },
 		"remarkModel":   func() (interface{}, error) { return s.GetRemarkModel() },
 		"datepicker":    func() (interface{}, error) { return s.GetDatepicker() },
 		"ipLimitEnable": func() (interface{}, error) { return s.GetIpLimitEnable() }, */
@@ -189,39 +743,66 @@ func (s *SettingService) GetDefaultSettings(host string) (interface{}, error) {
 		result[key] = value
 	}
 
-	// todo: to complement the code.
-	if result["subEnable"].(bool) && (result["subURI"].(string) == "" || result["subJsonURI"].(string) == "") {
-		// subURI := ""
-		/* subPort, _ := s.GetSubPort()
-		subPath, _ := s.GetSubPath()
-		subJsonPath, _ := s.GetSubJsonPath()
-		subDomain, _ := s.GetSubDomain()
-		subKeyFile, _ := s.GetSubKeyFile()
-		subCertFile, _ := s.GetSubCertFile()
-		subTLS := false
-		if subKeyFile != "" && subCertFile != "" {
-			subTLS = true
-		}
-		if subDomain == "" {
-			subDomain = strings.Split(host, ":")[0]
+	if subEnable, _ := result["subEnable"].(bool); subEnable && (result["subURI"].(string) == "" || result["subJsonURI"].(string) == "") {
+		subURI, err := s.getSubBaseURI(host)
+		if err != nil {
+			return "", err
 		}
-		if subTLS {
-			subURI = "https://"
-		} else {
-			subURI = "http://"
+		subPath, err := s.GetSubPath()
+		if err != nil {
+			return "", err
 		}
-		if (subPort == 443 && subTLS) || (subPort == 80 && !subTLS) {
-			subURI += subDomain
-		} else {
-			subURI += fmt.Sprintf("%s:%d", subDomain, subPort)
+		subJsonPath, err := s.GetSubJsonPath()
+		if err != nil {
+			return "", err
 		}
 		if result["subURI"].(string) == "" {
 			result["subURI"] = subURI + subPath
 		}
 		if result["subJsonURI"].(string) == "" {
 			result["subJsonURI"] = subURI + subJsonPath
-		} */
+		}
 	}
 
 	return result, nil
 }
+
+// getSubBaseURI returns the scheme and authority the subscription server is
+// reached at, using the host the panel is reached at when no subscription
+// domain is set.
+func (s *SettingService) getSubBaseURI(host string) (string, error) {
+	subPort, err := s.GetSubPort()
+	if err != nil {
+		return "", err
+	}
+	subDomain, err := s.GetSubDomain()
+	if err != nil {
+		return "", err
+	}
+	subCertFile, err := s.GetSubCertFile()
+	if err != nil {
+		return "", err
+	}
+	subKeyFile, err := s.GetSubKeyFile()
+	if err != nil {
+		return "", err
+	}
+	subTLS := subCertFile != "" && subKeyFile != ""
+	if subDomain == "" {
+		subDomain = host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			subDomain = h
+		}
+	}
+	subURI := "http://"
+	if subTLS {
+		subURI = "https://"
+	}
+	if (subPort == 443 && subTLS) || (subPort == 80 && !subTLS) {
+		if strings.Contains(subDomain, ":") {
+			subDomain = "[" + subDomain + "]"
+		}
+		return subURI + subDomain, nil
+	}
+	return subURI + net.JoinHostPort(subDomain, strconv.Itoa(subPort)), nil
+}
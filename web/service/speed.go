@@ -0,0 +1,554 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/xray"
+	"x-ui-scratch/xray/shaper"
+
+	"gorm.io/gorm"
+)
+
+// SpeedService enforces the speed limits of clients and inbounds and the soft
+// quota actions of clients. Xray policy levels cannot limit bandwidth, so the
+// panel runs a shaper on localhost: every limited client and inbound gets a
+// socks outbound to it and a routing rule sending its traffic there, and the
+// shaper passes that traffic through token buckets. Clients throttled for
+// exceeding their quota are limited the same way; clients redirected for it
+// are routed to the quota-exceeded outbound.
+//
+// The shaper sends the traffic back into Xray through the speed-return socks
+// inbound, where the rules of the config template pick its outbound as for
+// any other traffic. Template rules matching a user or an inbound tag do not
+// see it there, as it arrives without them.
+//
+// The rules come before those of the config template: the quota rule first,
+// then client rules before inbound rules, so a limited client of a limited
+// inbound passes both buckets.
+type SpeedService struct {
+	settingService SettingService
+	xrayAPI        xray.XrayAPI
+}
+
+// speedTarget is an outbound the panel adds to Xray together with the rule
+// routing traffic to it.
+type speedTarget struct {
+	tag      string
+	outbound string
+	rule     string
+}
+
+const (
+	quotaTag       = "quota-exceeded"
+	speedReturnTag = "speed-return"
+)
+
+var (
+	shaperServer *shaper.Server
+	speedLock    sync.Mutex
+	// speedTargets are the targets of the running Xray.
+	speedTargets []speedTarget
+)
+
+func speedTag(user string) string {
+	return "speed-" + user
+}
+
+func shaperPassword(secret []byte, user string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkSpeedLimit(limit int64) error {
+	if limit < 0 {
+		return common.NewErrorf("invalid speed limit: %v", limit)
+	}
+	return nil
+}
+
+// StartShaper starts the shaper on the speedLimitPort of localhost.
+func (s *SpeedService) StartShaper() error {
+	port, err := s.settingService.GetSpeedLimitPort()
+	if err != nil {
+		return err
+	}
+	returnPort, err := s.settingService.GetSpeedReturnPort()
+	if err != nil {
+		return err
+	}
+	secret, err := s.settingService.GetSecret()
+	if err != nil {
+		return err
+	}
+	server := shaper.NewServer(func(user string) string {
+		return shaperPassword(secret, user)
+	}, s.resolve, shaper.Upstream{
+		Addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(returnPort)),
+		User: speedReturnTag,
+		Pass: shaperPassword(secret, speedReturnTag),
+	})
+	err = server.Start(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	shaperServer = server
+	logger.Info("Speed limit shaper running on port", port)
+	return nil
+}
+
+func (s *SpeedService) StopShaper() error {
+	if shaperServer == nil {
+		return nil
+	}
+	err := shaperServer.Close()
+	shaperServer = nil
+	return err
+}
+
+// resolve returns the limits of a shaper user. Clients pass their own bucket
+// and the one of their inbound, which all traffic of the inbound shares.
+func (s *SpeedService) resolve(user string) ([]shaper.Limit, error) {
+	kind, idString, _ := strings.Cut(user, "-")
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		return nil, common.NewErrorf("unknown shaper user: %v", user)
+	}
+	db := database.GetDB()
+	var limits []shaper.Limit
+	inboundId := id
+	switch kind {
+	case "client":
+		client := &model.Client{}
+		err = db.Model(model.Client{}).Where("id = ?", id).First(client).Error
+		if err != nil {
+			return nil, err
+		}
+		rate, err := s.getClientRate(db, client)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, shaper.Limit{Key: user, Rate: rate})
+		inboundId = client.InboundId
+	case "inbound":
+	default:
+		return nil, common.NewErrorf("unknown shaper user: %v", user)
+	}
+	inbound := &model.Inbound{}
+	err = db.Model(model.Inbound{}).Select("speed_limit").Where("id = ?", inboundId).First(inbound).Error
+	if err != nil {
+		return nil, err
+	}
+	limits = append(limits, shaper.Limit{Key: "inbound-" + strconv.Itoa(inboundId), Rate: inbound.SpeedLimit})
+	return limits, nil
+}
+
+// getCutActions returns the quota actions of clients that are cut off when
+// they exceed their quota. Throttled clients are cut as well while they can
+// not be throttled, without a quota throttle speed or a running shaper.
+func (s *SpeedService) getCutActions() ([]model.QuotaAction, error) {
+	actions := []model.QuotaAction{model.QuotaCut, ""}
+	throttle, err := s.settingService.GetQuotaThrottleSpeed()
+	if err != nil {
+		return nil, err
+	}
+	if throttle <= 0 || shaperServer == nil {
+		actions = append(actions, model.QuotaThrottle)
+	}
+	return actions, nil
+}
+
+// getClientRate returns the speed limit of a client, lowered to the quota
+// throttle speed while it is throttled for exceeding its quota.
+func (s *SpeedService) getClientRate(tx *gorm.DB, client *model.Client) (int64, error) {
+	rate := client.SpeedLimit
+	if client.QuotaAction != model.QuotaThrottle {
+		return rate, nil
+	}
+	traffic := &xray.ClientTraffic{}
+	err := tx.Model(xray.ClientTraffic{}).Where("email = ?", client.Email).First(traffic).Error
+	if err != nil {
+		return 0, err
+	}
+	if !isQuotaExceeded(client, traffic) {
+		return rate, nil
+	}
+	throttle, err := s.settingService.GetQuotaThrottleSpeed()
+	if err != nil {
+		return 0, err
+	}
+	if throttle > 0 && (rate == 0 || int64(throttle) < rate) {
+		rate = int64(throttle)
+	}
+	return rate, nil
+}
+
+// getTargets returns the quota-exceeded outbound when clients are redirected
+// to it, then the shaper outbounds of the limited clients and inbounds while
+// the shaper runs.
+func (s *SpeedService) getTargets(tx *gorm.DB) ([]speedTarget, error) {
+	var redirected []string
+	err := tx.Model(model.Client{}).
+		Joins("JOIN client_traffics ON client_traffics.email = clients.email").
+		Where("clients.quota_action = ? AND "+quotaExceededSQL, model.QuotaRedirect).
+		Order("clients.id").
+		Pluck("clients.email", &redirected).Error
+	if err != nil {
+		return nil, err
+	}
+	throttle, err := s.settingService.GetQuotaThrottleSpeed()
+	if err != nil {
+		return nil, err
+	}
+	var clients []*model.Client
+	var inbounds []*model.Inbound
+	// Without a running shaper the limited clients and inbounds stay
+	// unlimited rather than losing their traffic.
+	if shaperServer != nil {
+		err = tx.Model(model.Client{}).
+			Select("clients.id", "clients.email").
+			Joins("JOIN client_traffics ON client_traffics.email = clients.email").
+			Where("clients.speed_limit > 0 OR (? AND clients.quota_action = ? AND "+quotaExceededSQL+")", throttle > 0, model.QuotaThrottle).
+			Order("clients.id").
+			Find(&clients).Error
+		if err != nil {
+			return nil, err
+		}
+		err = tx.Model(model.Inbound{}).Select("id", "tag").Where("speed_limit > 0").Order("id").Find(&inbounds).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	targets := make([]speedTarget, 0, len(clients)+len(inbounds)+1)
+	add := func(tag string, outbound []byte, key string, values []string) error {
+		rule, err := json.Marshal(map[string]interface{}{
+			"type":        "field",
+			"ruleTag":     tag,
+			key:           values,
+			"outboundTag": tag,
+		})
+		if err != nil {
+			return err
+		}
+		targets = append(targets, speedTarget{tag: tag, outbound: string(outbound), rule: string(rule)})
+		return nil
+	}
+	if len(redirected) > 0 {
+		outbound, err := s.genQuotaOutbound()
+		if err != nil {
+			return nil, err
+		}
+		if err := add(quotaTag, outbound, "user", redirected); err != nil {
+			return nil, err
+		}
+	}
+	for _, client := range clients {
+		user := "client-" + strconv.Itoa(client.Id)
+		outbound, err := s.genOutbound(user)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(speedTag(user), outbound, "user", []string{client.Email}); err != nil {
+			return nil, err
+		}
+	}
+	for _, inbound := range inbounds {
+		user := "inbound-" + strconv.Itoa(inbound.Id)
+		outbound, err := s.genOutbound(user)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(speedTag(user), outbound, "inboundTag", []string{inbound.Tag}); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+// genQuotaOutbound builds the outbound of clients redirected for exceeding
+// their quota. It sends every connection to the quotaRedirect address, or
+// answers with an HTTP 403 when none is set.
+func (s *SpeedService) genQuotaOutbound() ([]byte, error) {
+	redirect, err := s.settingService.GetQuotaRedirect()
+	if err != nil {
+		return nil, err
+	}
+	if redirect == "" {
+		return json.Marshal(map[string]interface{}{
+			"tag":      quotaTag,
+			"protocol": "blackhole",
+			"settings": map[string]interface{}{
+				"response": map[string]interface{}{"type": "http"},
+			},
+		})
+	}
+	return json.Marshal(map[string]interface{}{
+		"tag":      quotaTag,
+		"protocol": "freedom",
+		"settings": map[string]interface{}{
+			"redirect": redirect,
+		},
+	})
+}
+
+// genOutbound builds the socks outbound of a shaper user.
+func (s *SpeedService) genOutbound(user string) ([]byte, error) {
+	port, err := s.settingService.GetSpeedLimitPort()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.settingService.GetSecret()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{
+		"tag":      speedTag(user),
+		"protocol": "socks",
+		"settings": map[string]interface{}{
+			"servers": []interface{}{
+				map[string]interface{}{
+					"address": "127.0.0.1",
+					"port":    port,
+					"users": []interface{}{
+						map[string]interface{}{
+							"user": user,
+							"pass": shaperPassword(secret, user),
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+// genReturnInbound builds the socks inbound the shaper sends shaped traffic
+// back through. It sniffs for routing only, so domain rules of the template
+// still apply to traffic the shaper got by IP.
+func (s *SpeedService) genReturnInbound() (*xray.InboundConfig, error) {
+	port, err := s.settingService.GetSpeedReturnPort()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.settingService.GetSecret()
+	if err != nil {
+		return nil, err
+	}
+	inboundJson, err := json.Marshal(map[string]interface{}{
+		"tag":      speedReturnTag,
+		"listen":   "127.0.0.1",
+		"port":     port,
+		"protocol": "socks",
+		"settings": map[string]interface{}{
+			"auth": "password",
+			"accounts": []interface{}{
+				map[string]interface{}{
+					"user": speedReturnTag,
+					"pass": shaperPassword(secret, speedReturnTag),
+				},
+			},
+			"udp": true,
+			"ip":  "127.0.0.1",
+		},
+		"sniffing": map[string]interface{}{
+			"enabled":      true,
+			"destOverride": []string{"http", "tls", "quic"},
+			"routeOnly":    true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	inbound := &xray.InboundConfig{}
+	if err := json.Unmarshal(inboundJson, inbound); err != nil {
+		return nil, err
+	}
+	return inbound, nil
+}
+
+// genRouting returns a routing config with the rules of the targets put
+// before the rules of the given one.
+func genRouting(routerConfig []byte, targets []speedTarget) ([]byte, error) {
+	routing := map[string]interface{}{}
+	if len(routerConfig) > 0 {
+		if err := json.Unmarshal(routerConfig, &routing); err != nil {
+			return nil, err
+		}
+	}
+	templateRules, _ := routing["rules"].([]interface{})
+	rules := make([]interface{}, 0, len(targets)+len(templateRules))
+	for _, target := range targets {
+		rules = append(rules, json.RawMessage(target.rule))
+	}
+	routing["rules"] = append(rules, templateRules...)
+	return json.MarshalIndent(routing, "", "  ")
+}
+
+// addSpeedConfig adds the return inbound of the shaper and the outbounds and
+// rules of the targets to an Xray config, and enables the RoutingService its
+// API needs to change them.
+func (s *SpeedService) addSpeedConfig(config *xray.Config, targets []speedTarget) error {
+	if shaperServer != nil {
+		inbound, err := s.genReturnInbound()
+		if err != nil {
+			return err
+		}
+		config.InboundConfigs = append(config.InboundConfigs, *inbound)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	var outbounds []json.RawMessage
+	if len(config.OutboundConfigs) > 0 {
+		if err := json.Unmarshal(config.OutboundConfigs, &outbounds); err != nil {
+			return err
+		}
+	}
+	for _, target := range targets {
+		outbounds = append(outbounds, json.RawMessage(target.outbound))
+	}
+	outboundJson, err := json.MarshalIndent(outbounds, "", "  ")
+	if err != nil {
+		return err
+	}
+	config.OutboundConfigs = outboundJson
+	routingJson, err := genRouting(config.RouterConfig, targets)
+	if err != nil {
+		return err
+	}
+	config.RouterConfig = routingJson
+
+	if len(config.API) > 0 {
+		api := map[string]interface{}{}
+		if err := json.Unmarshal(config.API, &api); err != nil {
+			return err
+		}
+		services, _ := api["services"].([]interface{})
+		if !slices.Contains(services, interface{}("RoutingService")) {
+			api["services"] = append(services, "RoutingService")
+			apiJson, err := json.MarshalIndent(api, "", "  ")
+			if err != nil {
+				return err
+			}
+			config.API = apiJson
+		}
+	}
+	return nil
+}
+
+// ApplySpeedLimits updates the outbounds and rules of the running Xray after
+// speed limits or quota states changed and applies changed rates to open
+// connections. Only the rules and changed outbounds are replaced, so users
+// whose limits did not change keep their connections. The API can only add
+// rules after the existing ones, so the whole rule list of the template is
+// loaded again with the speed rules in front. It returns true when Xray has
+// to be restarted.
+func (s *SpeedService) ApplySpeedLimits() bool {
+	if shaperServer != nil {
+		shaperServer.Refresh()
+	}
+	if p == nil || !p.IsRunning() {
+		return false
+	}
+	speedLock.Lock()
+	defer speedLock.Unlock()
+
+	targets, err := s.getTargets(database.GetDB())
+	if err != nil {
+		logger.Warning("Unable to load speed limits:", err)
+		return true
+	}
+	if slices.Equal(targets, speedTargets) {
+		return false
+	}
+	templateConfig, err := s.settingService.GetXrayConfigTemplate()
+	if err != nil {
+		logger.Warning("Unable to load xray config template:", err)
+		return true
+	}
+	template := &xray.Config{}
+	if err := json.Unmarshal([]byte(templateConfig), template); err != nil {
+		logger.Warning("Unable to parse xray config template:", err)
+		return true
+	}
+	routing, err := genRouting(template.RouterConfig, targets)
+	if err != nil {
+		logger.Warning("Unable to generate speed limit rules:", err)
+		return true
+	}
+
+	err = s.xrayAPI.Init(p.GetAPIPort())
+	if err != nil {
+		logger.Debug("Unable to connect to Xray API:", err)
+		return true
+	}
+	defer s.xrayAPI.Close()
+
+	oldOutbounds := make(map[string]string, len(speedTargets))
+	for _, target := range speedTargets {
+		oldOutbounds[target.tag] = target.outbound
+	}
+	newOutbounds := make(map[string]string, len(targets))
+	for _, target := range targets {
+		newOutbounds[target.tag] = target.outbound
+	}
+
+	// New outbounds are added before the rules routing to them and old ones
+	// deleted after, as Xray sends traffic of rules without an outbound to
+	// the default one. Changed outbounds are replaced in place.
+	needRestart := false
+	for _, target := range targets {
+		if _, ok := oldOutbounds[target.tag]; ok {
+			continue
+		}
+		if err := s.xrayAPI.AddOutbound([]byte(target.outbound)); err != nil {
+			logger.Debug("Unable to add outbound by api:", err)
+			needRestart = true
+		}
+	}
+	if err := s.xrayAPI.SetRouting(routing); err != nil {
+		logger.Debug("Unable to set routing by api:", err)
+		return true
+	}
+	for _, target := range speedTargets {
+		if outbound, ok := newOutbounds[target.tag]; ok && outbound == target.outbound {
+			continue
+		}
+		if err := s.xrayAPI.DelOutbound(target.tag); err != nil {
+			logger.Debug("Unable to delete outbound by api:", err)
+			needRestart = true
+		}
+	}
+	for _, target := range targets {
+		if outbound, ok := oldOutbounds[target.tag]; !ok || outbound == target.outbound {
+			continue
+		}
+		if err := s.xrayAPI.AddOutbound([]byte(target.outbound)); err != nil {
+			logger.Debug("Unable to add outbound by api:", err)
+			needRestart = true
+		}
+	}
+	if !needRestart {
+		speedTargets = targets
+	}
+	return needRestart
+}
+
+// setSpeedTargets records the targets of a newly started Xray.
+func setSpeedTargets(targets []speedTarget) {
+	speedLock.Lock()
+	defer speedLock.Unlock()
+	speedTargets = targets
+}
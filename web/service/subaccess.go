@@ -0,0 +1,238 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/util/common"
+
+	"gorm.io/gorm"
+)
+
+// SubAccessService guards the subscriptions of clients against leaked URLs.
+// It resolves replaced subscription ids during their grace period, signs and
+// checks the time-limited tokens of subscription URLs, and logs every fetch
+// so that subscriptions fetched from suspiciously many IPs can be found.
+type SubAccessService struct {
+	clientService  ClientService
+	settingService SettingService
+}
+
+// SubToken is a signed token for the URLs of a subscription, valid until
+// ExpiryTime.
+type SubToken struct {
+	SubId      string `json:"subId"`
+	Token      string `json:"token"`
+	ExpiryTime int64  `json:"expiryTime"`
+}
+
+// SubAccessReport is a subscription fetched from many IPs, with the emails of
+// its clients.
+type SubAccessReport struct {
+	SubId    string   `json:"subId"`
+	Emails   []string `json:"emails"`
+	Ips      int      `json:"ips"`
+	Fetches  int      `json:"fetches"`
+	LastTime int64    `json:"lastTime"`
+}
+
+// ResolveSubId returns the current id of a subscription, which differs from
+// the given one when that was replaced and is still in its grace period.
+func (s *SubAccessService) ResolveSubId(subId string) (string, error) {
+	db := database.GetDB()
+	alias := &model.SubIdAlias{}
+	err := db.Where("sub_id = ? AND expiry_time > ?", subId, time.Now().UnixMilli()).First(alias).Error
+	if err == gorm.ErrRecordNotFound {
+		return subId, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return alias.Target, nil
+}
+
+// signSubId returns the signature of a subscription id valid until expiry, in
+// Unix seconds, keyed with the secret of the panel.
+func (s *SubAccessService) signSubId(subId string, expiry int64) (string, error) {
+	secret, err := s.settingService.GetSecret()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("sub:" + subId + ":" + strconv.FormatInt(expiry, 10)))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// GetSubToken signs a token for the subscription of a client, valid for the
+// given hours or the default validity when 0.
+func (s *SubAccessService) GetSubToken(user *model.User, email string, hours int) (*SubToken, error) {
+	if hours < 0 {
+		return nil, common.NewErrorf("invalid token validity: %v", hours)
+	}
+	if hours == 0 {
+		var err error
+		hours, err = s.settingService.GetSubTokenTTL()
+		if err != nil {
+			return nil, err
+		}
+	}
+	client, _, err := s.clientService.findClient(database.GetDB(), user, email)
+	if err != nil {
+		return nil, err
+	}
+	expiry := time.Now().Add(time.Duration(hours) * time.Hour).Unix()
+	signature, err := s.signSubId(client.SubID, expiry)
+	if err != nil {
+		return nil, err
+	}
+	return &SubToken{
+		SubId:      client.SubID,
+		Token:      strconv.FormatInt(expiry, 10) + "." + signature,
+		ExpiryTime: expiry * 1000,
+	}, nil
+}
+
+// CheckSubToken fails unless token is a valid token of the subscription id it
+// was requested with that has not expired.
+func (s *SubAccessService) CheckSubToken(subId string, token string) error {
+	expiryText, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return common.NewError("invalid subscription token")
+	}
+	expiry, err := strconv.ParseInt(expiryText, 10, 64)
+	if err != nil {
+		return common.NewError("invalid subscription token")
+	}
+	expected, err := s.signSubId(subId, expiry)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return common.NewError("invalid subscription token")
+	}
+	if time.Now().Unix() > expiry {
+		return common.NewError("subscription token expired")
+	}
+	return nil
+}
+
+// LogAccess logs a fetch of a subscription by its current id, subId, and the
+// id it was requested by.
+func (s *SubAccessService) LogAccess(subId string, requestedId string, ip string, userAgent string, status int) error {
+	db := database.GetDB()
+	return db.Create(&model.SubAccessLog{
+		SubId:       subId,
+		RequestedId: requestedId,
+		Ip:          ip,
+		UserAgent:   userAgent,
+		Status:      status,
+		Time:        time.Now().UnixMilli(),
+	}).Error
+}
+
+// GetAccessLogs returns the latest fetches of the subscription of a client,
+// at most limit of them.
+func (s *SubAccessService) GetAccessLogs(user *model.User, email string, limit int) ([]*model.SubAccessLog, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	db := database.GetDB()
+	client, _, err := s.clientService.findClient(db, user, email)
+	if err != nil {
+		return nil, err
+	}
+	var logs []*model.SubAccessLog
+	err = db.Where("sub_id = ?", client.SubID).Order("id DESC").Limit(limit).Find(&logs).Error
+	return logs, err
+}
+
+// GetSuspicious returns the subscriptions the user can see that were served
+// to at least minIps IPs in the last hours, the most IPs first. Zero
+// arguments take a day and the threshold of the settings.
+func (s *SubAccessService) GetSuspicious(user *model.User, hours int, minIps int) ([]*SubAccessReport, error) {
+	if hours <= 0 {
+		hours = 24
+	}
+	if minIps <= 0 {
+		var err error
+		minIps, err = s.settingService.GetSubSuspiciousIps()
+		if err != nil {
+			return nil, err
+		}
+	}
+	db := database.GetDB()
+	var rows []struct {
+		SubId    string
+		Ips      int
+		Fetches  int
+		LastTime int64
+	}
+	err := db.Model(model.SubAccessLog{}).
+		Select("sub_id, COUNT(DISTINCT ip) AS ips, COUNT(*) AS fetches, MAX(time) AS last_time").
+		Where("status = ? AND time >= ?", 200, time.Now().Add(-time.Duration(hours)*time.Hour).UnixMilli()).
+		Group("sub_id").
+		Having("COUNT(DISTINCT ip) >= ?", minIps).
+		Order("ips DESC").
+		Scan(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+
+	subIds := make([]string, 0, len(rows))
+	for _, row := range rows {
+		subIds = append(subIds, row.SubId)
+	}
+	var clients []struct {
+		SubId string
+		Email string
+	}
+	err = scopeInbounds(db.Model(model.Client{}).Joins("JOIN inbounds ON inbounds.id = clients.inbound_id"), user).
+		Select("clients.sub_id, clients.email").
+		Where("clients.sub_id IN ?", subIds).
+		Order("clients.id").
+		Scan(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	emails := make(map[string][]string)
+	for _, client := range clients {
+		emails[client.SubId] = append(emails[client.SubId], client.Email)
+	}
+	// Subscriptions without clients the user can see are left out.
+	reports := make([]*SubAccessReport, 0, len(rows))
+	for _, row := range rows {
+		if len(emails[row.SubId]) == 0 {
+			continue
+		}
+		reports = append(reports, &SubAccessReport{
+			SubId:    row.SubId,
+			Emails:   emails[row.SubId],
+			Ips:      row.Ips,
+			Fetches:  row.Fetches,
+			LastTime: row.LastTime,
+		})
+	}
+	return reports, nil
+}
+
+// Prune deletes the fetches older than the access log retention and the
+// replaced subscription ids past their grace period.
+func (s *SubAccessService) Prune() error {
+	db := database.GetDB()
+	err := db.Where("expiry_time <= ?", time.Now().UnixMilli()).Delete(model.SubIdAlias{}).Error
+	if err != nil {
+		return err
+	}
+	days, err := s.settingService.GetSubAccessLogRetention()
+	if err != nil || days <= 0 {
+		return err
+	}
+	before := time.Now().AddDate(0, 0, -days).UnixMilli()
+	return db.Where("time < ?", before).Delete(model.SubAccessLog{}).Error
+}
@@ -0,0 +1,687 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"x-ui-scratch/config"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/web/locale"
+)
+
+type LoginStatus int
+
+const (
+	LoginFail    LoginStatus = 0
+	LoginSuccess LoginStatus = 1
+)
+
+const (
+	tgbotPollTimeout = 30 * time.Second
+	tgbotRetryDelay  = 5 * time.Second
+	// tgbotMessageLimit is the longest text Telegram accepts in a message.
+	tgbotMessageLimit = 4096
+)
+
+// Tgbot is the Telegram bot of the panel. It alerts the admins about logins,
+// Xray crashes and depleted clients, sends them reports and database backups,
+// and answers the commands of admins and of clients whose Telegram ID is set.
+type Tgbot struct {
+	settingService SettingService
+	serverService  ServerService
+	xrayService    XrayService
+	inboundService InboundService
+	clientService  ClientService
+}
+
+// tgbotState is the configuration of the running bot.
+type tgbotState struct {
+	api      string
+	client   *http.Client
+	admins   []int64
+	hostname string
+	cancel   context.CancelFunc
+}
+
+var (
+	botLock sync.Mutex
+	bot     *tgbotState
+
+	botRegister sync.Once
+)
+
+type tgbotResponse struct {
+	Ok          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	Description string          `json:"description"`
+}
+
+type tgbotUpdate struct {
+	UpdateId int64         `json:"update_id"`
+	Message  *tgbotMessage `json:"message"`
+}
+
+type tgbotMessage struct {
+	From *struct {
+		Id        int64  `json:"id"`
+		FirstName string `json:"first_name"`
+	} `json:"from"`
+	Chat struct {
+		Id int64 `json:"id"`
+	} `json:"chat"`
+	Text string `json:"text"`
+}
+
+// tgbotClient is a client with its usage as shown by the bot.
+type tgbotClient struct {
+	Email      string
+	Remark     string
+	Enable     bool
+	Active     bool
+	Up         int64
+	Down       int64
+	Total      int64
+	ExpiryTime int64
+}
+
+// Start starts answering commands when the bot is enabled. The settings are
+// read once, so changing them takes a restart of the panel.
+func (t *Tgbot) Start() error {
+	enabled, err := t.settingService.GetTgbotEnabled()
+	if err != nil || !enabled {
+		return err
+	}
+	token, err := t.settingService.GetTgBotToken()
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return common.NewError("telegram bot token is empty")
+	}
+	apiServer, err := t.settingService.GetTgBotAPIServer()
+	if err != nil {
+		return err
+	}
+	proxy, err := t.settingService.GetTgBotProxy()
+	if err != nil {
+		return err
+	}
+	chatIds, err := t.settingService.GetTgBotChatId()
+	if err != nil {
+		return err
+	}
+	var admins []int64
+	for _, chatId := range strings.Split(chatIds, ",") {
+		chatId = strings.TrimSpace(chatId)
+		if chatId == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(chatId, 10, 64)
+		if err != nil {
+			return common.NewErrorf("invalid telegram chat id: %v", chatId)
+		}
+		admins = append(admins, id)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return common.NewErrorf("invalid telegram proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	hostname, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(context.Background())
+	state := &tgbotState{
+		api: strings.TrimSuffix(apiServer, "/") + "/bot" + token + "/",
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   tgbotPollTimeout + 10*time.Second,
+		},
+		admins:   admins,
+		hostname: hostname,
+		cancel:   cancel,
+	}
+
+	botLock.Lock()
+	if bot != nil {
+		bot.cancel()
+	}
+	bot = state
+	botLock.Unlock()
+
+	botRegister.Do(func() {
+		RegisterNotifyChannel(&Tgbot{})
+	})
+	go t.poll(ctx, state)
+	return nil
+}
+
+func (t *Tgbot) Stop() {
+	botLock.Lock()
+	defer botLock.Unlock()
+	if bot != nil {
+		bot.cancel()
+		bot = nil
+	}
+}
+
+func (t *Tgbot) IsRunning() bool {
+	return t.state() != nil
+}
+
+func (t *Tgbot) state() *tgbotState {
+	botLock.Lock()
+	defer botLock.Unlock()
+	return bot
+}
+
+func (t *Tgbot) Name() string {
+	return "telegram"
+}
+
+func (t *Tgbot) Enabled() bool {
+	return t.IsRunning()
+}
+
+var tgbotNotifyMessages = map[model.NotifyEvent]string{
+	model.NotifyExpiring: "tgbot.messages.clientExpiring",
+	model.NotifyTraffic:  "tgbot.messages.clientTraffic",
+	model.NotifyDepleted: "tgbot.messages.clientDepleted",
+	model.NotifyDisabled: "tgbot.messages.clientDisabled",
+	model.NotifyRenewed:  "tgbot.messages.clientRenewed",
+}
+
+// Send tells the client about the notification when it has a Telegram ID,
+// and the admins when the client was depleted or disabled.
+func (t *Tgbot) Send(notification *Notification) error {
+	state := t.state()
+	if state == nil {
+		return nil
+	}
+	msg := t.i18nBot(tgbotNotifyMessages[notification.Event], "Email=="+html.EscapeString(notification.Email))
+	msg += t.i18nBot("tgbot.messages.inbound", "Remark=="+html.EscapeString(notification.Remark))
+	msg += t.expiry(notification.ExpiryTime)
+	msg += t.total(notification.Up+notification.Down, notification.Total)
+
+	var errs []error
+	if notification.Event == model.NotifyDepleted || notification.Event == model.NotifyDisabled {
+		for _, admin := range state.admins {
+			errs = append(errs, state.sendMessage(admin, msg))
+		}
+	}
+	if notification.TgID != 0 && !slices.Contains(state.admins, notification.TgID) {
+		errs = append(errs, state.sendMessage(notification.TgID, msg))
+	}
+	return errors.Join(errs...)
+}
+
+// UserLoginNotify tells the admins about a login to the panel. The password
+// is never sent, as a failed one is often close to the real one.
+func (t *Tgbot) UserLoginNotify(username string, ip string, loginTime string, status LoginStatus) {
+	state := t.state()
+	if state == nil {
+		return
+	}
+	loginNotify, err := t.settingService.GetTgBotLoginNotify()
+	if err != nil || !loginNotify {
+		return
+	}
+	var msg string
+	if status == LoginSuccess {
+		msg = t.i18nBot("tgbot.messages.loginSuccess")
+	} else {
+		msg = t.i18nBot("tgbot.messages.loginFailed")
+	}
+	msg += t.i18nBot("tgbot.messages.hostname", "Hostname=="+state.hostname)
+	msg += t.i18nBot("tgbot.messages.username", "Username=="+username)
+	msg += t.i18nBot("tgbot.messages.ip", "IP=="+ip)
+	msg += t.i18nBot("tgbot.messages.time", "Time=="+loginTime)
+	go state.sendAdmins(msg)
+}
+
+// SendXrayCrash tells the admins that Xray exited with the given output.
+func (t *Tgbot) SendXrayCrash(result string) {
+	state := t.state()
+	if state == nil {
+		return
+	}
+	msg := t.i18nBot("tgbot.messages.xrayCrashed", "Error=="+html.EscapeString(result))
+	msg += t.i18nBot("tgbot.messages.hostname", "Hostname=="+state.hostname)
+	msg += t.i18nBot("tgbot.messages.datetime", "DateTime=="+t.formatTime(time.Now().UnixMilli()))
+	state.sendAdmins(msg)
+}
+
+// SendReport sends the server status to the admins, along with a database
+// backup when backups are enabled.
+func (t *Tgbot) SendReport() {
+	state := t.state()
+	if state == nil {
+		return
+	}
+	runTime, err := t.settingService.GetTgRunTime()
+	if err != nil {
+		logger.Warning("get telegram report time failed:", err)
+	}
+	msg := t.i18nBot("tgbot.messages.report", "RunTime=="+runTime)
+	msg += t.i18nBot("tgbot.messages.datetime", "DateTime=="+t.formatTime(time.Now().UnixMilli()))
+	msg += t.serverStatus(state)
+	state.sendAdmins(msg)
+
+	backup, err := t.settingService.GetTgBotBackup()
+	if err != nil {
+		logger.Warning("get telegram backup setting failed:", err)
+		return
+	}
+	if backup {
+		for _, admin := range state.admins {
+			t.sendBackup(state, admin)
+		}
+	}
+}
+
+func (t *Tgbot) poll(ctx context.Context, state *tgbotState) {
+	offset := int64(0)
+	for ctx.Err() == nil {
+		var updates []*tgbotUpdate
+		err := state.call(ctx, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(tgbotPollTimeout / time.Second),
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warning("get telegram updates failed:", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(tgbotRetryDelay):
+			}
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateId + 1
+			if update.Message != nil {
+				t.answer(state, update.Message)
+			}
+		}
+	}
+}
+
+// answer handles a command. Commands of chats that are not admins are limited
+// to the clients whose Telegram ID is the chat.
+func (t *Tgbot) answer(state *tgbotState, message *tgbotMessage) {
+	text := strings.TrimSpace(message.Text)
+	if !strings.HasPrefix(text, "/") {
+		return
+	}
+	command, arg, _ := strings.Cut(text, " ")
+	command, _, _ = strings.Cut(command, "@")
+	arg = strings.TrimSpace(arg)
+	chatId := message.Chat.Id
+	isAdmin := slices.Contains(state.admins, chatId)
+
+	var msgs []string
+	switch {
+	case command == "/start":
+		firstName := ""
+		if message.From != nil {
+			firstName = html.EscapeString(message.From.FirstName)
+		}
+		msg := t.i18nBot("tgbot.commands.start", "Firstname=="+firstName)
+		msg += t.i18nBot("tgbot.commands.welcome", "Hostname=="+state.hostname)
+		msg += "\r\n" + t.help(isAdmin)
+		msgs = append(msgs, msg)
+	case command == "/help":
+		msgs = append(msgs, t.i18nBot("tgbot.commands.help")+t.help(isAdmin))
+	case command == "/id":
+		msgs = append(msgs, t.i18nBot("tgbot.commands.getID", "ID=="+strconv.FormatInt(chatId, 10)))
+	case command == "/usage":
+		msgs = t.usage(chatId, arg, isAdmin)
+	case command == "/status" && isAdmin:
+		msgs = append(msgs, t.serverStatus(state))
+	case command == "/inbound" && isAdmin:
+		msgs = t.inbounds(arg)
+	case command == "/reset" && isAdmin:
+		msgs = append(msgs, t.resetTraffic(arg))
+	case command == "/backup" && isAdmin:
+		t.sendBackup(state, chatId)
+		return
+	default:
+		msgs = append(msgs, t.i18nBot("tgbot.commands.unknown"))
+	}
+
+	err := state.sendMessages(chatId, msgs)
+	if err != nil {
+		logger.Warningf("answer telegram command %v failed: %v", command, err)
+	}
+}
+
+func (t *Tgbot) help(isAdmin bool) string {
+	if isAdmin {
+		return t.i18nBot("tgbot.commands.helpAdminCommands") + "\r\n\r\n" + t.i18nBot("tgbot.commands.helpAdminActions")
+	}
+	return t.i18nBot("tgbot.commands.helpClientCommands")
+}
+
+// usage returns the usage of the client with the given email. Clients see
+// only their own usage, of all their clients when no email is given.
+func (t *Tgbot) usage(chatId int64, email string, isAdmin bool) []string {
+	var clients []*tgbotClient
+	var err error
+	if isAdmin {
+		if email == "" {
+			return []string{t.i18nBot("tgbot.commands.usage")}
+		}
+		clients, err = t.getClients("clients.email = ?", email)
+	} else {
+		clients, err = t.getClients("clients.tg_id = ?", chatId)
+		if err == nil && len(clients) == 0 {
+			return []string{t.i18nBot("tgbot.answers.askToAddUserId", "TgUserID=="+strconv.FormatInt(chatId, 10))}
+		}
+		if email != "" {
+			clients = slices.DeleteFunc(clients, func(client *tgbotClient) bool {
+				return client.Email != email
+			})
+		}
+	}
+	if err != nil {
+		logger.Warning("get telegram client usage failed:", err)
+		return []string{t.i18nBot("tgbot.wentWrong")}
+	}
+	if len(clients) == 0 {
+		return []string{t.i18nBot("tgbot.noResult")}
+	}
+	online := t.inboundService.GetOnlineClients()
+	msgs := make([]string, 0, len(clients))
+	for _, client := range clients {
+		msgs = append(msgs, t.clientUsage(client, online))
+	}
+	return msgs
+}
+
+// inbounds returns the inbounds whose remark contains the given text with
+// the usage of their clients.
+func (t *Tgbot) inbounds(remark string) []string {
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(remark) + "%"
+	err := db.Model(model.Inbound{}).Where(`remark LIKE ? ESCAPE '\'`, pattern).Order("id").Find(&inbounds).Error
+	if err != nil {
+		logger.Warning("get telegram inbounds failed:", err)
+		return []string{t.i18nBot("tgbot.answers.getInboundsFailed")}
+	}
+	if len(inbounds) == 0 {
+		return []string{t.i18nBot("tgbot.noInbounds")}
+	}
+	online := t.inboundService.GetOnlineClients()
+	var msgs []string
+	for _, inbound := range inbounds {
+		msg := t.i18nBot("tgbot.messages.inbound", "Remark=="+html.EscapeString(inbound.Remark))
+		msg += t.i18nBot("tgbot.messages.port", "Port=="+strconv.Itoa(inbound.Port))
+		msg += t.i18nBot("tgbot.messages.traffic",
+			"Total=="+common.FormatTraffic(inbound.Up+inbound.Down),
+			"Upload=="+common.FormatTraffic(inbound.Up),
+			"Download=="+common.FormatTraffic(inbound.Down))
+		msg += t.expiry(inbound.ExpiryTime)
+		msgs = append(msgs, msg)
+
+		clients, err := t.getClients("clients.inbound_id = ?", inbound.Id)
+		if err != nil {
+			logger.Warning("get telegram client usage failed:", err)
+			msgs = append(msgs, t.i18nBot("tgbot.answers.getClientsFailed"))
+			continue
+		}
+		for _, client := range clients {
+			msgs = append(msgs, t.clientUsage(client, online))
+		}
+	}
+	return msgs
+}
+
+func (t *Tgbot) resetTraffic(email string) string {
+	if email == "" {
+		return t.i18nBot("tgbot.commands.usage")
+	}
+	needRestart, err := t.clientService.ResetClientTraffic(nil, email)
+	if err != nil {
+		logger.Warningf("reset traffic of %v by telegram failed: %v", email, err)
+		return t.i18nBot("tgbot.answers.errorOperation")
+	}
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+	return t.i18nBot("tgbot.answers.resetTrafficSuccess", "Email=="+html.EscapeString(email))
+}
+
+func (t *Tgbot) sendBackup(state *tgbotState, chatId int64) {
+	dbPath := config.GetDBPath()
+	data, err := os.ReadFile(dbPath)
+	if err == nil {
+		caption := t.i18nBot("tgbot.messages.backupTime", "Time=="+t.formatTime(time.Now().UnixMilli()))
+		err = state.sendDocument(chatId, filepath.Base(dbPath), data, caption)
+	}
+	if err != nil {
+		logger.Warning("send telegram backup failed:", err)
+	}
+}
+
+func (t *Tgbot) getClients(query interface{}, args ...interface{}) ([]*tgbotClient, error) {
+	db := database.GetDB()
+	var clients []*tgbotClient
+	err := db.Model(model.Client{}).
+		Joins("JOIN inbounds ON inbounds.id = clients.inbound_id").
+		Joins("JOIN client_traffics ON client_traffics.email = clients.email").
+		Select("clients.email, inbounds.remark, clients.enable, client_traffics.enable AS active, "+
+			"client_traffics.up, client_traffics.down, client_traffics.total, client_traffics.expiry_time").
+		Where(query, args...).
+		Order("clients.id").
+		Scan(&clients).Error
+	return clients, err
+}
+
+func (t *Tgbot) clientUsage(client *tgbotClient, online []string) string {
+	status := t.i18nBot("tgbot.offline")
+	if slices.Contains(online, client.Email) {
+		status = t.i18nBot("tgbot.online")
+	}
+	msg := t.i18nBot("tgbot.messages.email", "Email=="+html.EscapeString(client.Email))
+	msg += t.i18nBot("tgbot.messages.inbound", "Remark=="+html.EscapeString(client.Remark))
+	msg += t.i18nBot("tgbot.messages.enabled", "Enable=="+t.yesNo(client.Enable))
+	msg += t.i18nBot("tgbot.messages.active", "Enable=="+t.yesNo(client.Active))
+	msg += t.i18nBot("tgbot.messages.online", "Status=="+status)
+	msg += t.expiry(client.ExpiryTime)
+	msg += t.i18nBot("tgbot.messages.upload", "Upload=="+common.FormatTraffic(client.Up))
+	msg += t.i18nBot("tgbot.messages.download", "Download=="+common.FormatTraffic(client.Down))
+	msg += t.total(client.Up+client.Down, client.Total)
+	return msg
+}
+
+func (t *Tgbot) serverStatus(state *tgbotState) string {
+	status := t.serverService.GetStatus(nil)
+	msg := t.i18nBot("tgbot.messages.hostname", "Hostname=="+state.hostname)
+	msg += t.i18nBot("tgbot.messages.version", "Version=="+config.GetVersion())
+	msg += t.i18nBot("tgbot.messages.xrayVersion", "XrayVersion=="+status.Xray.Version)
+	msg += t.i18nBot("tgbot.messages.xrayStatus", "State=="+string(status.Xray.State))
+	msg += t.i18nBot("tgbot.messages.ipv4", "IPv4=="+status.PublicIP.IPv4)
+	msg += t.i18nBot("tgbot.messages.ipv6", "IPv6=="+status.PublicIP.IPv6)
+	msg += t.i18nBot("tgbot.messages.serverUpTime",
+		"UpTime=="+strconv.FormatUint(status.Uptime/86400, 10),
+		"Unit=="+t.i18nBot("tgbot.days"))
+	if len(status.Loads) == 3 {
+		msg += t.i18nBot("tgbot.messages.serverLoad",
+			"Load1=="+strconv.FormatFloat(status.Loads[0], 'f', 2, 64),
+			"Load2=="+strconv.FormatFloat(status.Loads[1], 'f', 2, 64),
+			"Load3=="+strconv.FormatFloat(status.Loads[2], 'f', 2, 64))
+	}
+	msg += t.i18nBot("tgbot.messages.serverMemory",
+		"Current=="+common.FormatTraffic(int64(status.Mem.Current)),
+		"Total=="+common.FormatTraffic(int64(status.Mem.Total)))
+	msg += t.i18nBot("tgbot.messages.tcpCount", "Count=="+strconv.Itoa(status.TcpCount))
+	msg += t.i18nBot("tgbot.messages.udpCount", "Count=="+strconv.Itoa(status.UdpCount))
+	msg += t.i18nBot("tgbot.messages.traffic",
+		"Total=="+common.FormatTraffic(int64(status.NetTraffic.Sent+status.NetTraffic.Recv)),
+		"Upload=="+common.FormatTraffic(int64(status.NetTraffic.Sent)),
+		"Download=="+common.FormatTraffic(int64(status.NetTraffic.Recv)))
+	msg += t.i18nBot("tgbot.messages.onlinesCount", "Count=="+strconv.Itoa(len(t.inboundService.GetOnlineClients())))
+	return msg
+}
+
+func (t *Tgbot) expiry(expiryTime int64) string {
+	switch {
+	case expiryTime == 0:
+		return t.i18nBot("tgbot.messages.expire", "Time=="+t.i18nBot("tgbot.unlimited"))
+	case expiryTime < 0:
+		days := strconv.FormatInt(-expiryTime/86400000, 10)
+		return t.i18nBot("tgbot.messages.expireIn", "Time=="+days+" "+t.i18nBot("tgbot.days"))
+	default:
+		return t.i18nBot("tgbot.messages.expire", "Time=="+t.formatTime(expiryTime))
+	}
+}
+
+func (t *Tgbot) total(used int64, total int64) string {
+	totalStr := t.i18nBot("tgbot.unlimited")
+	if total > 0 {
+		totalStr = common.FormatTraffic(total)
+	}
+	return t.i18nBot("tgbot.messages.total", "UpDown=="+common.FormatTraffic(used), "Total=="+totalStr)
+}
+
+func (t *Tgbot) yesNo(value bool) string {
+	if value {
+		return t.i18nBot("tgbot.messages.yes")
+	}
+	return t.i18nBot("tgbot.messages.no")
+}
+
+func (t *Tgbot) formatTime(millis int64) string {
+	loc, err := t.settingService.GetTimeLocation()
+	if err != nil {
+		loc = time.Local
+	}
+	return time.UnixMilli(millis).In(loc).Format("2006-01-02 15:04:05")
+}
+
+func (t *Tgbot) i18nBot(name string, params ...string) string {
+	return locale.I18n(locale.Bot, name, params...)
+}
+
+func (s *tgbotState) sendAdmins(msg string) {
+	for _, admin := range s.admins {
+		err := s.sendMessage(admin, msg)
+		if err != nil {
+			logger.Warningf("send telegram message to %v failed: %v", admin, err)
+		}
+	}
+}
+
+func (s *tgbotState) sendMessage(chatId int64, text string) error {
+	return s.call(context.Background(), "sendMessage", map[string]interface{}{
+		"chat_id":    chatId,
+		"text":       text,
+		"parse_mode": "HTML",
+	}, nil)
+}
+
+// sendMessages sends the texts in as few messages as fit the length limit of
+// Telegram.
+func (s *tgbotState) sendMessages(chatId int64, texts []string) error {
+	var msg string
+	for _, text := range texts {
+		if msg != "" && len([]rune(msg))+len([]rune(text))+2 > tgbotMessageLimit {
+			if err := s.sendMessage(chatId, msg); err != nil {
+				return err
+			}
+			msg = ""
+		}
+		if msg != "" {
+			msg += "\r\n"
+		}
+		msg += text
+	}
+	if msg == "" {
+		return nil
+	}
+	return s.sendMessage(chatId, msg)
+}
+
+func (s *tgbotState) sendDocument(chatId int64, name string, data []byte, caption string) error {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("chat_id", strconv.FormatInt(chatId, 10))
+	writer.WriteField("caption", caption)
+	writer.WriteField("parse_mode", "HTML")
+	part, err := writer.CreateFormFile("document", name)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(data)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.api+"sendDocument", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return s.do(req, nil)
+}
+
+func (s *tgbotState) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.api+method, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return s.do(req, result)
+}
+
+func (s *tgbotState) do(req *http.Request, result interface{}) error {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// the URL holds the bot token, so it is kept out of the error
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	response := &tgbotResponse{}
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if err != nil {
+		return common.NewErrorf("telegram returned %v: %v", resp.Status, err)
+	}
+	if !response.Ok {
+		return common.NewErrorf("telegram returned %v: %v", resp.Status, response.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/util/common"
+
+	"gorm.io/gorm"
+)
+
+const apiTokenPrefix = "xui_"
+
+// TokenService manages the bearer tokens used by the REST API.
+type TokenService struct {
+	userService UserService
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + hex.EncodeToString(buf), nil
+}
+
+// AddToken creates a token for the user and returns the plain token, which is
+// not stored and can not be recovered later. Scopes are limited to the
+// permissions of the user's role.
+func (s *TokenService) AddToken(user *model.User, name string, scopes []model.Permission, expiryTime int64) (string, *model.APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, common.NewError("token name can not be empty")
+	}
+	if len(scopes) == 0 {
+		return "", nil, common.NewError("token needs at least one scope")
+	}
+	scopeNames := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !user.Role.Can(scope) {
+			return "", nil, common.NewErrorf("role %v can not grant scope %v", user.Role, scope)
+		}
+		scopeNames = append(scopeNames, string(scope))
+	}
+	if expiryTime > 0 && expiryTime <= time.Now().UnixMilli() {
+		return "", nil, common.NewError("expiry time is in the past")
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", nil, err
+	}
+	apiToken := &model.APIToken{
+		UserId:     user.Id,
+		Name:       name,
+		Prefix:     token[:len(apiTokenPrefix)+6],
+		TokenHash:  hashToken(token),
+		Scopes:     strings.Join(scopeNames, ","),
+		ExpiryTime: expiryTime,
+		CreatedAt:  time.Now().UnixMilli(),
+	}
+	db := database.GetDB()
+	err = db.Create(apiToken).Error
+	if err != nil {
+		return "", nil, err
+	}
+	return token, apiToken, nil
+}
+
+// GetTokens returns the user's tokens, or every token for owners.
+func (s *TokenService) GetTokens(user *model.User) ([]*model.APIToken, error) {
+	db := database.GetDB().Model(model.APIToken{})
+	if user.Role != model.RoleOwner {
+		db = db.Where("user_id = ?", user.Id)
+	}
+	var tokens []*model.APIToken
+	err := db.Order("id").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *TokenService) DelToken(user *model.User, id int) error {
+	db := database.GetDB().Where("id = ?", id)
+	if user.Role != model.RoleOwner {
+		db = db.Where("user_id = ?", user.Id)
+	}
+	result := db.Delete(&model.APIToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// CheckToken resolves a plain token to the stored token and its user, and
+// records the time it was used.
+func (s *TokenService) CheckToken(token string) (*model.APIToken, *model.User, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, nil, common.NewError("invalid token")
+	}
+	db := database.GetDB()
+	apiToken := &model.APIToken{}
+	err := db.Model(model.APIToken{}).Where("token_hash = ?", hashToken(token)).First(apiToken).Error
+	if database.IsNotFound(err) {
+		return nil, nil, common.NewError("invalid token")
+	} else if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now().UnixMilli()
+	if apiToken.ExpiryTime > 0 && apiToken.ExpiryTime <= now {
+		return nil, nil, common.NewError("token expired")
+	}
+	user, err := s.userService.GetUserById(apiToken.UserId)
+	if err != nil {
+		return nil, nil, common.NewError("token owner not found")
+	}
+	apiToken.LastUsed = now
+	err = db.Model(apiToken).Update("last_used", now).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return apiToken, user, nil
+}
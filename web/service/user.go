@@ -1,9 +1,11 @@
 package service
 
 import (
+	"strings"
 	"x-ui-scratch/database"
 	"x-ui-scratch/database/model"
 	"x-ui-scratch/logger"
+	"x-ui-scratch/util/common"
 
 	"gorm.io/gorm"
 )
@@ -27,3 +29,136 @@ func (s *UserService) CheckUser(username string, password string, secret string)
 	}
 	return user
 }
+
+func (s *UserService) GetUserById(id int) (*model.User, error) {
+	db := database.GetDB()
+	user := &model.User{}
+	err := db.Model(model.User{}).Where("id = ?", id).First(user).Error
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUsers returns all panel administrators without their passwords and secrets.
+func (s *UserService) GetUsers() ([]*model.User, error) {
+	db := database.GetDB()
+	var users []*model.User
+	err := db.Model(model.User{}).Order("id").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		user.Password = ""
+		user.LoginSecret = ""
+	}
+	return users, nil
+}
+
+func (s *UserService) checkUser(tx *gorm.DB, user *model.User) error {
+	user.Username = strings.TrimSpace(user.Username)
+	if user.Username == "" {
+		return common.NewError("username can not be empty")
+	}
+	if !user.Role.IsValid() {
+		return common.NewErrorf("invalid role: %v", user.Role)
+	}
+	var count int64
+	err := tx.Model(model.User{}).Where("username = ? and id != ?", user.Username, user.Id).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewErrorf("username %v already exists", user.Username)
+	}
+	return nil
+}
+
+// countOtherOwners returns the number of owners other than the user with the given id.
+func (s *UserService) countOtherOwners(tx *gorm.DB, id int) (int64, error) {
+	var count int64
+	err := tx.Model(model.User{}).Where("role = ? and id != ?", model.RoleOwner, id).Count(&count).Error
+	return count, err
+}
+
+func (s *UserService) AddUser(user *model.User) error {
+	if user.Password == "" {
+		return common.NewError("password can not be empty")
+	}
+	user.Id = 0
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := s.checkUser(tx, user); err != nil {
+			return err
+		}
+		return tx.Create(user).Error
+	})
+}
+
+// UpdateUser updates the username, role and, when not empty, the password and
+// secret of an existing user. The last owner can not be demoted.
+func (s *UserService) UpdateUser(user *model.User) error {
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		oldUser := &model.User{}
+		err := tx.Model(model.User{}).Where("id = ?", user.Id).First(oldUser).Error
+		if err != nil {
+			return err
+		}
+		if err := s.checkUser(tx, user); err != nil {
+			return err
+		}
+		if oldUser.Role == model.RoleOwner && user.Role != model.RoleOwner {
+			count, err := s.countOtherOwners(tx, user.Id)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return common.NewError("can not demote the last owner")
+			}
+		}
+		oldUser.Username = user.Username
+		oldUser.Role = user.Role
+		if user.Password != "" {
+			oldUser.Password = user.Password
+		}
+		if user.LoginSecret != "" {
+			oldUser.LoginSecret = user.LoginSecret
+		}
+		return tx.Save(oldUser).Error
+	})
+}
+
+// DelUser removes a user and its API tokens. Inbounds owned by it are handed
+// back to the first owner.
+func (s *UserService) DelUser(id int) error {
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		user := &model.User{}
+		err := tx.Model(model.User{}).Where("id = ?", id).First(user).Error
+		if err != nil {
+			return err
+		}
+		count, err := s.countOtherOwners(tx, id)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return common.NewError("can not delete the last owner")
+		}
+		owner := &model.User{}
+		err = tx.Model(model.User{}).Where("role = ? and id != ?", model.RoleOwner, id).Order("id").First(owner).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(model.Inbound{}).Where("user_id = ?", id).Update("user_id", owner.Id).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ?", id).Delete(&model.APIToken{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(user).Error
+	})
+}
@@ -0,0 +1,387 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"x-ui-scratch/config"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
+	"x-ui-scratch/logger"
+	"x-ui-scratch/util/common"
+	"x-ui-scratch/util/random"
+
+	"gorm.io/gorm"
+)
+
+// WebhookService posts panel events to the registered webhooks. Each event is
+// stored as a delivery before it is sent, so failed deliveries are retried
+// with exponential backoff and can be redelivered by hand.
+//
+// A delivery is a POST of a WebhookPayload with the headers X-Webhook-Event,
+// X-Webhook-Delivery, X-Webhook-Timestamp and X-Webhook-Signature. The
+// signature is "sha256=" followed by the hex HMAC-SHA256, keyed with the
+// webhook secret, of the timestamp, a dot and the body.
+type WebhookService struct {
+	settingService SettingService
+}
+
+// WebhookPayload is the body of a delivery.
+type WebhookPayload struct {
+	Event model.WebhookEvent `json:"event"`
+	Time  int64              `json:"time"`
+	Data  interface{}        `json:"data"`
+}
+
+// LoginEvent is the data of the login.success and login.failed webhook events.
+type LoginEvent struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+const (
+	webhookMaxAttempts  = 8
+	webhookBaseDelay    = 30 * time.Second
+	webhookTimeout      = 10 * time.Second
+	webhookBatchSize    = 100
+	defaultDeliveryPage = 50
+	maxDeliveryPage     = 500
+)
+
+var (
+	// webhookDeliver keeps a delivery from being sent by two passes at once.
+	webhookDeliver sync.Mutex
+	webhookClient  = &http.Client{Timeout: webhookTimeout}
+)
+
+func init() {
+	RegisterNotifyChannel(&WebhookService{})
+}
+
+func (s *WebhookService) GetWebhooks() ([]*model.Webhook, error) {
+	db := database.GetDB()
+	webhooks := make([]*model.Webhook, 0)
+	err := db.Model(model.Webhook{}).Order("id").Find(&webhooks).Error
+	return webhooks, err
+}
+
+func (s *WebhookService) GetWebhook(id int) (*model.Webhook, error) {
+	db := database.GetDB()
+	webhook := &model.Webhook{}
+	err := db.Model(model.Webhook{}).Where("id = ?", id).First(webhook).Error
+	if err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (s *WebhookService) checkWebhook(webhook *model.Webhook) error {
+	webhook.Name = strings.TrimSpace(webhook.Name)
+	webhook.URL = strings.TrimSpace(webhook.URL)
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return common.NewErrorf("invalid webhook url: %v", webhook.URL)
+	}
+	for _, event := range webhook.Events {
+		if !event.IsValid() {
+			return common.NewErrorf("invalid webhook event: %v", event)
+		}
+	}
+	slices.Sort(webhook.Events)
+	webhook.Events = slices.Compact(webhook.Events)
+	return nil
+}
+
+// AddWebhook registers a webhook. A secret is generated when none is given.
+func (s *WebhookService) AddWebhook(webhook *model.Webhook) error {
+	webhook.Id = 0
+	err := s.checkWebhook(webhook)
+	if err != nil {
+		return err
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = random.Seq(32)
+	}
+	db := database.GetDB()
+	return db.Create(webhook).Error
+}
+
+// UpdateWebhook replaces a webhook. The secret is kept when none is given.
+func (s *WebhookService) UpdateWebhook(webhook *model.Webhook) error {
+	oldWebhook, err := s.GetWebhook(webhook.Id)
+	if err != nil {
+		return err
+	}
+	err = s.checkWebhook(webhook)
+	if err != nil {
+		return err
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = oldWebhook.Secret
+	}
+	db := database.GetDB()
+	return db.Save(webhook).Error
+}
+
+// DelWebhook deletes a webhook along with its deliveries.
+func (s *WebhookService) DelWebhook(id int) error {
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("webhook_id = ?", id).Delete(model.WebhookDelivery{}).Error
+		if err != nil {
+			return err
+		}
+		result := tx.Delete(model.Webhook{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// GetDeliveries returns the latest deliveries, of one webhook or of all when
+// webhookId is 0.
+func (s *WebhookService) GetDeliveries(webhookId int, limit int) ([]*model.WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = defaultDeliveryPage
+	}
+	limit = min(limit, maxDeliveryPage)
+	db := database.GetDB()
+	tx := db.Model(model.WebhookDelivery{})
+	if webhookId > 0 {
+		tx = tx.Where("webhook_id = ?", webhookId)
+	}
+	deliveries := make([]*model.WebhookDelivery, 0)
+	err := tx.Order("id DESC").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// Emit queues an event for the enabled webhooks subscribed to it, one
+// delivery per data item, and starts sending them. Failures are only logged,
+// so emitting never fails the action the event is about.
+func (s *WebhookService) Emit(event model.WebhookEvent, data ...interface{}) {
+	if len(data) == 0 {
+		return
+	}
+	db := database.GetDB()
+	var webhooks []*model.Webhook
+	err := db.Model(model.Webhook{}).Where("enable = ?", true).Find(&webhooks).Error
+	if err != nil {
+		logger.Warning("get webhooks failed:", err)
+		return
+	}
+	webhooks = slices.DeleteFunc(webhooks, func(webhook *model.Webhook) bool {
+		return len(webhook.Events) > 0 && !slices.Contains(webhook.Events, event)
+	})
+	if len(webhooks) == 0 {
+		return
+	}
+	now := time.Now().UnixMilli()
+	deliveries := make([]*model.WebhookDelivery, 0, len(data)*len(webhooks))
+	for _, item := range data {
+		payload, err := json.Marshal(&WebhookPayload{Event: event, Time: now, Data: item})
+		if err != nil {
+			logger.Warningf("marshal %v webhook payload failed: %v", event, err)
+			return
+		}
+		for _, webhook := range webhooks {
+			deliveries = append(deliveries, &model.WebhookDelivery{
+				WebhookId:   webhook.Id,
+				Event:       event,
+				Payload:     string(payload),
+				NextAttempt: now,
+				Time:        now,
+			})
+		}
+	}
+	err = db.CreateInBatches(deliveries, webhookBatchSize).Error
+	if err != nil {
+		logger.Warningf("queue %v webhook deliveries failed: %v", event, err)
+		return
+	}
+	go func() {
+		if err := s.DeliverPending(); err != nil {
+			logger.Warning("deliver webhooks failed:", err)
+		}
+	}()
+}
+
+// DeliverPending sends the deliveries that are due, of enabled webhooks. A
+// webhook that fails is not tried again in the same pass, so an unreachable
+// URL does not hold up the others.
+func (s *WebhookService) DeliverPending() error {
+	webhookDeliver.Lock()
+	defer webhookDeliver.Unlock()
+	db := database.GetDB()
+	var webhooks []*model.Webhook
+	err := db.Model(model.Webhook{}).Where("enable = ?", true).Find(&webhooks).Error
+	if err != nil {
+		return err
+	}
+	webhookMap := make(map[int]*model.Webhook, len(webhooks))
+	for _, webhook := range webhooks {
+		webhookMap[webhook.Id] = webhook
+	}
+	lastId := 0
+	for len(webhookMap) > 0 {
+		webhookIds := make([]int, 0, len(webhookMap))
+		for id := range webhookMap {
+			webhookIds = append(webhookIds, id)
+		}
+		var deliveries []*model.WebhookDelivery
+		err = db.Model(model.WebhookDelivery{}).
+			Where("id > ? AND webhook_id IN ? AND delivered = ? AND attempts < ? AND next_attempt <= ?",
+				lastId, webhookIds, false, webhookMaxAttempts, time.Now().UnixMilli()).
+			Order("id").
+			Limit(webhookBatchSize).
+			Find(&deliveries).Error
+		if err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+		for _, delivery := range deliveries {
+			lastId = delivery.Id
+			webhook, ok := webhookMap[delivery.WebhookId]
+			if !ok {
+				continue
+			}
+			s.deliver(webhook, delivery)
+			err = db.Save(delivery).Error
+			if err != nil {
+				return err
+			}
+			if !delivery.Delivered {
+				delete(webhookMap, delivery.WebhookId)
+			}
+		}
+	}
+	return nil
+}
+
+// Redeliver sends the payload of a delivery again as a new delivery, right
+// away and regardless of whether the webhook is enabled.
+func (s *WebhookService) Redeliver(id int) (*model.WebhookDelivery, error) {
+	db := database.GetDB()
+	old := &model.WebhookDelivery{}
+	err := db.Model(model.WebhookDelivery{}).Where("id = ?", id).First(old).Error
+	if err != nil {
+		return nil, err
+	}
+	webhook, err := s.GetWebhook(old.WebhookId)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	delivery := &model.WebhookDelivery{
+		WebhookId:   old.WebhookId,
+		Event:       old.Event,
+		Payload:     old.Payload,
+		NextAttempt: now,
+		Time:        now,
+	}
+	err = db.Create(delivery).Error
+	if err != nil {
+		return nil, err
+	}
+	webhookDeliver.Lock()
+	defer webhookDeliver.Unlock()
+	s.deliver(webhook, delivery)
+	err = db.Save(delivery).Error
+	return delivery, err
+}
+
+// deliver makes one attempt to send a delivery and records its outcome. A
+// failed attempt is retried after 30 seconds, doubling with each attempt.
+func (s *WebhookService) deliver(webhook *model.Webhook, delivery *model.WebhookDelivery) {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttempt = now.UnixMilli()
+	delivery.StatusCode, delivery.Error = s.post(webhook, delivery, now)
+	delivery.Delivered = delivery.Error == ""
+	if !delivery.Delivered {
+		backoff := webhookBaseDelay * time.Duration(math.Pow(2, float64(delivery.Attempts-1)))
+		delivery.NextAttempt = now.Add(backoff).UnixMilli()
+	}
+}
+
+func (s *WebhookService) post(webhook *model.Webhook, delivery *model.WebhookDelivery, now time.Time) (int, string) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(timestamp + "." + delivery.Payload))
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", config.GetName()+"/"+config.GetVersion())
+	req.Header.Set("X-Webhook-Event", string(delivery.Event))
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(delivery.Id))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, resp.Status
+	}
+	return resp.StatusCode, ""
+}
+
+// PruneDeliveries deletes the finished deliveries older than the webhook log
+// retention.
+func (s *WebhookService) PruneDeliveries() error {
+	days, err := s.settingService.GetWebhookLogRetention()
+	if err != nil || days <= 0 {
+		return err
+	}
+	before := time.Now().AddDate(0, 0, -days).UnixMilli()
+	db := database.GetDB()
+	return db.Where("time < ? AND (delivered = ? OR attempts >= ?)", before, true, webhookMaxAttempts).
+		Delete(model.WebhookDelivery{}).Error
+}
+
+func (s *WebhookService) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookService) Enabled() bool {
+	db := database.GetDB()
+	var count int64
+	err := db.Model(model.Webhook{}).Where("enable = ?", true).Count(&count).Error
+	return err == nil && count > 0
+}
+
+// Send emits depleted, expired and renewed clients. A depleted client whose
+// expiry has passed is sent as expired.
+func (s *WebhookService) Send(notification *Notification) error {
+	switch notification.Event {
+	case model.NotifyDepleted:
+		if notification.ExpiryTime > 0 && notification.ExpiryTime <= notification.Time {
+			s.Emit(model.WebhookClientExpired, notification)
+		} else {
+			s.Emit(model.WebhookClientDepleted, notification)
+		}
+	case model.NotifyRenewed:
+		s.Emit(model.WebhookClientRenewed, notification)
+	}
+	return nil
+}
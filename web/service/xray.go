@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"x-ui-scratch/database"
+	"x-ui-scratch/database/model"
 	"x-ui-scratch/logger"
 	"x-ui-scratch/xray"
 )
@@ -11,8 +14,16 @@ import (
 type XrayService struct {
 	inboundService InboundService
 	settingService SettingService
+	speedService   SpeedService
+	webhookService WebhookService
+	xrayAPI        xray.XrayAPI
+}
 
-	/*	xrayAPI        xray.XrayAPI */
+// XrayEvent is the data of the xray.crashed and xray.restarted webhook
+// events. Result is the last output of a crashed Xray.
+type XrayEvent struct {
+	Version string `json:"version"`
+	Result  string `json:"result,omitempty"`
 }
 
 var (
@@ -20,6 +31,12 @@ var (
 
 	result string
 	lock   sync.Mutex
+
+	isNeedXrayRestart atomic.Bool
+
+	// crashChecked is the process whose exit was already reported or that
+	// was stopped on purpose.
+	crashChecked *xray.Process
 )
 
 func (s *XrayService) IsXrayRunning() bool {
@@ -47,6 +64,22 @@ func (s *XrayService) GetXrayResult() string {
 	return result
 }
 
+// GetXrayCrash reports whether Xray exited by itself with an error, along with
+// its last output. Each exit is reported once and stopping Xray through the
+// panel is not reported.
+func (s *XrayService) GetXrayCrash() (string, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	if p == nil || p == crashChecked || p.IsRunning() {
+		return "", false
+	}
+	crashChecked = p
+	if p.GetErr() == nil {
+		return "", false
+	}
+	return p.GetResult(), true
+}
+
 func (s *XrayService) GetXrayVersion() string {
 	if p == nil {
 		return "Unknown"
@@ -54,11 +87,32 @@ func (s *XrayService) GetXrayVersion() string {
 	return p.GetVersion()
 }
 
+// GetXrayTraffic returns the traffic counted by the running Xray since the
+// last call.
+func (s *XrayService) GetXrayTraffic() ([]*xray.Traffic, []*xray.ClientTraffic, error) {
+	if !s.IsXrayRunning() {
+		return nil, nil, errors.New("xray is not running")
+	}
+	err := s.xrayAPI.Init(p.GetAPIPort())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.xrayAPI.Close()
+
+	traffic, clientTraffic, err := s.xrayAPI.GetTraffic(true)
+	if err != nil {
+		logger.Debug("Failed to fetch Xray traffic:", err)
+		return nil, nil, err
+	}
+	return traffic, clientTraffic, nil
+}
+
 func (s *XrayService) StopXray() error {
 	lock.Lock()
 	defer lock.Unlock()
 	logger.Debug("Attempting to stop Xray...")
 	if s.IsXrayRunning() {
+		crashChecked = p
 		return p.Stop()
 	}
 	return errors.New("xray is not running")
@@ -69,7 +123,7 @@ func (s *XrayService) RestartXray(isForce bool) error {
 	defer lock.Unlock()
 	logger.Debug("restart xray, force:", isForce)
 	// s.GetXrayConfig 这是所有的 XrayConfig
-	xrayConfig, err := s.GetXrayConfig()
+	xrayConfig, targets, err := s.getXrayConfig()
 	if err != nil {
 		return err
 	}
@@ -89,110 +143,144 @@ func (s *XrayService) RestartXray(isForce bool) error {
 	if err != nil {
 		return err
 	}
+	setSpeedTargets(targets)
+	s.webhookService.Emit(model.WebhookXrayRestarted, &XrayEvent{Version: p.GetVersion()})
 	return nil
 }
 
 func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
+	xrayConfig, _, err := s.getXrayConfig()
+	return xrayConfig, err
+}
+
+// getXrayConfig builds the Xray config and returns the speed limit targets
+// configured in it.
+func (s *XrayService) getXrayConfig() (*xray.Config, []speedTarget, error) {
 	templateConfig, err := s.settingService.GetXrayConfigTemplate()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	xrayConfig := &xray.Config{}
 	err = json.Unmarshal([]byte(templateConfig), xrayConfig)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	s.inboundService.AddTraffic(nil, nil)
 
 	inbounds, err := s.inboundService.GetAllInbounds()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	inboundIds := make([]int, 0, len(inbounds))
+	for _, inbound := range inbounds {
+		inboundIds = append(inboundIds, inbound.Id)
+	}
+	linkedClients, err := s.inboundService.getLinkedClients(database.GetDB(), inboundIds)
+	if err != nil {
+		return nil, nil, err
 	}
 	for _, inbound := range inbounds {
 		if !inbound.Enable {
 			continue
 		}
-		// get settings clients
+		inboundConfig, err := genXrayInboundConfig(inbound, linkedClients[inbound.Id])
+		if err != nil {
+			return nil, nil, err
+		}
+		xrayConfig.InboundConfigs = append(xrayConfig.InboundConfigs, *inboundConfig)
+	}
+
+	targets, err := s.speedService.getTargets(database.GetDB())
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.speedService.addSpeedConfig(xrayConfig, targets)
+	if err != nil {
+		return nil, nil, err
+	}
+	return xrayConfig, targets, nil
+}
+
+// genXrayInboundConfig builds the Xray config of a single inbound, rendering
+// its enabled clients and the given linked clients into settings.clients and
+// dropping panel-only stream fields. inbound.Clients and inbound.ClientStats
+// must be loaded.
+func genXrayInboundConfig(inbound *model.Inbound, linkedClients []model.Client) (*xray.InboundConfig, error) {
+	if inbound.Protocol.HasClients() {
 		settings := map[string]interface{}{}
 		json.Unmarshal([]byte(inbound.Settings), &settings)
-		clients, ok := settings["clients"].([]interface{})
-		if ok {
-			// check users active or not
-			clientStats := inbound.ClientStats
-			for _, clientTraffic := range clientStats {
-				indexDecrease := 0
-				for index, client := range clients {
-					c := client.(map[string]interface{})
-					if c["email"] == clientTraffic.Email {
-						if !clientTraffic.Enable {
-							clients = RemoveIndex(clients, index-indexDecrease)
-							indexDecrease++
-							logger.Infof("Remove Inbound User %s due to expiration or traffic limit", c["email"])
-						}
-					}
-				}
-			}
 
-			// clear client config for additional parameters
-			var final_clients []interface{}
-			for _, client := range clients {
-				c := client.(map[string]interface{})
-				if c["enable"] != nil {
-					if enable, ok := c["enable"].(bool); ok && !enable {
-						continue
-					}
-				}
-				for key := range c {
-					if key != "email" && key != "id" && key != "password" && key != "flow" && key != "method" {
-						delete(c, key)
-					}
-					if c["flow"] == "xtls-rprx-vision-udp443" {
-						c["flow"] = "xtls-rprx-vision"
-					}
-				}
-				final_clients = append(final_clients, interface{}(c))
+		// check users active or not
+		disabledEmails := make(map[string]bool)
+		for _, clientTraffic := range inbound.ClientStats {
+			if !clientTraffic.Enable {
+				disabledEmails[clientTraffic.Email] = true
 			}
+		}
 
-			settings["clients"] = final_clients
-			modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
-			if err != nil {
-				return nil, err
+		finalClients := make([]interface{}, 0, len(inbound.Clients)+len(linkedClients))
+		for i := range inbound.Clients {
+			client := &inbound.Clients[i]
+			if !client.Enable {
+				continue
+			}
+			if disabledEmails[client.Email] {
+				logger.Infof("Remove Inbound User %s due to expiration or traffic limit", client.Email)
+				continue
 			}
+			finalClients = append(finalClients, genXrayClient(inbound.Protocol, client))
+		}
+		for i := range linkedClients {
+			finalClients = append(finalClients, genXrayClient(inbound.Protocol, &linkedClients[i]))
+		}
 
-			inbound.Settings = string(modifiedSettings)
+		settings["clients"] = finalClients
+		modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
+		if err != nil {
+			return nil, err
 		}
 
-		if len(inbound.StreamSettings) > 0 {
-			// Unmarshal stream JSON
-			var stream map[string]interface{}
-			json.Unmarshal([]byte(inbound.StreamSettings), &stream)
-
-			// Remove the "settings" field under "tlsSettings" and "realitySettings"
-			tlsSettings, ok1 := stream["tlsSettings"].(map[string]interface{})
-			realitySettings, ok2 := stream["realitySettings"].(map[string]interface{})
-			if ok1 || ok2 {
-				if ok1 {
-					delete(tlsSettings, "settings")
-				} else if ok2 {
-					delete(realitySettings, "settings")
-				}
-			}
+		inbound.Settings = string(modifiedSettings)
+	}
 
-			delete(stream, "externalProxy")
+	if len(inbound.StreamSettings) > 0 {
+		// Unmarshal stream JSON
+		var stream map[string]interface{}
+		json.Unmarshal([]byte(inbound.StreamSettings), &stream)
 
-			newStream, err := json.MarshalIndent(stream, "", "  ")
-			if err != nil {
-				return nil, err
+		// Remove the "settings" field under "tlsSettings" and "realitySettings"
+		tlsSettings, ok1 := stream["tlsSettings"].(map[string]interface{})
+		realitySettings, ok2 := stream["realitySettings"].(map[string]interface{})
+		if ok1 || ok2 {
+			if ok1 {
+				delete(tlsSettings, "settings")
+			} else if ok2 {
+				delete(realitySettings, "settings")
 			}
-			inbound.StreamSettings = string(newStream)
 		}
 
-		inboundConfig := inbound.GenXrayInboundConfig()
-		xrayConfig.InboundConfigs = append(xrayConfig.InboundConfigs, *inboundConfig)
+		delete(stream, "externalProxy")
+
+		newStream, err := json.MarshalIndent(stream, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		inbound.StreamSettings = string(newStream)
 	}
-	return xrayConfig, nil
+
+	return inbound.GenXrayInboundConfig(), nil
+}
+
+// SetToNeedRestart marks the running Xray as out of date. The web server
+// restarts it on its next check.
+func (s *XrayService) SetToNeedRestart() {
+	isNeedXrayRestart.Store(true)
+}
+
+func (s *XrayService) IsNeedRestartAndSetFalse() bool {
+	return isNeedXrayRestart.CompareAndSwap(true, false)
 }
 
 func RemoveIndex(s []interface{}, index int) []interface{} {
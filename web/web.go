@@ -14,6 +14,7 @@ import (
 	"x-ui-scratch/config"
 	"x-ui-scratch/logger"
 	"x-ui-scratch/web/controller"
+	"x-ui-scratch/web/job"
 	"x-ui-scratch/web/locale"
 	"x-ui-scratch/web/middleware"
 	"x-ui-scratch/web/service"
@@ -33,12 +34,16 @@ type Server struct {
 	cancel context.CancelFunc
 
 	settingService service.SettingService
+	xrayService    service.XrayService
+	speedService   service.SpeedService
+	tgbotService   service.Tgbot
 
 	cron *cron.Cron
 
 	index  *controller.IndexController
 	server *controller.ServerController
 	panel  *controller.XUIController
+	api    *controller.APIController
 
 	httpServer *http.Server
 	listener   net.Listener
@@ -68,6 +73,12 @@ type wrapAssetsFile struct {
 	fs.File
 }
 
+// EmbeddedAssets returns the static files of the panel, which the status
+// page of the subscription server uses as well.
+func EmbeddedAssets() fs.FS {
+	return &wrapAssetsFS{FS: assetsFS}
+}
+
 func NewServer() *Server {
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -90,14 +101,23 @@ func (s *Server) Start() (err error) {
 		return err
 	}
 
+	// Without the shaper the panel runs on, only speed limits are lost
+	if err := s.speedService.StartShaper(); err != nil {
+		logger.Warning("start speed limit shaper failed, speed limits are disabled:", err)
+	}
+
 	s.cron = cron.New(cron.WithLocation(loc), cron.WithSeconds())
 	s.cron.Start()
+	s.startTask()
 
 	engine, err := s.initRouter()
 	if err != nil {
 		return err
 	}
 
+	// The bot needs the localizer set up by initRouter
+	s.startTgbot()
+
 	listen, err := s.settingService.GetListen()
 	if err != nil {
 		return err
@@ -123,8 +143,61 @@ func (s *Server) Start() (err error) {
 	return nil
 }
 
+func (s *Server) startTask() {
+	// Collect traffic from Xray every 10 seconds
+	s.cron.AddJob("@every 10s", job.NewXrayTrafficJob())
+	// Roll traffic history up into days and months every 10 minutes
+	s.cron.AddJob("@every 10m", job.NewTrafficHistoryJob())
+	// Run due traffic reset schedules at the start of every hour, so missed
+	// resets are caught up after downtime
+	s.cron.AddJob("0 0 * * * *", job.NewTrafficResetJob())
+	// Alert the admins when Xray exits by itself, checked every 10 seconds
+	s.cron.AddJob("@every 10s", job.NewCheckXrayRunningJob())
+	// Retry failed webhook deliveries and prune old ones every 30 seconds
+	s.cron.AddJob("@every 30s", job.NewWebhookJob())
+	// Retry queued emails every minute
+	s.cron.AddJob("@every 1m", job.NewEmailJob())
+	// Prune subscription access logs and expired subscription ids every hour
+	s.cron.AddJob("@every 1h", job.NewSubAccessJob())
+	// Notify clients approaching or reaching their limits every minute
+	s.cron.AddJob("@every 1m", job.NewNotifyJob())
+	// Write the usage report of the previous month on the 1st at 00:30
+	s.cron.AddJob("0 30 0 1 * *", job.NewUsageReportJob())
+
+	// Check every 30 seconds whether an API change failed and Xray needs a restart
+	s.cron.AddFunc("@every 30s", func() {
+		if s.xrayService.IsNeedRestartAndSetFalse() {
+			err := s.xrayService.RestartXray(false)
+			if err != nil {
+				logger.Error("restart xray failed:", err)
+			}
+		}
+	})
+}
+
+// startTgbot starts the Telegram bot and its periodic report. The panel runs
+// on when the bot can not start.
+func (s *Server) startTgbot() {
+	err := s.tgbotService.Start()
+	if err != nil {
+		logger.Warning("start telegram bot failed:", err)
+		return
+	}
+	if !s.tgbotService.IsRunning() {
+		return
+	}
+	runTime, err := s.settingService.GetTgRunTime()
+	if err == nil && runTime != "" {
+		_, err = s.cron.AddJob(runTime, job.NewTgbotReportJob())
+	}
+	if err != nil {
+		logger.Warning("add telegram report job failed:", err)
+	}
+}
+
 func (s *Server) Stop() error {
-	return nil
+	s.tgbotService.Stop()
+	return s.speedService.StopShaper()
 }
 
 func (s *Server) initRouter() (*gin.Engine, error) {
@@ -208,7 +281,7 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 	s.index = controller.NewIndexController(g)
 	s.server = controller.NewServerController(g)
 	s.panel = controller.NewXUIController(g)
-	// s.api = controller.NewAPIController(g)
+	s.api = controller.NewAPIController(g)
 
 	return engine, nil
 }
@@ -2,13 +2,19 @@ package xray
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"regexp"
 	"time"
+	"x-ui-scratch/config"
 
 	"github.com/xtls/xray-core/app/proxyman/command"
+	routingService "github.com/xtls/xray-core/app/router/command"
 	statsService "github.com/xtls/xray-core/app/stats/command"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/infra/conf"
 	"github.com/xtls/xray-core/proxy/shadowsocks"
 	"github.com/xtls/xray-core/proxy/shadowsocks_2022"
 	"github.com/xtls/xray-core/proxy/trojan"
@@ -21,6 +27,7 @@ import (
 type XrayAPI struct {
 	HandlerServiceClient *command.HandlerServiceClient
 	StatsServiceClient   *statsService.StatsServiceClient
+	RoutingServiceClient *routingService.RoutingServiceClient
 	grpcClient           *grpc.ClientConn
 	isConnected          bool
 }
@@ -41,9 +48,11 @@ func (x *XrayAPI) Init(apiPort int) error {
 
 	hsClient := command.NewHandlerServiceClient(conn)
 	ssClient := statsService.NewStatsServiceClient(conn)
+	rsClient := routingService.NewRoutingServiceClient(conn)
 
 	x.HandlerServiceClient = &hsClient
 	x.StatsServiceClient = &ssClient
+	x.RoutingServiceClient = &rsClient
 
 	return nil
 }
@@ -114,6 +123,7 @@ func (x *XrayAPI) Close() {
 	}
 	x.HandlerServiceClient = nil
 	x.StatsServiceClient = nil
+	x.RoutingServiceClient = nil
 	x.isConnected = false
 }
 
@@ -135,6 +145,25 @@ func (x *XrayAPI) RemoveUser(inboundTag, email string) error {
 	return nil
 }
 
+func (x *XrayAPI) AddInbound(inbound []byte) error {
+	client := *x.HandlerServiceClient
+
+	inboundConfig := new(conf.InboundDetourConfig)
+	err := json.Unmarshal(inbound, inboundConfig)
+	if err != nil {
+		return fmt.Errorf("failed to parse inbound config: %w", err)
+	}
+	config, err := inboundConfig.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build inbound config: %w", err)
+	}
+
+	_, err = client.AddInbound(context.Background(), &command.AddInboundRequest{
+		Inbound: config,
+	})
+	return err
+}
+
 func (x *XrayAPI) DelInbound(tag string) error {
 	client := *x.HandlerServiceClient
 	_, err := client.RemoveInbound(context.Background(), &command.RemoveInboundRequest{
@@ -142,3 +171,124 @@ func (x *XrayAPI) DelInbound(tag string) error {
 	})
 	return err
 }
+
+func (x *XrayAPI) AddOutbound(outbound []byte) error {
+	client := *x.HandlerServiceClient
+
+	outboundConfig := new(conf.OutboundDetourConfig)
+	err := json.Unmarshal(outbound, outboundConfig)
+	if err != nil {
+		return fmt.Errorf("failed to parse outbound config: %w", err)
+	}
+	config, err := outboundConfig.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build outbound config: %w", err)
+	}
+
+	_, err = client.AddOutbound(context.Background(), &command.AddOutboundRequest{
+		Outbound: config,
+	})
+	return err
+}
+
+func (x *XrayAPI) DelOutbound(tag string) error {
+	client := *x.HandlerServiceClient
+	_, err := client.RemoveOutbound(context.Background(), &command.RemoveOutboundRequest{
+		Tag: tag,
+	})
+	return err
+}
+
+// SetRouting replaces the rules and balancers of the running Xray with those
+// of a routing config given in the JSON format of the config.
+func (x *XrayAPI) SetRouting(routing []byte) error {
+	client := *x.RoutingServiceClient
+
+	// The rules are built here, so geoip and geosite rules need the geo files
+	// next to the Xray binary.
+	if _, ok := os.LookupEnv("XRAY_LOCATION_ASSET"); !ok {
+		os.Setenv("XRAY_LOCATION_ASSET", config.GetBinFolderPath())
+	}
+	routerConfig := new(conf.RouterConfig)
+	err := json.Unmarshal(routing, routerConfig)
+	if err != nil {
+		return fmt.Errorf("failed to parse routing config: %w", err)
+	}
+	config, err := routerConfig.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build routing config: %w", err)
+	}
+
+	_, err = client.AddRule(context.Background(), &routingService.AddRuleRequest{
+		Config:       serial.ToTypedMessage(config),
+		ShouldAppend: false,
+	})
+	return err
+}
+
+var trafficRegex = regexp.MustCompile(`(inbound|outbound)>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
+var clientTrafficRegex = regexp.MustCompile(`user>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
+
+// GetTraffic returns the inbound, outbound and client traffic counted by Xray
+// since the last reset, resetting the counters when reset is true.
+func (x *XrayAPI) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
+	if x.StatsServiceClient == nil {
+		return nil, nil, fmt.Errorf("xray api is not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := (*x.StatsServiceClient).QueryStats(ctx, &statsService.QueryStatsRequest{Reset_: reset})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query stats: %w", err)
+	}
+
+	tagTrafficMap := make(map[string]*Traffic)
+	emailTrafficMap := make(map[string]*ClientTraffic)
+	for _, stat := range resp.GetStat() {
+		if matches := trafficRegex.FindStringSubmatch(stat.Name); len(matches) == 4 {
+			isInbound := matches[1] == "inbound"
+			tag := matches[2]
+			if isInbound && tag == "api" {
+				continue
+			}
+			traffic, ok := tagTrafficMap[tag]
+			if !ok {
+				traffic = &Traffic{
+					IsInbound:  isInbound,
+					IsOutbound: !isInbound,
+					Tag:        tag,
+				}
+				tagTrafficMap[tag] = traffic
+			}
+			if matches[3] == "downlink" {
+				traffic.Down = stat.Value
+			} else {
+				traffic.Up = stat.Value
+			}
+		} else if matches := clientTrafficRegex.FindStringSubmatch(stat.Name); len(matches) == 3 {
+			email := matches[1]
+			traffic, ok := emailTrafficMap[email]
+			if !ok {
+				traffic = &ClientTraffic{Email: email}
+				emailTrafficMap[email] = traffic
+			}
+			if matches[2] == "downlink" {
+				traffic.Down = stat.Value
+			} else {
+				traffic.Up = stat.Value
+			}
+		}
+	}
+
+	traffics := make([]*Traffic, 0, len(tagTrafficMap))
+	for _, traffic := range tagTrafficMap {
+		traffics = append(traffics, traffic)
+	}
+	clientTraffics := make([]*ClientTraffic, 0, len(emailTrafficMap))
+	for _, traffic := range emailTrafficMap {
+		clientTraffics = append(clientTraffics, traffic)
+	}
+	return traffics, clientTraffics, nil
+}
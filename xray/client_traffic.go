@@ -2,12 +2,12 @@ package xray
 
 type ClientTraffic struct {
 	Id         int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
-	InboundId  int    `json:"inboundId" form:"inboundId"`
-	Enable     bool   `json:"enable" form:"enable"`
+	InboundId  int    `json:"inboundId" form:"inboundId" gorm:"index"`
+	Enable     bool   `json:"enable" form:"enable" gorm:"index"`
 	Email      string `json:"email" form:"email" gorm:"unique"`
 	Up         int64  `json:"up" form:"up"`
 	Down       int64  `json:"down" form:"down"`
-	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
+	ExpiryTime int64  `json:"expiryTime" form:"expiryTime" gorm:"index"`
 	Total      int64  `json:"total" form:"total"`
 	Reset      int    `json:"reset" form:"reset" gorm:"default:0"`
 }
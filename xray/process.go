@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
 	"x-ui-scratch/config"
@@ -27,7 +29,10 @@ type process struct {
 	exitErr   error
 	logWriter *LogWriter
 
-	version       string
+	version string
+
+	// onlineClients is written by the traffic job and read by requests.
+	onlineLock    sync.RWMutex
 	onlineClients []string
 
 	apiPort int
@@ -80,9 +85,18 @@ func GetBinaryName() string {
 }
 
 func (p *Process) SetOnlineClients(users []string) {
+	p.onlineLock.Lock()
+	defer p.onlineLock.Unlock()
 	p.onlineClients = users
 }
 
+// GetOnlineClients returns a copy of the emails of the online clients.
+func (p *Process) GetOnlineClients() []string {
+	p.onlineLock.RLock()
+	defer p.onlineLock.RUnlock()
+	return slices.Clone(p.onlineClients)
+}
+
 func (p *Process) GetAPIPort() int {
 	return p.apiPort
 }
@@ -0,0 +1,80 @@
+package shaper
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket refilled at rate bytes per second, holding at most
+// one second of tokens.
+type bucket struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (b *bucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	b.tokens = min(b.tokens, float64(rate))
+}
+
+// take removes n tokens and returns how long to wait until they were
+// available. A bucket without a rate never waits.
+func (b *bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(b.rate), float64(b.rate))
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// wait blocks until n bytes may pass all buckets.
+func wait(buckets []*bucket, n int) {
+	var delay time.Duration
+	for _, b := range buckets {
+		delay = max(delay, b.take(n))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// copyShaped copies from src to dst, letting the data pass the buckets.
+func copyShaped(dst io.Writer, src io.Reader, buckets []*bucket) error {
+	buf := make([]byte, 16*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			wait(buckets, n)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
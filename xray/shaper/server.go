@@ -0,0 +1,495 @@
+// Package shaper implements a local SOCKS5 server that limits the bandwidth
+// of the traffic Xray routes through it. Xray authenticates to it with one
+// user per limited client or inbound, and the traffic of each user passes the
+// token buckets the Resolver returns for it. The shaper does not dial targets
+// itself: it passes the traffic back to Xray through the Upstream SOCKS5
+// server, so Xray still picks the outbound it leaves through.
+package shaper
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"x-ui-scratch/logger"
+)
+
+// Limit is a token bucket the traffic of a user has to pass. Rate is in bytes
+// per second for each direction; users sharing a Key share the bucket.
+type Limit struct {
+	Key  string
+	Rate int64
+}
+
+// Resolver returns the limits of a user, or an error for unknown users.
+type Resolver func(user string) ([]Limit, error)
+
+// Upstream is the SOCKS5 server shaped traffic is sent to, authenticated
+// with username and password.
+type Upstream struct {
+	Addr string
+	User string
+	Pass string
+}
+
+type Server struct {
+	password func(user string) string
+	resolve  Resolver
+	upstream Upstream
+
+	listener net.Listener
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	// users counts the connections of each user and keys holds the buckets
+	// they pass.
+	users map[string]int
+	keys  map[string][]string
+}
+
+const handshakeTimeout = 10 * time.Second
+
+func NewServer(password func(user string) string, resolve Resolver, upstream Upstream) *Server {
+	return &Server{
+		password: password,
+		resolve:  resolve,
+		upstream: upstream,
+		buckets:  make(map[string]*bucket),
+		users:    make(map[string]int),
+		keys:     make(map[string][]string),
+	}
+}
+
+// Start listens on addr and serves connections in the background.
+func (s *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				logger.Warning("shaper accept failed:", err)
+				continue
+			}
+			go s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Refresh resolves the limits of the connected users again, so changed
+// rates apply to open connections, and drops the buckets none of them passes.
+func (s *Server) Refresh() {
+	s.mu.Lock()
+	users := make([]string, 0, len(s.users))
+	for user := range s.users {
+		users = append(users, user)
+	}
+	s.mu.Unlock()
+	for _, user := range users {
+		s.getBuckets(user)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used := make(map[string]bool, len(s.buckets))
+	for _, keys := range s.keys {
+		for _, key := range keys {
+			used[key] = true
+		}
+	}
+	for key := range s.buckets {
+		if !used[key] {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// getBuckets returns the upload and download buckets of a user, updating
+// their rates.
+func (s *Server) getBuckets(user string) ([]*bucket, []*bucket, error) {
+	limits, err := s.resolve(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	get := func(key string, rate int64) *bucket {
+		b, ok := s.buckets[key]
+		if !ok {
+			b = newBucket(rate)
+			s.buckets[key] = b
+		} else {
+			b.setRate(rate)
+		}
+		return b
+	}
+	var up, down []*bucket
+	keys := make([]string, 0, 2*len(limits))
+	for _, limit := range limits {
+		up = append(up, get(limit.Key+">up", limit.Rate))
+		down = append(down, get(limit.Key+">down", limit.Rate))
+		keys = append(keys, limit.Key+">up", limit.Key+">down")
+	}
+	if s.users[user] > 0 {
+		s.keys[user] = keys
+	}
+	return up, down, nil
+}
+
+func (s *Server) track(user string, delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user] += delta
+	if s.users[user] <= 0 {
+		delete(s.users, user)
+		delete(s.keys, user)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	user, err := s.handshake(conn)
+	if err != nil {
+		logger.Debug("shaper handshake failed:", err)
+		return
+	}
+	s.track(user, 1)
+	defer s.track(user, -1)
+	up, down, err := s.getBuckets(user)
+	if err != nil {
+		logger.Debug("shaper user rejected:", err)
+		return
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	target, err := readAddr(conn)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	switch header[1] {
+	case 1:
+		s.connect(conn, target, up, down)
+	case 3:
+		s.associate(conn, up, down)
+	default:
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// handshake negotiates username/password authentication and returns the user.
+func (s *Server) handshake(conn net.Conn) (string, error) {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 5 {
+		return "", fmt.Errorf("unsupported socks version %v", buf[0])
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	supported := false
+	for _, method := range methods {
+		if method == 2 {
+			supported = true
+		}
+	}
+	if !supported {
+		conn.Write([]byte{5, 0xff})
+		return "", errors.New("no username/password authentication offered")
+	}
+	conn.Write([]byte{5, 2})
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	name := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return "", err
+	}
+	user := string(name)
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return "", err
+	}
+	pass := buf[:buf[0]]
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare(pass, []byte(s.password(user))) != 1 {
+		conn.Write([]byte{1, 1})
+		return "", fmt.Errorf("invalid password for %v", user)
+	}
+	conn.Write([]byte{1, 0})
+	return user, nil
+}
+
+// dialUpstream authenticates to the upstream server and sends it a request,
+// returning the connection and the address the server bound.
+func (s *Server) dialUpstream(cmd byte, target string) (net.Conn, string, error) {
+	addr, err := encodeTarget(target)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := net.DialTimeout("tcp", s.upstream.Addr, handshakeTimeout)
+	if err != nil {
+		return nil, "", err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	bound, err := s.upstreamRequest(conn, cmd, addr)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (s *Server) upstreamRequest(conn net.Conn, cmd byte, addr []byte) (string, error) {
+	buf := make([]byte, 3)
+	if _, err := conn.Write([]byte{5, 1, 2}); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[1] != 2 {
+		return "", errors.New("upstream refused username/password authentication")
+	}
+	auth := append([]byte{1, byte(len(s.upstream.User))}, s.upstream.User...)
+	auth = append(auth, byte(len(s.upstream.Pass)))
+	auth = append(auth, s.upstream.Pass...)
+	if _, err := conn.Write(auth); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[1] != 0 {
+		return "", errors.New("upstream authentication failed")
+	}
+
+	if _, err := conn.Write(append([]byte{5, cmd, 0}, addr...)); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	if buf[1] != 0 {
+		return "", fmt.Errorf("upstream request failed with reply %v", buf[1])
+	}
+	return readAddr(conn)
+}
+
+func (s *Server) connect(conn net.Conn, target string, up []*bucket, down []*bucket) {
+	remote, _, err := s.dialUpstream(1, target)
+	if err != nil {
+		logger.Debug("shaper upstream connect failed:", err)
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer remote.Close()
+	conn.Write(append([]byte{5, 0, 0}, encodeAddr(remote.LocalAddr())...))
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src net.Conn, buckets []*bucket) {
+		copyShaped(dst, src, buckets)
+		if c, ok := dst.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(remote, conn, up)
+	go pipe(conn, remote, down)
+	<-done
+	<-done
+}
+
+// associate relays UDP packets between the client and the relay of the
+// upstream server for as long as both control connections stay open. The
+// packets keep their SOCKS headers, so the upstream server sees the targets
+// the client sent them to.
+func (s *Server) associate(conn net.Conn, up []*bucket, down []*bucket) {
+	upstream, bound, err := s.dialUpstream(3, "0.0.0.0:0")
+	if err != nil {
+		logger.Debug("shaper upstream associate failed:", err)
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	upstreamRelay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	if upstreamRelay.IP.IsUnspecified() {
+		upstreamRelay.IP = upstream.RemoteAddr().(*net.TCPAddr).IP
+	}
+	ip := conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer relay.Close()
+	remote, err := net.DialUDP("udp", nil, upstreamRelay)
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer remote.Close()
+	conn.Write(append([]byte{5, 0, 0}, encodeAddr(relay.LocalAddr())...))
+
+	go func() {
+		io.Copy(io.Discard, conn)
+		relay.Close()
+		remote.Close()
+	}()
+	go func() {
+		io.Copy(io.Discard, upstream)
+		conn.Close()
+	}()
+
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				return
+			}
+			to := client.Load()
+			if to == nil {
+				continue
+			}
+			wait(down, n)
+			relay.WriteToUDP(buf[:n], to)
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if to := client.Load(); to == nil {
+			client.Store(from)
+		} else if !to.IP.Equal(from.IP) || to.Port != from.Port {
+			continue
+		}
+		// Fragmented packets are not supported.
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		wait(up, n)
+		remote.Write(buf[:n])
+	}
+}
+
+// readAddr reads a SOCKS address and port.
+func readAddr(r io.Reader) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", err
+	}
+	var host string
+	switch buf[0] {
+	case 1, 4:
+		size := net.IPv4len
+		if buf[0] == 4 {
+			size = net.IPv6len
+		}
+		if _, err := io.ReadFull(r, buf[:size]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:size]).String()
+	case 3:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", err
+		}
+		size := int(buf[0])
+		if _, err := io.ReadFull(r, buf[:size]); err != nil {
+			return "", err
+		}
+		host = string(buf[:size])
+	default:
+		return "", fmt.Errorf("unsupported address type %v", buf[0])
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// encodeTarget encodes a host and port as a SOCKS address and port.
+func encodeTarget(target string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %v", host)
+		}
+		b = append([]byte{3, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{1}, ip4...)
+	} else {
+		b = append([]byte{4}, ip...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// encodeAddr encodes an address as a SOCKS address and port.
+func encodeAddr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{1}, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append([]byte{4}, ip16...)
+	} else {
+		b = []byte{1, 0, 0, 0, 0}
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}